@@ -1,9 +1,12 @@
 package server
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
 	/*"net"*/
@@ -14,7 +17,11 @@ import (
 	"github.com/go-i2p/i2pkeys"
 	//sam
 	"github.com/go-i2p/onramp"
+	pionlogging "github.com/pion/logging"
 	"github.com/yuukanoo/rtchat/internal/handler"
+	"github.com/yuukanoo/rtchat/internal/handler/websocket"
+	"github.com/yuukanoo/rtchat/internal/health"
+	"github.com/yuukanoo/rtchat/internal/ice"
 	"github.com/yuukanoo/rtchat/internal/logging"
 	"github.com/yuukanoo/rtchat/internal/service"
 	"github.com/yuukanoo/rtchat/internal/turn"
@@ -27,39 +34,70 @@ var r handler.Router
 var turnServer turn.Server
 var serv service.Service
 var logger logging.Logger
+var supervisor *health.Supervisor
 var err error
 
+// mutex guards the garlic listener which is rebuilt when the router restarts.
+var mutex sync.Mutex
+
+var garlicOptions = []string{"inbound.length=1", "outbound.length=1",
+	"inbound.backupQuantity=2", "outbound.backupQuantity=2",
+	"inbound.quantity=3", "outbound.quantity=3"}
+
 func Serve(e Flags, appname string) string {
-	logger = logging.New(false)
+	logger = logging.New(*e.Debug)
+
+	if err := e.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := e.Turn.loadExternal(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Pion components log through the same logger as the rest of rtchat
+	e.Turn.loggerFactory, err = logging.NewPionFactory(logger, *e.PionLog)
+
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Instantiates the service that creates rooms
 	serv = service.New()
 
-	// Instantiate and launch the turn server
-	turnServer, err = turn.New(serv, logger, &e.Turn)
+	// Watches the sam bridge to rebuild sessions when the router restarts
+	supervisor = health.New(e.Turn.SAMAddress(), e.Turn.I2p.ProbeInterval(), logger)
+	e.Turn.lost = func(err error) { supervisor.Lost("turn", err) }
 
+	garlic, err = onramp.NewGarlic(appname, e.Turn.SAMAddress(), garlicOptions)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Instantiate and launch the turn server unless relaying is left to
+	// external servers
+	if e.Turn.Builtin() {
+		turnServer, err = turn.New(serv, logger, &e.Turn)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// URLs given to clients point to the actual listener
+		e.Turn.host = turnServer.Host()
+		e.Turn.tlsHost = turnServer.TLSHost()
+	}
+
 	//defer turnServer.Close()
 
 	// Instantiate the application router
-	r, err = handler.New(serv, logger, &e.Turn)
+	r, err = handler.New(serv, logger, &routerOptions{&e.Turn, &e.Web}, turnServer, supervisor)
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	//defer r.Close()
-	garlic, err = onramp.NewGarlic(appname, e.Turn.SAMAddress(),
-		[]string{"inbound.length=1", "outbound.length=1",
-			"inbound.backupQuantity=2", "outbound.backupQuantity=2",
-			"inbound.quantity=3", "outbound.quantity=3"},
-	)
-	if err != nil {
-		log.Fatal(err)
-	}
 	l, err = garlic.ListenTLS()
 	if err != nil {
 		log.Fatal(err)
@@ -75,12 +113,17 @@ func Serve(e Flags, appname string) string {
 		WriteTimeout: 100 * time.Second,
 	}
 
-	go func() {
-		if err := s.Serve(l); err != http.ErrServerClosed {
-			log.Fatal(err)
-		}
-		log.Println("Server closed")
-	}()
+	go serve(l)
+
+	supervisor.Watch("web", func() error {
+		return reconnectWeb(appname, e.Turn.SAMAddress())
+	})
+
+	if turnServer != nil {
+		supervisor.Watch("turn", turnServer.Reconnect)
+	}
+
+	go supervisor.Run()
 
 	logger.Info(`HTTPS server launched:
 	Listening:	https://%s`, e.Web.Address())
@@ -88,50 +131,314 @@ func Serve(e Flags, appname string) string {
 	return fmt.Sprintf("https://%s", l.Addr().(i2pkeys.I2PAddr).Base32())
 }
 
+// serve the web server on the given listener. If the listener is lost without
+// being replaced, the supervisor rebuilds it.
+func serve(listener net.Listener) {
+	err := s.Serve(listener)
+
+	if err == http.ErrServerClosed {
+		log.Println("Server closed")
+		return
+	}
+
+	mutex.Lock()
+	replaced := listener != l
+	mutex.Unlock()
+
+	if !replaced {
+		supervisor.Lost("web", err)
+	}
+}
+
+// reconnectWeb rebuilds the garlic listener with the same keys, so the address
+// of the web server does not change, and serves it.
+func reconnectWeb(appname, samAddress string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// The bridge would refuse a duplicated destination
+	l.Close()
+	garlic.Close()
+
+	g, err := onramp.NewGarlic(appname, samAddress, garlicOptions)
+
+	if err != nil {
+		return err
+	}
+
+	listener, err := g.ListenTLS()
+
+	if err != nil {
+		g.Close()
+		return err
+	}
+
+	garlic, l = g, listener
+	go serve(listener)
+
+	return nil
+}
+
 func Close() {
+	supervisor.Close()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
 	garlic.Close()
 	s.Close()
 	l.Close()
 	r.Close()
-	turnServer.Close()
+
+	if turnServer != nil {
+		turnServer.Close()
+	}
 }
 
 // Flags represents options which can be passed to internal packages.
 type Flags struct {
-	//debug *bool
-	Turn TurnFlags
-	Web  WebFlags
+	Debug *bool
+	// Levels of pion components by scope, such as "warn,turn=debug".
+	PionLog *string
+	Turn    TurnFlags
+	Web     WebFlags
 	//I2p  I2pFlags
 	/*	tls   tlsFlags*/
 }
 
+// Validate checks that flags are consistent before launching anything.
+func (f *Flags) Validate() error {
+	if !f.Turn.Builtin() && *f.Turn.ICEServersString == "" {
+		return fmt.Errorf("the built-in turn server is disabled but no external server is given")
+	}
+
+	// The web server and I2P relays are both served through the sam bridge
+	if *f.Turn.I2p.SamIP == "" {
+		return fmt.Errorf("sam ip should be given")
+	}
+
+	if p := *f.Turn.I2p.SamPort; p <= 0 || p > 65535 {
+		return fmt.Errorf("sam port should be between 1 and 65535, got %d", p)
+	}
+
+	if f.Turn.I2p.ProbeInterval() <= 0 {
+		return fmt.Errorf("sam probe interval should be positive, got %s", f.Turn.I2p.ProbeInterval())
+	}
+
+	if p := f.Turn.Port(); f.Turn.Builtin() && (p <= 0 || p > 65535) {
+		return fmt.Errorf("turn port should be between 1 and 65535, got %d", p)
+	}
+
+	if f.Turn.RelayPoolSize() < 0 {
+		return fmt.Errorf("turn relay pool size should be positive, got %d", f.Turn.RelayPoolSize())
+	}
+
+	if f.Turn.RoomAllocations() < 0 || f.Turn.CredentialAllocations() < 0 || f.Turn.RelayBitrate() < 0 || f.Turn.RelayBandwidth() < 0 || f.Turn.MaxLifetime() < 0 {
+		return fmt.Errorf("turn quotas should be positive or 0 for no limit")
+	}
+
+	// A single allocation could never use more than the whole server
+	if b, t := f.Turn.RelayBitrate(), f.Turn.RelayBandwidth(); b > 0 && t > 0 && b > t {
+		return fmt.Errorf("turn relay bitrate should be lower than the relay bandwidth, got %d and %d", b, t)
+	}
+
+	if p := f.Turn.TLSPort(); p < 0 || p > 65535 {
+		return fmt.Errorf("turn tls port should be between 0 and 65535, got %d", p)
+	}
+
+	if (*f.Turn.TLSCertString == "") != (*f.Turn.TLSKeyString == "") {
+		return fmt.Errorf("turn tls certificate and key should be given together")
+	}
+
+	// Browsers never accept the self signed certificate of the web server
+	if f.Turn.TLSPort() > 0 && *f.Turn.TLSCertString == "" {
+		return fmt.Errorf("the turn tls listener requires a certificate and its key")
+	}
+
+	if f.Turn.TLSPort() == 0 && *f.Turn.TLSHostString != "" {
+		return fmt.Errorf("turn tls host is given but the tls listener is disabled")
+	}
+
+	// The host ends up in a turns URL which already holds the port
+	if h := *f.Turn.TLSHostString; h != "" && (!strings.HasSuffix(h, ".i2p") || strings.ContainsAny(h, ":/")) {
+		return fmt.Errorf("turn tls host should be an I2P host name, got %q", h)
+	}
+
+	// Below three participants, a mesh is always cheaper than forwarding
+	if t := f.Web.SFUThreshold(); t != 0 && t < 3 {
+		return fmt.Errorf("sfu threshold should be 0 to disable switching or at least 3, got %d", t)
+	}
+
+	if f.Web.RoomCapacity() < 0 || f.Web.BroadcastCapacity() < 0 {
+		return fmt.Errorf("room capacities should be positive or 0 for no limit")
+	}
+
+	// Broadcast rooms are meant to host larger audiences
+	if r, b := f.Web.RoomCapacity(), f.Web.BroadcastCapacity(); r > 0 && b > 0 && b < r {
+		return fmt.Errorf("broadcast capacity should be higher than the room capacity, got %d and %d", b, r)
+	}
+
+	switch f.Web.ScreenSharing() {
+	case websocket.ScreenShareAnyone, websocket.ScreenShareModerators, websocket.ScreenShareSingle:
+	default:
+		return fmt.Errorf("unknown screen sharing policy %q", f.Web.ScreenSharing())
+	}
+
+	return nil
+}
+
 // TurnFlags contains turn server related configuration.
 type TurnFlags struct {
-	RealmString    *string
+	RealmString *string
+	// Ignored since the server only listens on I2P, it is kept so existing
+	// command lines still work.
 	PublicIPString *string
 	PortInt        *int
-	I2p            I2pFlags
+	AnonymousBool  *bool
+	RelayPoolInt   *int
+	// Quotas of the relay, 0 for no limit. Bitrates are in kbit/s.
+	RoomAllocationsInt       *int
+	CredentialAllocationsInt *int
+	RelayBitrateInt          *int
+	RelayBandwidthInt        *int
+	MaxLifetimeDuration      *time.Duration
+	// TLS listener, disabled if the port is 0. It requires a certificate
+	// trusted by browsers.
+	TLSPortInt    *int
+	TLSHostString *string
+	TLSCertString *string
+	TLSKeyString  *string
+	// External STUN and TURN servers are read from a JSON file. The built-in
+	// server may be disabled to leave relaying to them.
+	BuiltinBool      *bool
+	ICEServersString *string
+
+	I2p I2pFlags
+
+	external      []ice.Server
+	loggerFactory pionlogging.LoggerFactory
+	lost          func(error)
+	// Host of the launched turn server.
+	host string
+	// Destination of its TLS listener.
+	tlsHost string
 }
 
 // WebFlags contains web specific flags.
 type WebFlags struct {
-	Port *int
-	Host string
+	Port            *int
+	Host            string
+	SFUThresholdInt *int
+	RecordDirString *string
+	// Capacities of regular and broadcast rooms, 0 for no limit.
+	RoomCapacityInt      *int
+	BroadcastCapacityInt *int
+	ScreenShareString    *string
+}
+
+// routerOptions gathers flags needed by the application router.
+type routerOptions struct {
+	*TurnFlags
+	*WebFlags
 }
 
 type I2pFlags struct {
 	SamIP   *string
 	SamPort *int
+	// Interval at which the sam bridge is probed.
+	ProbeIntervalDuration *time.Duration
 }
 
-func (f *TurnFlags) Realm() string    { return *f.RealmString }
-func (f *TurnFlags) PublicIP() net.IP { return net.ParseIP(*f.PublicIPString) }
-func (f *TurnFlags) Port() int        { return *f.PortInt }
+func (f *I2pFlags) ProbeInterval() time.Duration { return *f.ProbeIntervalDuration }
+
+func (f *TurnFlags) Realm() string              { return *f.RealmString }
+func (f *TurnFlags) Port() int                  { return *f.PortInt }
+func (f *TurnFlags) Anonymous() bool            { return *f.AnonymousBool }
+func (f *TurnFlags) RelayPoolSize() int         { return *f.RelayPoolInt }
+func (f *TurnFlags) RoomAllocations() int       { return *f.RoomAllocationsInt }
+func (f *TurnFlags) CredentialAllocations() int { return *f.CredentialAllocationsInt }
+func (f *TurnFlags) RelayBitrate() int          { return *f.RelayBitrateInt }
+func (f *TurnFlags) RelayBandwidth() int        { return *f.RelayBandwidthInt }
+func (f *TurnFlags) MaxLifetime() time.Duration { return *f.MaxLifetimeDuration }
 func (f *TurnFlags) TurnURL() string {
-	return fmt.Sprintf("turn:%s:%d", *f.PublicIPString, *f.PortInt)
+	return fmt.Sprintf("turn:%s:%d", f.Host(), *f.PortInt)
 }
-func (f *TurnFlags) StunURL() string {
-	return fmt.Sprintf("stun:%s:%d", *f.PublicIPString, *f.PortInt)
+func (f *TurnFlags) TLSPort() int                             { return *f.TLSPortInt }
+func (f *TurnFlags) Builtin() bool                            { return *f.BuiltinBool }
+func (f *TurnFlags) LoggerFactory() pionlogging.LoggerFactory { return f.loggerFactory }
+func (f *TurnFlags) SessionLost(err error)                    { f.lost(err) }
+
+// loadExternal reads the external servers, if any. Anonymous rooms could not
+// connect if none of them may relay their streams.
+func (f *TurnFlags) loadExternal() error {
+	path := *f.ICEServersString
+
+	if path == "" {
+		return nil
+	}
+
+	servers, err := ice.Load(path)
+
+	if err != nil {
+		return err
+	}
+
+	if !f.Builtin() && len(servers) == 0 {
+		return fmt.Errorf("the built-in turn server is disabled but %s lists no server", path)
+	}
+
+	if !f.Builtin() && f.Anonymous() && !ice.Relays(servers) {
+		return fmt.Errorf("anonymous rooms are relay only but %s lists no turn server reached over %s or %s", path, ice.TransportI2P, ice.TransportTor)
+	}
+
+	f.external = servers
+
+	return nil
 }
-func (f *WebFlags) Address() string     { return fmt.Sprintf("%s:%d", f.Host, *f.Port) }
-func (f *TurnFlags) SAMAddress() string { return fmt.Sprintf("%s:%d", *f.I2p.SamIP, *f.I2p.SamPort) }
+
+// ICEServers lists the built-in server, unless it is disabled, followed by the
+// external ones. The built-in server refuses bindings from I2P destinations so
+// it is never advertised as a STUN server.
+func (f *TurnFlags) ICEServers() []ice.Server {
+	var servers []ice.Server
+
+	if f.Builtin() {
+		turnURLs := []string{f.TurnURL()}
+
+		if u := f.TurnsURL(); u != "" {
+			turnURLs = append(turnURLs, u)
+		}
+
+		servers = append(servers, ice.Server{URLs: turnURLs, Transport: ice.TransportI2P, Credential: ice.CredentialRoom})
+	}
+
+	return append(servers, f.external...)
+}
+func (f *TurnFlags) TurnsURL() string {
+	if *f.TLSPortInt == 0 {
+		return ""
+	}
+
+	host := *f.TLSHostString
+
+	if host == "" {
+		host = f.tlsHost
+	}
+
+	return fmt.Sprintf("turns:%s:%d?transport=tcp", host, *f.TLSPortInt)
+}
+func (f *TurnFlags) Certificate() (tls.Certificate, error) {
+	return tls.LoadX509KeyPair(*f.TLSCertString, *f.TLSKeyString)
+}
+
+// Host at which the built-in server is reached, the destination of its
+// listener.
+func (f *TurnFlags) Host() string          { return f.host }
+func (f *WebFlags) Address() string        { return fmt.Sprintf("%s:%d", f.Host, *f.Port) }
+func (f *WebFlags) SFUThreshold() int      { return *f.SFUThresholdInt }
+func (f *WebFlags) RecordDir() string      { return *f.RecordDirString }
+func (f *WebFlags) Recording() bool        { return *f.RecordDirString != "" }
+func (f *WebFlags) RoomCapacity() int      { return *f.RoomCapacityInt }
+func (f *WebFlags) BroadcastCapacity() int { return *f.BroadcastCapacityInt }
+func (f *WebFlags) ScreenSharing() string  { return *f.ScreenShareString }
+func (f *TurnFlags) SAMAddress() string    { return fmt.Sprintf("%s:%d", *f.I2p.SamIP, *f.I2p.SamPort) }
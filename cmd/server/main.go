@@ -10,6 +10,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	//sam
 
@@ -19,17 +20,43 @@ import (
 
 func main() {
 	e := server.Flags{
+		Debug:   flag.Bool("debug", false, "Should we launch in the debug mode?"),
+		PionLog: flag.String("pion-log", "warn", "Log levels of pion components by scope, such as warn,turn=debug."),
 		Turn: server.TurnFlags{
 			RealmString:    flag.String("realm", "rtchat.io", "Realm used by the turn server."),
-			PublicIPString: flag.String("turn-ip", "127.0.0.1", "IP Address that TURN can be contacted on. Should be publicly available."),
+			PublicIPString: flag.String("turn-ip", "127.0.0.1", "Ignored, the TURN server is reached at the I2P destination of its listener."),
 			PortInt:        flag.Int("turn-port", 3478, "Listening port for the TURN/STUN endpoint."),
+			AnonymousBool:  flag.Bool("anonymous", false, "Force every room to relay streams through the TURN server over I2P."),
+			RelayPoolInt:   flag.Int("turn-pool", 2, "Number of I2P relay sessions kept ready for new TURN allocations."),
+
+			RoomAllocationsInt:       flag.Int("turn-room-allocations", 0, "Maximum number of TURN allocations per room, 0 for no limit."),
+			CredentialAllocationsInt: flag.Int("turn-credential-allocations", 0, "Maximum number of TURN allocations per participant credential, 0 for no limit."),
+			RelayBitrateInt:          flag.Int("turn-bitrate", 0, "Maximum bitrate of a TURN allocation in kbit/s, 0 for no limit."),
+			RelayBandwidthInt:        flag.Int("turn-bandwidth", 0, "Maximum bitrate relayed by the TURN server in kbit/s, 0 for no limit."),
+			MaxLifetimeDuration:      flag.Duration("turn-max-lifetime", 0, "Duration after which TURN allocations stop relaying, 0 for no limit."),
+
+			TLSPortInt:    flag.Int("turn-tls-port", 0, "Listening port for TURN over TLS, 0 to disable."),
+			TLSHostString: flag.String("turn-tls-host", "", "I2P host name matching the TURN TLS certificate, defaults to the base32 destination of the TLS listener."),
+			TLSCertString: flag.String("turn-tls-cert", "", "Certificate file of the TURN TLS listener, required with -turn-tls-port."),
+			TLSKeyString:  flag.String("turn-tls-key", "", "Key file of the TURN TLS certificate."),
+
+			BuiltinBool:      flag.Bool("turn", true, "Launch the built-in TURN/STUN server, disable it to only rely on external servers."),
+			ICEServersString: flag.String("ice-servers", "", "JSON file listing external STUN and TURN servers advertised to peers."),
 			I2p: server.I2pFlags{
 				SamIP:   flag.String("sam-ip", "127.0.0.1", "IP address on which the Simple Anonymous Messaging bridge can be reached"),
 				SamPort: flag.Int("sam-port", 7656, "Port on which the Simple Anonymous Messaging bridge can be reached"),
+
+				ProbeIntervalDuration: flag.Duration("sam-probe-interval", 15*time.Second, "Interval at which the Simple Anonymous Messaging bridge is probed to rebuild lost sessions."),
 			},
 		},
 		Web: server.WebFlags{
-			Port: flag.Int("http-port", 5000, "Web server listening port."),
+			Port:            flag.Int("http-port", 5000, "Web server listening port."),
+			SFUThresholdInt: flag.Int("sfu-threshold", 0, "Number of participants from which rooms switch to the forwarding unit, 0 to disable."),
+			RecordDirString: flag.String("record-dir", "", "Directory in which room recordings are written, recording is disabled if empty."),
+
+			RoomCapacityInt:      flag.Int("room-capacity", 0, "Maximum number of participants in a room, 0 for no limit."),
+			BroadcastCapacityInt: flag.Int("broadcast-capacity", 500, "Maximum number of participants in a broadcast room, 0 for no limit."),
+			ScreenShareString:    flag.String("screen-share", "anyone", "Who may share its screen, anyone, moderators or single for one participant at a time."),
 		},
 	}
 
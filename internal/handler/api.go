@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/yuukanoo/rtchat/internal/handler/websocket"
+	"github.com/yuukanoo/rtchat/internal/health"
+	"github.com/yuukanoo/rtchat/internal/service"
+	"github.com/yuukanoo/rtchat/internal/turn"
+
+	"github.com/go-chi/chi"
+)
+
+// moderatorCookie holds the moderator key given to the room creator.
+const moderatorCookie = "rtchat_moderator"
+
+// roomInfo is what moderators know about a room.
+type roomInfo struct {
+	*websocket.RoomInfo
+	Relay turn.Usage `json:"relay"`
+}
+
+// setModeratorKey gives the moderator key of the room to the client. The cookie
+// is restricted to the room path.
+func setModeratorKey(w http.ResponseWriter, room *service.Room) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     moderatorCookie,
+		Value:    room.ModeratorKey,
+		Path:     "/rooms/" + room.ID,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// moderatorKey extracts the moderator key from the Authorization header or
+// from the cookie set at the room creation.
+func moderatorKey(req *http.Request) string {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	if cookie, err := req.Cookie(moderatorCookie); err == nil {
+		return cookie.Value
+	}
+
+	return ""
+}
+
+// moderatedRoom retrieves the room targeted by the request and checks that the
+// caller is one of its moderators. It writes the appropriate status if not.
+func (r *router) moderatedRoom(w http.ResponseWriter, req *http.Request) *service.Room {
+	room := r.service.GetRoom(chi.URLParam(req, "id"))
+
+	if room == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	if !room.IsModerator(moderatorKey(req)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil
+	}
+
+	return room
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// ShowRoomInfo returns what the realtime server knows about a room, such as
+// members profiles and media states, along with its usage of the relay.
+func (r *router) ShowRoomInfo(w http.ResponseWriter, req *http.Request) {
+	room := r.moderatedRoom(w, req)
+
+	if room == nil {
+		return
+	}
+
+	snapshot := r.ws.Room(room.ID)
+
+	if snapshot == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	info := &roomInfo{RoomInfo: snapshot}
+
+	if r.relay != nil {
+		info.Relay = r.relay.Usage(room.ID)
+	}
+
+	writeJSON(w, info)
+}
+
+// ShowHealth reports the state of the SAM bridge. It answers with a 503 status
+// while the bridge is not up so external probes notice it.
+func (r *router) ShowHealth(w http.ResponseWriter, req *http.Request) {
+	if r.health == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	status := r.health.Status()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if status.State != health.StateUp {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/yuukanoo/rtchat/internal/handler/websocket"
+	"github.com/yuukanoo/rtchat/internal/rtc"
+)
+
+var errRecordingDisabled = errors.New("recording is disabled")
+
+type (
+	// recorders keeps track of the recorder of each room.
+	recorders struct {
+		mutex sync.Mutex
+		items map[string]*rtc.Recorder
+	}
+)
+
+func (rs *recorders) closeAll() {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	for id, rec := range rs.items {
+		rec.Close()
+		delete(rs.items, id)
+	}
+}
+
+// StartRecorder makes a recorder join the given room if it is not already
+// recorded.
+func (r *router) StartRecorder(id string) error {
+	if !r.options.Recording() {
+		return errRecordingDisabled
+	}
+
+	room := r.service.GetRoom(id)
+
+	if room == nil {
+		return errRoomNotFound
+	}
+
+	if room.IsRelayOnly() {
+		return errRelayOnly
+	}
+
+	r.recorders.mutex.Lock()
+	defer r.recorders.mutex.Unlock()
+
+	if r.recorders.items[id] != nil {
+		return nil
+	}
+
+	pipe, err := r.ws.Join(id, []string{websocket.CapabilityRecorder})
+
+	if err != nil {
+		return err
+	}
+
+	rec, err := r.engine.Record(room, pipe, r.options.RecordDir())
+
+	if err != nil {
+		pipe.Close()
+		return err
+	}
+
+	r.recorders.items[id] = rec
+
+	go rec.Run()
+
+	// Forget about it as soon as it has left the room
+	go func() {
+		<-rec.Done()
+
+		r.recorders.mutex.Lock()
+		defer r.recorders.mutex.Unlock()
+
+		if r.recorders.items[id] == rec {
+			delete(r.recorders.items, id)
+		}
+	}()
+
+	return nil
+}
+
+// StopRecorder makes the recorder of the given room leave.
+func (r *router) StopRecorder(id string) error {
+	r.recorders.mutex.Lock()
+	rec := r.recorders.items[id]
+	delete(r.recorders.items, id)
+	r.recorders.mutex.Unlock()
+
+	if rec != nil {
+		return rec.Close()
+	}
+
+	return nil
+}
+
+// StartRecording starts recording a room on behalf of one of its moderators.
+func (r *router) StartRecording(w http.ResponseWriter, req *http.Request) {
+	room := r.moderatedRoom(w, req)
+
+	if room == nil {
+		return
+	}
+
+	if !r.options.Recording() {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	if room.IsRelayOnly() {
+		http.Error(w, errRelayOnly.Error(), http.StatusConflict)
+		return
+	}
+
+	if err := r.StartRecorder(room.ID); err != nil {
+		r.logger.Error("could not record %s: %s", room.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// StopRecording stops recording a room on behalf of one of its moderators.
+func (r *router) StopRecording(w http.ResponseWriter, req *http.Request) {
+	room := r.moderatedRoom(w, req)
+
+	if room == nil {
+		return
+	}
+
+	r.StopRecorder(room.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
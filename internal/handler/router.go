@@ -1,14 +1,31 @@
 package handler
 
 import (
+	"errors"
 	"html/template"
 	"net/http"
 
 	"github.com/yuukanoo/rtchat/internal/handler/websocket"
+	"github.com/yuukanoo/rtchat/internal/health"
+	"github.com/yuukanoo/rtchat/internal/ice"
 	"github.com/yuukanoo/rtchat/internal/logging"
+	"github.com/yuukanoo/rtchat/internal/metrics"
+	"github.com/yuukanoo/rtchat/internal/rtc"
 	"github.com/yuukanoo/rtchat/internal/service"
+	"github.com/yuukanoo/rtchat/internal/turn"
 
 	"github.com/go-chi/chi"
+	pionlogging "github.com/pion/logging"
+)
+
+var (
+	errRoomNotFound = errors.New("room not found")
+	// errRelayOnly is returned when a server side peer should join a relay only
+	// room. Such rooms are only given I2P relays which pion could not reach.
+	errRelayOnly = errors.New("server side peers could not join relay only rooms")
+	// errNoRelay is returned when a relay only room is requested but no TURN
+	// server could be given to it.
+	errNoRelay = errors.New("no turn server could relay the streams of relay only rooms")
 )
 
 type (
@@ -22,17 +39,53 @@ type (
 
 	// Options holds needed configuration for the router.
 	Options interface {
-		// TurnURL represents the turn server which should be used for the
-		// communication.
-		TurnURL() string
-		// StunURL represents the stun server used to establish connections.
-		StunURL() string
+		// ICEServers lists STUN and TURN servers which should be used for the
+		// communication, the built-in one and external ones.
+		ICEServers() []ice.Server
+		// LoggerFactory creates the loggers of pion components.
+		LoggerFactory() pionlogging.LoggerFactory
+		// Anonymous returns true if every room should be relay only.
+		Anonymous() bool
+		// SFUThreshold is the number of participants from which new rooms switch
+		// to the forwarding unit, 0 to disable.
+		SFUThreshold() int
+		// RecordDir is the directory in which recordings are written.
+		RecordDir() string
+		// Recording returns true if rooms could be recorded.
+		Recording() bool
+		// RoomCapacity is the maximum number of participants in a room, 0 for
+		// no limit.
+		RoomCapacity() int
+		// BroadcastCapacity is the maximum number of participants in a broadcast
+		// room, 0 for no limit.
+		BroadcastCapacity() int
+		// ScreenSharing is the policy deciding who may share its screen.
+		ScreenSharing() string
+	}
+
+	// Health reports the state of the SAM bridge.
+	Health interface {
+		// Status retrieves the current health of the bridge.
+		Status() health.Status
+	}
+
+	// Relay reports how rooms use the TURN server.
+	Relay interface {
+		websocket.Relay
+		// Usage retrieves the relay usage of the given room.
+		Usage(string) turn.Usage
 	}
 
 	router struct {
-		options Options
-		service service.Service
-		ws      websocket.Server
+		options   Options
+		service   service.Service
+		relay     Relay
+		health    Health
+		logger    logging.Logger
+		ws        websocket.Server
+		engine    *rtc.Engine
+		endpoints *endpoints
+		recorders *recorders
 		*chi.Mux
 
 		// Templates
@@ -42,20 +95,44 @@ type (
 )
 
 // New instantiates a new http handler ready to be used with an http server.
-func New(service service.Service, logger logging.Logger, options Options) (Router, error) {
+func New(service service.Service, logger logging.Logger, options Options, relay Relay, health Health) (Router, error) {
+	engine, err := rtc.New(logger, options)
+
+	if err != nil {
+		return nil, err
+	}
+
 	r := &router{
-		options: options,
-		service: service,
-		ws:      websocket.New(service, logger, chi.URLParam),
-		Mux:     chi.NewRouter(),
+		options:   options,
+		service:   service,
+		relay:     relay,
+		health:    health,
+		logger:    logger,
+		engine:    engine,
+		endpoints: &endpoints{items: make(map[string]*rtc.Endpoint)},
+		recorders: &recorders{items: make(map[string]*rtc.Recorder)},
+		Mux:       chi.NewRouter(),
 
 		homeTpl: template.Must(template.ParseFiles("templates/index.html")),
 		roomTpl: template.Must(template.ParseFiles("templates/room.html")),
 	}
 
+	r.ws = websocket.New(service, logger, chi.URLParam, options, r, relay)
+
 	r.Get("/ws/{id}", r.ws.Handle)
 	r.Post("/rooms", r.CreateRoom)
 	r.Get("/rooms/{id}", r.ShowRoom)
+	r.Get("/rooms/{id}/info", r.ShowRoomInfo)
+	r.Post("/rooms/{id}/recording", r.StartRecording)
+	r.Delete("/rooms/{id}/recording", r.StopRecording)
+	r.Get("/rooms/{id}/events", r.ws.HandleEvents)
+	r.Post("/rooms/{id}/messages", r.ws.HandlePost)
+	r.Post("/whip/{id}", r.Publish)
+	r.Delete("/whip/{id}/{resource}", r.StopEndpoint)
+	r.Post("/whep/{id}", r.View)
+	r.Delete("/whep/{id}/{resource}", r.StopEndpoint)
+	r.Get("/metrics", metrics.Handler)
+	r.Get("/health", r.ShowHealth)
 	r.Get("/", r.ShowHome)
 	r.Handle("/static/*", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 
@@ -70,7 +147,51 @@ func (r *router) ShowHome(w http.ResponseWriter, req *http.Request) {
 }
 
 func (r *router) CreateRoom(w http.ResponseWriter, req *http.Request) {
-	id := r.service.CreateRoom()
+	privacy := service.ParsePrivacy(req.FormValue("privacy"))
+
+	if r.options.Anonymous() {
+		privacy = service.PrivacyRelay
+	}
+
+	topology := service.ParseTopology(req.FormValue("topology"))
+
+	// The forwarding unit could not join relay only rooms
+	if privacy == service.PrivacyRelay && topology != service.TopologyMesh {
+		http.Error(w, errRelayOnly.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Only clearnet servers are left when the built-in one is disabled
+	if privacy == service.PrivacyRelay && !ice.Relays(r.options.ICEServers()) {
+		http.Error(w, errNoRelay.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Unless asked otherwise, rooms switch to the forwarding unit when needed
+	if req.FormValue("topology") == "" && r.options.SFUThreshold() > 0 && privacy != service.PrivacyRelay {
+		topology = service.TopologyAuto
+	}
+
+	id := r.service.CreateRoom(service.RoomOptions{
+		Privacy:  privacy,
+		Topology: topology,
+
+		RequireConsent: req.FormValue("consent") == "required",
+		Kind:           service.ParseKind(req.FormValue("kind")),
+	})
+	room := r.service.GetRoom(id)
+
+	if room.IsForwarded() {
+		if err := r.StartSFU(id); err != nil {
+			r.logger.Error("could not start the forwarding unit of %s: %s", id, err)
+			r.service.DeleteRoom(id)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// The creator of the room is its moderator
+	setModeratorKey(w, room)
 
 	// Check that the room has at least one user in it in a while to prevent
 	// empty rooms for staying forever.
@@ -87,24 +208,70 @@ func (r *router) ShowRoom(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Only moderators get their key back
+	key := moderatorKey(req)
+
+	if !room.IsModerator(key) {
+		key = ""
+	}
+
 	r.roomTpl.Execute(w, struct {
-		RoomID         string
-		RoomCredential string
-		TurnURL        string
-		StunURL        string
-		Username       string
-		Credential     string
+		RoomID          string
+		RoomCredential  string
+		ModeratorKey    string
+		TransportPolicy string
+		ICEServers      []ice.ICEServer
 	}{
-		RoomID:         room.ID,
-		RoomCredential: room.Credential,
-		TurnURL:        r.options.TurnURL(),
-		StunURL:        r.options.StunURL(),
-		Username:       room.ID,
-		Credential:     room.Credential,
+		RoomID:          room.ID,
+		RoomCredential:  room.Credential,
+		ModeratorKey:    key,
+		TransportPolicy: transportPolicy(room),
+		ICEServers:      ice.Configure(room, r.options.ICEServers()),
 	})
 }
 
+// StartSFU makes the forwarding unit join the given room. It leaves with the
+// last participant or when the room switches back to a mesh.
+func (r *router) StartSFU(id string) error {
+	room := r.service.GetRoom(id)
+
+	if room == nil {
+		return errRoomNotFound
+	}
+
+	if room.IsRelayOnly() {
+		return errRelayOnly
+	}
+
+	pipe, err := r.ws.Join(room.ID, []string{websocket.CapabilitySFU})
+
+	if err != nil {
+		return err
+	}
+
+	go r.engine.NewSFU(room, pipe).Run()
+
+	return nil
+}
+
+// Mixing returns true if the forwarding unit could mix audio.
+func (r *router) Mixing() bool {
+	return r.engine.CanMix()
+}
+
+// transportPolicy returns the ICE transport policy browsers should use in the
+// given room.
+func transportPolicy(room *service.Room) string {
+	if room.IsRelayOnly() {
+		return "relay"
+	}
+
+	return "all"
+}
+
 func (r *router) Close() error {
+	r.endpoints.closeAll()
+	r.recorders.closeAll()
 	return r.ws.Close()
 }
 
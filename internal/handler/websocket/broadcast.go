@@ -0,0 +1,74 @@
+package websocket
+
+import "github.com/yuukanoo/rtchat/internal/service"
+
+const (
+	// RolePresenter is given to clients publishing media in broadcast rooms.
+	RolePresenter = "presenter"
+	// RoleViewer is given to clients which only receive media in broadcast
+	// rooms.
+	RoleViewer = "viewer"
+)
+
+// role determines the role of a new client in the given room. Moderators and
+// in-process publishers present, everyone else watches. The forwarding unit and
+// the recorder have no role since they must reach every client.
+func role(room *service.Room, c *client) string {
+	if !room.IsBroadcast() || c.isSFU() || c.isRecorder() {
+		return ""
+	}
+
+	if c.moderator || (c.local && c.capabilities[CapabilityPresenter]) {
+		return RolePresenter
+	}
+
+	return RoleViewer
+}
+
+// isViewer checks if this client only receives media.
+func (c *client) isViewer() bool {
+	return c.role == RoleViewer
+}
+
+// capacity returns the maximum number of remote clients in the given room, 0
+// if unlimited.
+func (h *hub) capacity(room *service.Room) int {
+	if room.IsBroadcast() {
+		return h.options.BroadcastCapacity()
+	}
+
+	return h.options.RoomCapacity()
+}
+
+// admits checks if a new client could join the given room before upgrading its
+// connection. Clients resuming the session of one of its members are already
+// counted so they are let in. The hub checks again when registering the client
+// since the room may fill up in the meantime.
+func (h *hub) admits(room *service.Room, hs *handshake) bool {
+	if h.capacity(room) <= 0 {
+		return true
+	}
+
+	info := h.snapshot(room.ID, hs)
+
+	return info != nil && info.admits
+}
+
+// fits checks if the given registration could join its room as a new client.
+// In-process participants are not limited. It must be called from the hub
+// goroutine.
+func (h *hub) fits(reg *registration) bool {
+	if reg.hs.local {
+		return true
+	}
+
+	room := h.service.GetRoom(reg.room)
+
+	if room == nil {
+		return true
+	}
+
+	capacity := h.capacity(room)
+
+	return capacity <= 0 || h.participants(reg.room) < capacity
+}
@@ -0,0 +1,60 @@
+package websocket
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/yuukanoo/rtchat/internal/service"
+)
+
+func TestCapacityOnlyLetsMembersResume(t *testing.T) {
+	h, svc := startTestHub(t, testOptions{capacity: 1}, testController{})
+	room := svc.GetRoom(svc.CreateRoom(service.RoomOptions{}))
+
+	conn, status := dial(t, h, room)
+
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("the first client should be let in, got %d", status)
+	}
+
+	var m message
+
+	if err := conn.ReadJSON(&m); err != nil || m.Hello == nil {
+		t.Fatalf("no hello received: %v", err)
+	}
+
+	if _, status = dial(t, h, room, resumePrefix+"forged"); status != http.StatusServiceUnavailable {
+		t.Errorf("a forged resume token should not bypass the capacity, got %d", status)
+	}
+
+	conn.Close()
+
+	// Leave the hub some time to detach the client
+	time.Sleep(100 * time.Millisecond)
+
+	if _, status = dial(t, h, room, resumePrefix+m.Hello.ResumeToken); status != http.StatusSwitchingProtocols {
+		t.Errorf("the client should resume its session, got %d", status)
+	}
+}
+
+func TestRegisterChecksTheCapacity(t *testing.T) {
+	h, svc := startTestHub(t, testOptions{capacity: 1}, testController{})
+	room := svc.GetRoom(svc.CreateRoom(service.RoomOptions{}))
+
+	first, _ := dial(t, h, room)
+
+	var m message
+
+	if err := first.ReadJSON(&m); err != nil || m.Hello == nil {
+		t.Fatalf("no hello received: %v", err)
+	}
+
+	// A client which passed the handler check while the room was filling up
+	conn := newPipeConn()
+	h.enroll(&registration{room: room.ID, conn: conn, hs: &handshake{version: protocolVersion}})
+
+	if _, err := conn.Read(); err != errPipeClosed {
+		t.Errorf("the client should be refused once the room is full, got %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package websocket
+
+import (
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/yuukanoo/rtchat/internal/crypto"
+	"github.com/yuukanoo/rtchat/internal/service"
+)
+
+// maxChatLength is the maximum size of a chat message in bytes.
+const maxChatLength = 4096
+
+// validate sanitizes the chat message text and checks its size. Line breaks
+// and tabs are kept but every other control character is removed.
+func (p *chatPayload) validate() bool {
+	p.Text = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r != '\n' && r != '\t' && unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(p.Text, string(utf8.RuneError))))
+
+	return p.Text != "" && len(p.Text) <= maxChatLength
+}
+
+// handleChat stamps, stores and broadcasts a chat message to the whole room,
+// sender included so it gets the server identifier and timestamp.
+func (h *hub) handleChat(m *message) {
+	c := h.clients[m.From]
+
+	if c == nil || !m.Chat.validate() {
+		return
+	}
+
+	m.To = ""
+	m.Chat.ID = crypto.GenerateUID(16)
+	m.Chat.Time = time.Now().UTC()
+
+	h.service.PostMessage(c.room, service.Message{
+		ID:   m.Chat.ID,
+		From: m.From,
+		Text: m.Chat.Text,
+		Time: m.Chat.Time,
+	})
+
+	for _, cli := range h.rooms[c.room] {
+		if cli.accepts(m) {
+			cli.deliver(m)
+		}
+	}
+}
+
+// history builds chat messages to replay to the given client.
+func (h *hub) history(c *client) []*message {
+	history := h.service.History(c.room)
+	messages := make([]*message, len(history))
+
+	for i, entry := range history {
+		messages[i] = &message{
+			room: c.room,
+			From: entry.From,
+			To:   c.id,
+			Chat: &chatPayload{
+				ID:      entry.ID,
+				Text:    entry.Text,
+				Time:    entry.Time,
+				History: true,
+			},
+		}
+	}
+
+	return messages
+}
@@ -4,40 +4,229 @@ import (
 	"time"
 
 	"github.com/yuukanoo/rtchat/internal/crypto"
+)
 
-	"github.com/gorilla/websocket"
+const (
+	// sendBufferSize is the number of messages which could be waiting to be
+	// written on a connection before the client is considered too slow. It must
+	// be large enough to hold the chat history replayed to newcomers.
+	sendBufferSize = 256
+	// maxPending is the number of messages kept for a detached client.
+	maxPending = 512
 )
 
 type (
+	// connection represents a transport able to carry JSON messages between the
+	// hub and a client such as a websocket.
+	connection interface {
+		ReadJSON(interface{}) error
+		WriteJSON(interface{}) error
+		Close() error
+	}
+
 	client struct {
-		id   string
-		room string
-		conn *websocket.Conn
-		send chan *message
-		hub  *hub
+		id           string
+		room         string
+		token        string
+		version      int
+		local        bool
+		moderator    bool
+		consent      bool
+		role         string
+		watching     string
+		capabilities map[string]bool
+		presence     *presencePayload
+		media        *mediaPayload
+		tracks       []*trackPayload
+		conn         connection
+		send         chan *message
+		hub          *hub
+
+		// Set when the connection has been lost but the client may still resume
+		// its session.
+		detachedAt time.Time
+		pending    []*message
+	}
+
+	// disconnection is emitted by a read pump when its connection is lost.
+	disconnection struct {
+		client *client
+		conn   connection
 	}
 )
 
-func newClient(hub *hub, room string, conn *websocket.Conn) *client {
+func newClient(hub *hub, room string, conn connection, hs *handshake) *client {
 	return &client{
-		id:   crypto.GenerateUID(64),
-		room: room,
-		conn: conn,
-		hub:  hub,
-		send: make(chan *message),
+		id:           crypto.GenerateUID(64),
+		room:         room,
+		token:        crypto.GenerateUID(32),
+		version:      hs.version,
+		local:        hs.local,
+		moderator:    hs.moderator,
+		watching:     hs.watching,
+		capabilities: hs.capabilities,
+		conn:         conn,
+		hub:          hub,
+		send:         make(chan *message, sendBufferSize),
 	}
 }
 
-func (c *client) readPump() {
+// canResume checks if this client supports session resumption.
+func (c *client) canResume() bool {
+	return c.version != legacyVersion && !c.local
+}
+
+// isDetached checks if the client has lost its connection.
+func (c *client) isDetached() bool {
+	return c.conn == nil
+}
+
+// attach starts pumps for the current connection.
+func (c *client) attach() {
+	go c.readPump(c.conn)
+	go c.writePump(c.conn, c.send)
+}
+
+// reattach replaces the connection of this client and replays every message
+// queued while it was detached.
+func (c *client) reattach(conn connection) {
+	if !c.isDetached() {
+		c.detach()
+	}
+
+	c.conn = conn
+	c.send = make(chan *message, sendBufferSize)
+	c.detachedAt = time.Time{}
+	c.attach()
+}
+
+// replay flushes pending messages to the current connection.
+func (c *client) replay() {
+	pending := c.pending
+	c.pending = nil
+
+	for _, m := range pending {
+		c.deliver(m)
+	}
+}
+
+// detach closes the current connection and starts queueing messages for this
+// client.
+func (c *client) detach() {
+	close(c.send)
+	c.conn.Close()
+	c.conn = nil
+	c.send = nil
+	c.detachedAt = time.Now()
+}
+
+// deliver a message to this client without blocking. If the client is detached,
+// the message is kept to be replayed later. If it is too slow, its connection is
+// dropped and the message kept for when it resumes.
+func (c *client) deliver(m *message) {
+	if !c.isDetached() {
+		select {
+		case c.send <- m:
+			return
+		default:
+			c.detach()
+		}
+	}
+
+	if len(c.pending) >= maxPending {
+		c.pending = c.pending[1:]
+	}
+
+	c.pending = append(c.pending, m)
+}
+
+// isSFU checks if this client is the in-process forwarding unit of its room.
+func (c *client) isSFU() bool {
+	return c.local && c.capabilities[CapabilitySFU]
+}
+
+// isRecorder checks if this client is the in-process recorder of its room.
+func (c *client) isRecorder() bool {
+	return c.local && c.capabilities[CapabilityRecorder]
+}
+
+// notified checks if this client is told when its room is being recorded.
+func (c *client) notified() bool {
+	return c.version != legacyVersion && !c.local
+}
+
+// recordable checks if the recorder may receive media from this client, which
+// is only the case of notified clients and of the forwarding unit relaying
+// their media.
+func (c *client) recordable() bool {
+	return c.notified() || c.isSFU()
+}
+
+// exchangesWith checks if this client may exchange messages with the given
+// one. Viewers watching a participant only talk to it and to the forwarding
+// unit so other peers never try to connect with them. The recorder never
+// learns about clients which could not be told about the recording.
+func (c *client) exchangesWith(other *client) bool {
+	if (c.isRecorder() && !other.recordable()) || (other.isRecorder() && !c.recordable()) {
+		return false
+	}
+
+	return c.watching == "" || other.id == c.watching || other.isSFU()
+}
+
+// accepts checks if the given message could be understood by this client.
+func (c *client) accepts(m *message) bool {
+	return c.version != legacyVersion || m.IsLegacy()
+}
+
+// hello builds the hello message describing this client session.
+func (c *client) hello(resumed bool) *message {
+	f := serverFeatures()
+
+	return &message{
+		room: c.room,
+		To:   c.id,
+		Hello: &helloPayload{
+			Version:      c.version,
+			ID:           c.id,
+			ResumeToken:  c.token,
+			Resumed:      resumed,
+			Capabilities: capabilityList(c.capabilities),
+			Features:     &f,
+			Moderator:    c.moderator,
+			Role:         c.role,
+		},
+	}
+}
+
+// member builds the roster entry of this client.
+func (c *client) member() *memberPayload {
+	return &memberPayload{
+		ID:       c.id,
+		Presence: c.presence,
+		Media:    c.media,
+		Consent:  c.consent,
+		Role:     c.role,
+		Tracks:   c.tracks,
+
+		Capabilities: capabilityList(c.capabilities),
+	}
+}
+
+func (c *client) readPump(conn connection) {
 	defer func() {
-		c.hub.unregister <- c
-		c.conn.Close()
+		select {
+		case c.hub.unregister <- &disconnection{client: c, conn: conn}:
+		case <-c.hub.done:
+		}
+
+		conn.Close()
 	}()
 
 	for {
 		var m message
 
-		if err := c.conn.ReadJSON(&m); err != nil {
+		if err := conn.ReadJSON(&m); err != nil {
 			return
 		}
 
@@ -46,17 +235,21 @@ func (c *client) readPump() {
 		m.From = c.id
 
 		if m.IsAllowed() {
-			c.hub.send <- &m
+			select {
+			case c.hub.send <- &m:
+			case <-c.hub.done:
+				return
+			}
 		}
 	}
 }
 
-func (c *client) writePump() {
+func (c *client) writePump(conn connection, send <-chan *message) {
 	ticker := time.NewTicker(15 * time.Second)
 
 	defer func() {
 		ticker.Stop()
-		c.conn.Close()
+		conn.Close()
 	}()
 
 	for {
@@ -66,10 +259,14 @@ func (c *client) writePump() {
 
 		case <-ticker.C:
 			// Writes an empty message to keep the connection alive
-			err = c.conn.WriteJSON(message{})
+			err = conn.WriteJSON(message{})
+
+		case m, ok := <-send:
+			if !ok {
+				return
+			}
 
-		case m := <-c.send:
-			err = c.conn.WriteJSON(m)
+			err = conn.WriteJSON(m)
 
 		}
 
@@ -0,0 +1,37 @@
+package websocket
+
+// handleMedia stores the media state of the sending client and broadcasts it
+// to the room.
+func (h *hub) handleMedia(m *message) bool {
+	c := h.clients[m.From]
+
+	if c == nil {
+		return false
+	}
+
+	// Unless anyone may share its screen, the flag follows accepted tracks
+	if h.options.ScreenSharing() != ScreenShareAnyone {
+		m.Media.Screen = c.sharesScreen()
+	}
+
+	m.To = ""
+	m.Media.ID = c.id
+	c.media = m.Media
+
+	return true
+}
+
+// handleReaction validates a reaction which is broadcasted to the room but
+// never stored.
+func (h *hub) handleReaction(m *message) bool {
+	c := h.clients[m.From]
+
+	if c == nil || !isEmoji(m.Reaction.Emoji) {
+		return false
+	}
+
+	m.To = ""
+	m.Reaction.ID = c.id
+
+	return true
+}
@@ -1,14 +1,110 @@
 package websocket
 
+import "time"
+
 type (
+	helloPayload struct {
+		Version      int       `json:"version"`
+		ID           string    `json:"id,omitempty"`
+		ResumeToken  string    `json:"resumeToken,omitempty"`
+		Resumed      bool      `json:"resumed,omitempty"`
+		Capabilities []string  `json:"capabilities"`
+		Features     *features `json:"features,omitempty"`
+		// SFU is the identifier of the participant forwarding media in the room.
+		// When set, clients should only connect to it.
+		SFU string `json:"sfu,omitempty"`
+		// Moderator is set if the client has given the moderator key of the room.
+		Moderator bool `json:"moderator,omitempty"`
+		// Role of the client in broadcast rooms.
+		Role string `json:"role,omitempty"`
+	}
+
 	joinedPayload struct {
-		ID string `json:"id"`
+		ID           string   `json:"id"`
+		Role         string   `json:"role,omitempty"`
+		Capabilities []string `json:"capabilities,omitempty"`
 	}
 
 	leftPayload struct {
 		ID string `json:"id"`
 	}
 
+	presencePayload struct {
+		ID     string `json:"id,omitempty"`
+		Name   string `json:"name"`
+		Avatar string `json:"avatar,omitempty"`
+		Status string `json:"status,omitempty"`
+	}
+
+	mediaPayload struct {
+		ID       string `json:"id,omitempty"`
+		Audio    bool   `json:"audio"`
+		Video    bool   `json:"video"`
+		Screen   bool   `json:"screen"`
+		Hand     bool   `json:"hand"`
+		Speaking bool   `json:"speaking"`
+	}
+
+	reactionPayload struct {
+		ID    string `json:"id,omitempty"`
+		Emoji string `json:"emoji"`
+	}
+
+	memberPayload struct {
+		ID       string           `json:"id"`
+		Presence *presencePayload `json:"presence,omitempty"`
+		Media    *mediaPayload    `json:"media,omitempty"`
+		Consent  bool             `json:"consent,omitempty"`
+		Role     string           `json:"role,omitempty"`
+		Tracks   []*trackPayload  `json:"tracks,omitempty"`
+		// Capabilities are needed by server side participants to know how to
+		// serve each member.
+		Capabilities []string `json:"capabilities,omitempty"`
+	}
+
+	rosterPayload struct {
+		Members []*memberPayload `json:"members"`
+	}
+
+	recordPayload struct {
+		Active bool `json:"active"`
+	}
+
+	recordingPayload struct {
+		Active  bool `json:"active"`
+		Consent bool `json:"consent"`
+	}
+
+	consentPayload struct {
+		ID        string `json:"id,omitempty"`
+		Recording bool   `json:"recording"`
+	}
+
+	switchPayload struct {
+		Topology string `json:"topology"`
+		SFU      string `json:"sfu,omitempty"`
+	}
+
+	// trackPayload tells the purpose of a track published by a client. The
+	// track identifier is kept by the forwarding unit, unlike the stream one.
+	trackPayload struct {
+		Stream  string `json:"stream"`
+		Track   string `json:"track"`
+		Purpose string `json:"purpose"`
+	}
+
+	tracksPayload struct {
+		ID     string          `json:"id,omitempty"`
+		Tracks []*trackPayload `json:"tracks"`
+	}
+
+	chatPayload struct {
+		ID      string    `json:"id,omitempty"`
+		Text    string    `json:"text"`
+		Time    time.Time `json:"time"`
+		History bool      `json:"history,omitempty"`
+	}
+
 	sdpPayload struct {
 		Type string `json:"type"`
 		SDP  string `json:"sdp"`
@@ -24,13 +120,44 @@ type (
 	// message hold every message payload that exists in the system.
 	message struct {
 		room string
+		// viewer is set when the sender only receives media in a broadcast
+		// room, such messages are never delivered to other viewers.
+		viewer bool
 
 		From string `json:"from,omitempty"`
 		To   string `json:"to,omitempty"`
 
+		// Sent by the server as the first frame and by clients to update their
+		// capabilities.
+		Hello *helloPayload `json:"hello,omitempty"`
+
 		// Server based messages
 		Joined *joinedPayload `json:"joined,omitempty"`
 		Left   *leftPayload   `json:"left,omitempty"`
+		Roster *rosterPayload `json:"roster,omitempty"`
+		Switch *switchPayload `json:"switch,omitempty"`
+
+		// Sent by clients to update their profile and relayed to the room
+		Presence *presencePayload `json:"presence,omitempty"`
+
+		// Media state and reactions of a client, relayed to the room
+		Media    *mediaPayload    `json:"media,omitempty"`
+		Reaction *reactionPayload `json:"reaction,omitempty"`
+
+		// Purpose of the tracks published by a client, relayed to the room
+		Tracks *tracksPayload `json:"tracks,omitempty"`
+
+		// Text chat, stamped by the server and broadcasted to the room
+		Chat *chatPayload `json:"chat,omitempty"`
+
+		// Recording requests from moderators, notices sent by the server and
+		// consent of participants relayed to the room
+		Record    *recordPayload    `json:"record,omitempty"`
+		Recording *recordingPayload `json:"recording,omitempty"`
+		Consent   *consentPayload   `json:"consent,omitempty"`
+
+		// Allocations of the room on the TURN server, sent to moderators
+		Relay *relayPayload `json:"relay,omitempty"`
 
 		// Client messages
 		Offer  *sdpPayload `json:"offer,omitempty"`
@@ -41,7 +168,31 @@ type (
 
 // IsAllowed checks if this message is allowed from client.
 // It prevents malicious message sending without making the websocket stuff too
-// complex.
+// complex. Clients send one payload at a time since handlers broadcasting a
+// payload to the room would also broadcast the others.
 func (m *message) IsAllowed() bool {
-	return m.Joined == nil && m.Left == nil
+	return m.Joined == nil && m.Left == nil && m.Roster == nil && m.Switch == nil && m.Recording == nil && m.Relay == nil &&
+		m.payloads() <= 1
+}
+
+// payloads counts the payloads a client could send in this message.
+func (m *message) payloads() int {
+	n := 0
+
+	for _, set := range []bool{
+		m.Hello != nil, m.Presence != nil, m.Media != nil, m.Reaction != nil, m.Tracks != nil, m.Chat != nil,
+		m.Record != nil, m.Consent != nil, m.Offer != nil, m.Answer != nil, m.ICE != nil,
+	} {
+		if set {
+			n++
+		}
+	}
+
+	return n
+}
+
+// IsLegacy checks if this message can be understood by clients which have not
+// negotiated a protocol version.
+func (m *message) IsLegacy() bool {
+	return m.Joined != nil || m.Left != nil || m.Offer != nil || m.Answer != nil || m.ICE != nil
 }
@@ -0,0 +1,36 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMessageIsAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		allowed bool
+	}{
+		{"keepalive", `{}`, true},
+		{"chat", `{"chat":{"text":"hi"}}`, true},
+		{"directed offer", `{"to":"a","offer":{"type":"offer","sdp":"v=0"}}`, true},
+		{"chat with offer", `{"to":"a","chat":{"text":"hi"},"offer":{"type":"offer","sdp":"v=0"}}`, false},
+		{"presence with ice", `{"to":"a","presence":{"name":"bob"},"ice":{"candidate":""}}`, false},
+		{"media with reaction", `{"media":{"audio":true},"reaction":{"emoji":"👍"}}`, false},
+		{"server payload", `{"joined":{"id":"a"}}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m message
+
+			if err := json.Unmarshal([]byte(tt.data), &m); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := m.IsAllowed(); got != tt.allowed {
+				t.Errorf("IsAllowed() = %v, want %v", got, tt.allowed)
+			}
+		})
+	}
+}
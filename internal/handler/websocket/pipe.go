@@ -0,0 +1,132 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// pipeBufferSize is the number of messages which could be waiting in each
+// direction of a pipe.
+const pipeBufferSize = 64
+
+var (
+	errPipeClosed   = errors.New("pipe closed")
+	errRoomNotFound = errors.New("room not found")
+)
+
+type (
+	// Pipe is an in-process connection to a room used by server side
+	// participants. Messages are JSON documents, exactly like the ones exchanged
+	// with remote clients.
+	Pipe interface {
+		// Read the next message sent by the hub.
+		Read() ([]byte, error)
+		// Write a message to the hub.
+		Write([]byte) error
+		// Close the pipe which makes the participant leave the room.
+		Close() error
+	}
+
+	// pipeConn implements both the Pipe used by the participant and the
+	// connection used by the hub.
+	pipeConn struct {
+		incoming chan []byte
+		outgoing chan []byte
+		done     chan struct{}
+		once     sync.Once
+	}
+)
+
+func newPipeConn() *pipeConn {
+	return &pipeConn{
+		incoming: make(chan []byte, pipeBufferSize),
+		outgoing: make(chan []byte, pipeBufferSize),
+		done:     make(chan struct{}),
+	}
+}
+
+func (p *pipeConn) ReadJSON(v interface{}) error {
+	select {
+	case data := <-p.incoming:
+		return json.Unmarshal(data, v)
+	case <-p.done:
+		return errPipeClosed
+	}
+}
+
+func (p *pipeConn) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+
+	if err != nil {
+		return err
+	}
+
+	select {
+	case p.outgoing <- data:
+		return nil
+	case <-p.done:
+		return errPipeClosed
+	}
+}
+
+func (p *pipeConn) Read() ([]byte, error) {
+	select {
+	case data := <-p.outgoing:
+		return data, nil
+	case <-p.done:
+		return nil, errPipeClosed
+	}
+}
+
+func (p *pipeConn) Write(data []byte) error {
+	select {
+	case p.incoming <- data:
+		return nil
+	case <-p.done:
+		return errPipeClosed
+	}
+}
+
+func (p *pipeConn) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return nil
+}
+
+func (h *hub) Join(room string, capabilities []string) (Pipe, error) {
+	return h.join(room, &handshake{
+		version:      protocolVersion,
+		local:        true,
+		capabilities: parseCapabilities(capabilities),
+	})
+}
+
+func (h *hub) Watch(room string, participant string) (Pipe, error) {
+	return h.join(room, &handshake{
+		version:      protocolVersion,
+		local:        true,
+		capabilities: make(map[string]bool),
+		watching:     participant,
+	})
+}
+
+// join registers an in-process participant with the given handshake.
+func (h *hub) join(room string, hs *handshake) (Pipe, error) {
+	if h.service.GetRoom(room) == nil {
+		return nil, errRoomNotFound
+	}
+
+	conn := newPipeConn()
+
+	registered := h.enroll(&registration{
+		room: room,
+		conn: conn,
+		hs:   hs,
+	})
+
+	if !registered {
+		return nil, errPipeClosed
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,197 @@
+package websocket
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/yuukanoo/rtchat/internal/logging"
+	"github.com/yuukanoo/rtchat/internal/service"
+)
+
+type testOptions struct {
+	threshold int
+	capacity  int
+	screen    string
+}
+
+func (o testOptions) SFUThreshold() int    { return o.threshold }
+func (testOptions) Recording() bool        { return false }
+func (o testOptions) RoomCapacity() int    { return o.capacity }
+func (testOptions) BroadcastCapacity() int { return 0 }
+func (o testOptions) ScreenSharing() string {
+	if o.screen == "" {
+		return ScreenShareAnyone
+	}
+
+	return o.screen
+}
+
+// testController reports the rooms in which the forwarding unit is started on
+// the optional sfu channel and fails to start it if err is set.
+type testController struct {
+	sfu chan string
+	err error
+}
+
+func (c testController) StartSFU(id string) error {
+	if c.sfu != nil {
+		c.sfu <- id
+	}
+
+	return c.err
+}
+
+func (testController) StartRecorder(string) error { return nil }
+func (testController) StopRecorder(string) error  { return nil }
+func (testController) Mixing() bool               { return false }
+
+// newTestHub launches a hub without any relay.
+func newTestHub(t *testing.T) (*hub, service.Service) {
+	t.Helper()
+
+	return startTestHub(t, testOptions{}, testController{})
+}
+
+// startTestHub launches a hub with the given options and controller.
+func startTestHub(t *testing.T, options Options, controller Controller) (*hub, service.Service) {
+	t.Helper()
+
+	svc := service.New()
+	h := New(svc, logging.New(false), func(r *http.Request, name string) string {
+		return r.URL.Query().Get(name)
+	}, options, controller, nil).(*hub)
+
+	go h.Run()
+	t.Cleanup(func() { h.Close() })
+
+	return h, svc
+}
+
+// dial connects a websocket client to the given room of the hub with the
+// given extra subprotocols. It returns the status of the handshake and the
+// connection if it has been upgraded.
+func dial(t *testing.T, h *hub, room *service.Room, protocols ...string) (*websocket.Conn, int) {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(h.Handle))
+	t.Cleanup(srv.Close)
+
+	dialer := websocket.Dialer{Subprotocols: append([]string{subprotocolV1, authPrefix + strings.TrimRight(room.Credential, "=")}, protocols...)}
+	conn, res, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"?id="+room.ID, nil)
+
+	if err != nil {
+		if res == nil {
+			t.Fatal(err)
+		}
+
+		return nil, res.StatusCode
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	return conn, res.StatusCode
+}
+
+// collect reads messages of the pipe in the background.
+func collect(p Pipe) <-chan *message {
+	messages := make(chan *message, sendBufferSize)
+
+	go func() {
+		defer close(messages)
+
+		for {
+			data, err := p.Read()
+
+			if err != nil {
+				return
+			}
+
+			var m message
+
+			if json.Unmarshal(data, &m) == nil {
+				messages <- &m
+			}
+		}
+	}()
+
+	return messages
+}
+
+// helloID waits for the hello message and returns the identifier it gives.
+func helloID(t *testing.T, messages <-chan *message) string {
+	t.Helper()
+
+	for {
+		select {
+		case m := <-messages:
+			if m.Hello != nil {
+				return m.Hello.ID
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no hello received")
+		}
+	}
+}
+
+func TestWatchOnlyExchangesWithItsTarget(t *testing.T) {
+	h, svc := newTestHub(t)
+	room := svc.CreateRoom(service.RoomOptions{})
+
+	target, _ := h.Join(room, nil)
+	other, _ := h.Join(room, nil)
+	targetMessages, otherMessages := collect(target), collect(other)
+	targetID := helloID(t, targetMessages)
+	helloID(t, otherMessages)
+
+	viewer, err := h.Watch(room, targetID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	viewerMessages := collect(viewer)
+	viewerID := helloID(t, viewerMessages)
+
+	// Other participants try to connect with the viewer
+	other.Write([]byte(`{"to":"` + viewerID + `","offer":{"type":"offer","sdp":"v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n"}}`))
+	target.Write([]byte(`{"to":"` + viewerID + `","offer":{"type":"offer","sdp":"v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n"}}`))
+
+	deadline := time.After(500 * time.Millisecond)
+	joined, offered := false, false
+
+	for done := false; !done; {
+		select {
+		case m := <-otherMessages:
+			if m.Joined != nil && m.Joined.ID == viewerID {
+				t.Error("the viewer has been announced to another participant")
+			}
+		case m := <-targetMessages:
+			if m.Joined != nil && m.Joined.ID == viewerID {
+				joined = true
+			}
+		case m := <-viewerMessages:
+			if m.Offer != nil {
+				if m.From != targetID {
+					t.Errorf("the viewer received an offer from %s", m.From)
+				}
+
+				offered = true
+			}
+
+			if m.Roster != nil && (len(m.Roster.Members) != 1 || m.Roster.Members[0].ID != targetID) {
+				t.Errorf("the viewer roster should only contain its target, got %d members", len(m.Roster.Members))
+			}
+		case <-deadline:
+			done = true
+		}
+	}
+
+	if !joined || !offered {
+		t.Errorf("the viewer should exchange with its target, joined %v offered %v", joined, offered)
+	}
+}
@@ -0,0 +1,62 @@
+package websocket
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxNameLength   = 32
+	maxStatusLength = 64
+	// maxEmojiLength is expressed in runes to allow sequences such as flags or
+	// skin tone modifiers.
+	maxEmojiLength = 8
+)
+
+var colorRegexp = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// sanitize removes control characters and surrounding spaces from the given
+// text.
+func sanitize(text string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, text))
+}
+
+// validate sanitizes the presence and checks that every field is within
+// bounds.
+func (p *presencePayload) validate() bool {
+	p.Name = sanitize(p.Name)
+	p.Avatar = strings.TrimSpace(p.Avatar)
+	p.Status = sanitize(p.Status)
+
+	if p.Name == "" || utf8.RuneCountInString(p.Name) > maxNameLength {
+		return false
+	}
+
+	if utf8.RuneCountInString(p.Status) > maxStatusLength {
+		return false
+	}
+
+	return p.Avatar == "" || colorRegexp.MatchString(p.Avatar) || isEmoji(p.Avatar)
+}
+
+// isEmoji checks if the given text is a short sequence of symbols.
+func isEmoji(text string) bool {
+	if !utf8.ValidString(text) || utf8.RuneCountInString(text) > maxEmojiLength {
+		return false
+	}
+
+	for _, r := range text {
+		if r < utf8.RuneSelf || unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) {
+			return false
+		}
+	}
+
+	return true
+}
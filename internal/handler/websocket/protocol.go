@@ -0,0 +1,204 @@
+package websocket
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// legacyVersion is used for clients which do not negotiate a subprotocol and
+	// send the room credential as the only Sec-WebSocket-Protocol value.
+	legacyVersion = 0
+	// protocolVersion is the current version of the signaling protocol.
+	protocolVersion = 1
+
+	subprotocolV1 = "rtchat.v1"
+	// authPrefix is used by versioned clients to pass the room credential in the
+	// subprotocol list since browsers could not set custom headers.
+	authPrefix = "rtchat.auth."
+	// resumePrefix is used by versioned clients to pass the resume token given
+	// in a previous hello message.
+	resumePrefix = "rtchat.resume."
+	// moderatorPrefix is used by versioned clients to pass the moderator key of
+	// the room.
+	moderatorPrefix = "rtchat.moderator."
+
+	maxCapabilities   = 16
+	maxCapabilityName = 32
+
+	// CapabilitySFU is announced by the in-process forwarding unit of a room.
+	// It is ignored when coming from remote clients.
+	CapabilitySFU = "sfu"
+	// CapabilityRecorder is announced by the in-process recorder of a room. It
+	// is ignored when coming from remote clients.
+	CapabilityRecorder = "recorder"
+	// CapabilityPresenter is announced by in-process participants publishing
+	// media in broadcast rooms. It is ignored when coming from remote clients.
+	CapabilityPresenter = "presenter"
+	// CapabilityMix is announced by clients which want to receive a single
+	// mixed audio track from the forwarding unit.
+	CapabilityMix = "mix"
+)
+
+var (
+	upgrader = websocket.Upgrader{
+		CheckOrigin:  func(r *http.Request) bool { return true },
+		Subprotocols: []string{subprotocolV1},
+	}
+
+	// legacyUpgrader echoes the credential given by old clients since they expect
+	// the server to select it as the subprotocol.
+	legacyUpgrader = websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+)
+
+type (
+	// features advertised by the server in the hello message so clients can
+	// adapt their interface.
+	features struct {
+		Presence   bool `json:"presence"`
+		Chat       bool `json:"chat"`
+		Moderation bool `json:"moderation"`
+		Recording  bool `json:"recording"`
+		Mixing     bool `json:"mixing"`
+	}
+
+	// handshake represents what has been extracted from the websocket upgrade
+	// request.
+	handshake struct {
+		version      int
+		credential   string
+		resumeToken  string
+		moderatorKey string
+		capabilities map[string]bool
+		// moderator is set once the moderator key has been checked.
+		moderator bool
+		// local is set for in-process participants which could not resume their
+		// session.
+		local bool
+		// watching is the participant an in-process viewer receives media from.
+		watching string
+	}
+)
+
+// serverFeatures returns feature flags supported by this server. Every room
+// has a moderator key so moderation is always available.
+func serverFeatures() features {
+	return features{
+		Presence:   true,
+		Chat:       true,
+		Moderation: true,
+	}
+}
+
+// negotiate parses the upgrade request to determine which protocol version the
+// client speaks and which credential it has provided.
+func negotiate(r *http.Request) *handshake {
+	protocols := websocket.Subprotocols(r)
+	hs := &handshake{
+		version:      legacyVersion,
+		capabilities: parseCapabilities(strings.Split(r.URL.Query().Get("caps"), ",")),
+	}
+
+	for _, p := range protocols {
+		switch {
+		case p == subprotocolV1:
+			hs.version = protocolVersion
+		case strings.HasPrefix(p, authPrefix):
+			hs.credential = strings.TrimPrefix(p, authPrefix)
+		case strings.HasPrefix(p, resumePrefix):
+			hs.resumeToken = strings.TrimPrefix(p, resumePrefix)
+		case strings.HasPrefix(p, moderatorPrefix):
+			hs.moderatorKey = strings.TrimPrefix(p, moderatorPrefix)
+		}
+	}
+
+	// Old clients only send the credential as is
+	if hs.version == legacyVersion && len(protocols) == 1 {
+		hs.credential = protocols[0]
+	}
+
+	return hs
+}
+
+// authorize checks the given credential against the handshake one. Padding is
+// ignored since it is not a valid token character in subprotocol names.
+func (hs *handshake) authorize(credential string) bool {
+	return hs.credential != "" &&
+		subtle.ConstantTimeCompare([]byte(strings.TrimRight(hs.credential, "=")), []byte(strings.TrimRight(credential, "="))) == 1
+}
+
+// moderates checks the given moderator key against the handshake one. Padding
+// is ignored like for the credential.
+func (hs *handshake) moderates(key string) bool {
+	return hs.version != legacyVersion && hs.moderatorKey != "" &&
+		subtle.ConstantTimeCompare([]byte(strings.TrimRight(hs.moderatorKey, "=")), []byte(strings.TrimRight(key, "="))) == 1
+}
+
+// resumes checks if the handshake carries the given resume token.
+func (hs *handshake) resumes(token string) bool {
+	return hs.version != legacyVersion && hs.resumeToken != "" &&
+		subtle.ConstantTimeCompare([]byte(strings.TrimRight(hs.resumeToken, "=")), []byte(strings.TrimRight(token, "="))) == 1
+}
+
+// upgrade the connection using the appropriate upgrader for the negotiated
+// version.
+func (hs *handshake) upgrade(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	if hs.version == legacyVersion {
+		return legacyUpgrader.Upgrade(w, r, http.Header{
+			"Sec-Websocket-Protocol": []string{hs.credential},
+		})
+	}
+
+	return upgrader.Upgrade(w, r, nil)
+}
+
+// parseCapabilities keeps valid capability names and drop everything else.
+func parseCapabilities(names []string) map[string]bool {
+	caps := make(map[string]bool)
+
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+
+		if len(caps) >= maxCapabilities {
+			break
+		}
+
+		if isValidCapability(name) {
+			caps[name] = true
+		}
+	}
+
+	return caps
+}
+
+func isValidCapability(name string) bool {
+	if name == "" || len(name) > maxCapabilityName {
+		return false
+	}
+
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '.') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func capabilityList(caps map[string]bool) []string {
+	list := make([]string, 0, len(caps))
+
+	for name := range caps {
+		list = append(list, name)
+	}
+
+	sort.Strings(list)
+
+	return list
+}
@@ -0,0 +1,96 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yuukanoo/rtchat/internal/logging"
+	"github.com/yuukanoo/rtchat/internal/service"
+)
+
+func TestHandshakeAuthorize(t *testing.T) {
+	tests := []struct {
+		name       string
+		given      string
+		credential string
+		authorized bool
+	}{
+		{"same credential", "abc=", "abc=", true},
+		{"padding stripped", "abc", "abc==", true},
+		{"other credential", "abd", "abc", false},
+		{"prefix", "ab", "abc", false},
+		{"missing", "", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hs := &handshake{credential: test.given}
+
+			if got := hs.authorize(test.credential); got != test.authorized {
+				t.Errorf("expected %v, got %v", test.authorized, got)
+			}
+		})
+	}
+}
+
+func TestHelloAdvertisesModeration(t *testing.T) {
+	h, svc := newTestHub(t)
+	room := svc.GetRoom(svc.CreateRoom(service.RoomOptions{}))
+	conn, _ := dial(t, h, room)
+
+	var m message
+
+	if err := conn.ReadJSON(&m); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Hello == nil || m.Hello.Features == nil || !m.Hello.Features.Moderation {
+		t.Errorf("expected the hello to advertise moderation, got %+v", m.Hello)
+	}
+}
+
+func TestClientsDoNotBlockOnAStoppedHub(t *testing.T) {
+	svc := service.New()
+	h := New(svc, logging.New(false), nil, testOptions{}, testController{}, nil).(*hub)
+	h.Close()
+
+	conn := newPipeConn()
+	c := newClient(h, "room", conn, &handshake{version: protocolVersion, capabilities: make(map[string]bool)})
+	done := make(chan struct{})
+
+	go func() {
+		c.readPump(conn)
+		close(done)
+	}()
+
+	conn.Write([]byte(`{"chat":{"text":"hello"}}`))
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the client is still waiting for the stopped hub")
+	}
+}
+
+func TestHandshakeResumes(t *testing.T) {
+	tests := []struct {
+		name    string
+		hs      handshake
+		token   string
+		resumes bool
+	}{
+		{"same token", handshake{version: protocolVersion, resumeToken: "token"}, "token", true},
+		{"padding stripped", handshake{version: protocolVersion, resumeToken: "token"}, "token==", true},
+		{"other token", handshake{version: protocolVersion, resumeToken: "tokem"}, "token", false},
+		{"missing token", handshake{version: protocolVersion}, "token", false},
+		{"legacy client", handshake{version: legacyVersion, resumeToken: "token"}, "token", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.hs.resumes(test.token); got != test.resumes {
+				t.Errorf("expected %v, got %v", test.resumes, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package websocket
+
+// recorder retrieves the in-process participant recording the given room if
+// any.
+func (h *hub) recorder(room string) *client {
+	for _, c := range h.rooms[room] {
+		if c.isRecorder() {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// recordingNotice builds the message telling a client whether its room is being
+// recorded and if its consent is needed.
+func (h *hub) recordingNotice(c *client, active bool) *message {
+	room := h.service.GetRoom(c.room)
+
+	return &message{
+		room: c.room,
+		To:   c.id,
+		Recording: &recordingPayload{
+			Active:  active,
+			Consent: room != nil && room.RequireConsent,
+		},
+	}
+}
+
+// announceRecording tells every notified client of a room that a recording
+// has started or stopped.
+func (h *hub) announceRecording(room string, active bool) {
+	for _, c := range h.rooms[room] {
+		if c.notified() {
+			c.deliver(h.recordingNotice(c, active))
+		}
+	}
+
+	h.logger.Debug(`recording:
+	room: %s
+	active: %t`, room, active)
+}
+
+// handleRecord starts or stops the recording of a room on behalf of one of its
+// moderators.
+func (h *hub) handleRecord(m *message) {
+	c := h.clients[m.From]
+
+	if c == nil || !c.moderator || !h.options.Recording() {
+		return
+	}
+
+	room := c.room
+	active := m.Record.Active
+
+	// Recorders join through the hub so this could not be done in its goroutine
+	go func() {
+		var err error
+
+		if active {
+			err = h.controller.StartRecorder(room)
+		} else {
+			err = h.controller.StopRecorder(room)
+		}
+
+		if err != nil {
+			h.logger.Error("could not change the recording of %s: %s", room, err)
+		}
+	}()
+}
+
+// handleConsent stores whether the sending client agrees to be recorded and
+// relays it to the room so the recorder knows about it.
+func (h *hub) handleConsent(m *message) bool {
+	c := h.clients[m.From]
+
+	if c == nil {
+		return false
+	}
+
+	m.To = ""
+	m.Consent.ID = c.id
+	c.consent = m.Consent.Recording
+
+	return true
+}
@@ -0,0 +1,73 @@
+package websocket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/yuukanoo/rtchat/internal/service"
+)
+
+func TestRecorderOnlyLearnsAboutNotifiedClients(t *testing.T) {
+	h, svc := newTestHub(t)
+	room := svc.GetRoom(svc.CreateRoom(service.RoomOptions{}))
+
+	conn, _ := dial(t, h, room)
+
+	var hello message
+
+	if err := conn.ReadJSON(&hello); err != nil || hello.Hello == nil {
+		t.Fatalf("expected a hello, got %v", err)
+	}
+
+	// Legacy clients only send the credential as subprotocol
+	srv := httptest.NewServer(http.HandlerFunc(h.Handle))
+	defer srv.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{strings.TrimRight(room.Credential, "=")}}
+	legacy, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"?id="+room.ID, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer legacy.Close()
+
+	presenter, _ := h.Join(room.ID, []string{CapabilityPresenter})
+	defer presenter.Close()
+	helloID(t, collect(presenter))
+
+	// The legacy client gets no hello telling it has been registered
+	for deadline := time.Now().Add(time.Second); len(h.Room(room.ID).Members) < 3; {
+		if time.Now().After(deadline) {
+			t.Fatal("the legacy client has not joined")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	recorder, _ := h.Join(room.ID, []string{CapabilityRecorder})
+	defer recorder.Close()
+
+	messages := collect(recorder)
+
+	for {
+		select {
+		case m := <-messages:
+			if m.Roster == nil {
+				continue
+			}
+
+			if len(m.Roster.Members) != 1 || m.Roster.Members[0].ID != hello.Hello.ID {
+				t.Fatalf("expected the recorder to only know %s, got %d members", hello.Hello.ID, len(m.Roster.Members))
+			}
+
+			return
+		case <-time.After(time.Second):
+			t.Fatal("no roster received")
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package websocket
+
+import "github.com/yuukanoo/rtchat/internal/turn"
+
+type (
+	// Relay reports allocations made on the TURN server.
+	Relay interface {
+		// Subscribe returns a channel receiving allocation events.
+		Subscribe() <-chan turn.Event
+		// Unsubscribe stops sending events to the given channel.
+		Unsubscribe(<-chan turn.Event)
+	}
+
+	// relayPayload tells moderators how many allocations their room has on the
+	// TURN server.
+	relayPayload struct {
+		Event       string `json:"event"`
+		Allocations int    `json:"allocations"`
+	}
+)
+
+// handleRelay notifies moderators of a room of its allocation events. Events
+// carry the number of allocations of the room so a dropped one is made up for
+// by the next.
+func (h *hub) handleRelay(e turn.Event) {
+	for _, c := range h.rooms[e.Room] {
+		if c.moderator && c.version != legacyVersion {
+			c.deliver(&message{
+				room: e.Room,
+				To:   c.id,
+				Relay: &relayPayload{
+					Event:       e.Type,
+					Allocations: e.Allocations,
+				},
+			})
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package websocket
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/yuukanoo/rtchat/internal/metrics"
+	"github.com/yuukanoo/rtchat/internal/service"
+
+	"github.com/pion/sdp/v3"
+)
+
+const (
+	maxSDPLength       = 64 * 1024
+	maxCandidateLength = 1024
+	maxHostnameLength  = 255
+
+	candidatePrefix = "candidate:"
+	relayCandidate  = "relay"
+)
+
+var (
+	errInvalidCandidate = errors.New("invalid ice candidate")
+	errInvalidSDP       = errors.New("invalid session description")
+
+	candidateTypes = map[string]bool{
+		"host":         true,
+		"srflx":        true,
+		"prflx":        true,
+		relayCandidate: true,
+	}
+)
+
+type (
+	// candidate represents a parsed ICE candidate attribute as defined in
+	// RFC 8839.
+	candidate struct {
+		foundation string
+		component  int
+		transport  string
+		priority   uint32
+		address    string
+		port       int
+		typ        string
+		// extensions contains every key/value pair after the candidate type, in
+		// order, such as raddr, rport or tcptype.
+		extensions []string
+	}
+)
+
+// parseCandidate parses the value of a candidate attribute, with or without
+// its "candidate:" prefix.
+func parseCandidate(value string) (*candidate, error) {
+	if len(value) > maxCandidateLength {
+		return nil, errInvalidCandidate
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(value, candidatePrefix))
+
+	// foundation component transport priority address port "typ" type
+	if len(fields) < 8 || fields[6] != "typ" || len(fields)%2 != 0 {
+		return nil, errInvalidCandidate
+	}
+
+	component, err := strconv.Atoi(fields[1])
+
+	if err != nil || component < 1 || component > 256 {
+		return nil, errInvalidCandidate
+	}
+
+	priority, err := strconv.ParseUint(fields[3], 10, 32)
+
+	if err != nil {
+		return nil, errInvalidCandidate
+	}
+
+	port, err := strconv.Atoi(fields[5])
+
+	if err != nil || port < 0 || port > 65535 {
+		return nil, errInvalidCandidate
+	}
+
+	c := &candidate{
+		foundation: fields[0],
+		component:  component,
+		transport:  strings.ToLower(fields[2]),
+		priority:   uint32(priority),
+		address:    fields[4],
+		port:       port,
+		typ:        fields[7],
+		extensions: fields[8:],
+	}
+
+	if (c.transport != "udp" && c.transport != "tcp") || !candidateTypes[c.typ] || !isValidAddress(c.address) {
+		return nil, errInvalidCandidate
+	}
+
+	return c, nil
+}
+
+// isValidAddress checks if the given candidate address is an IP or a host name
+// such as mDNS or I2P ones.
+func isValidAddress(address string) bool {
+	if net.ParseIP(address) != nil {
+		return true
+	}
+
+	if address == "" || len(address) > maxHostnameLength {
+		return false
+	}
+
+	for _, r := range address {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' || r == '~') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hideRelatedAddress removes the related address of the candidate which may
+// contain the host or reflexive address of the peer.
+func (c *candidate) hideRelatedAddress() {
+	for i := 0; i+1 < len(c.extensions); i += 2 {
+		switch c.extensions[i] {
+		case "raddr":
+			c.extensions[i+1] = "0.0.0.0"
+		case "rport":
+			c.extensions[i+1] = "0"
+		}
+	}
+}
+
+func (c *candidate) String() string {
+	parts := append([]string{
+		c.foundation,
+		strconv.Itoa(c.component),
+		c.transport,
+		strconv.FormatUint(uint64(c.priority), 10),
+		c.address,
+		strconv.Itoa(c.port),
+		"typ",
+		c.typ,
+	}, c.extensions...)
+
+	return candidatePrefix + strings.Join(parts, " ")
+}
+
+// allows checks if the candidate respects the given privacy policy and
+// sanitizes it if needed.
+func (c *candidate) allows(privacy service.Privacy) bool {
+	if privacy != service.PrivacyRelay {
+		return true
+	}
+
+	if c.typ != relayCandidate {
+		return false
+	}
+
+	c.hideRelatedAddress()
+
+	return true
+}
+
+// sanitizeCandidate validates the ICE payload and applies the privacy policy.
+// It returns false if the candidate should not be relayed.
+func sanitizeCandidate(p *icePayload, privacy service.Privacy) bool {
+	// An empty candidate signals the end of candidates
+	if p.Candidate == "" {
+		return true
+	}
+
+	c, err := parseCandidate(p.Candidate)
+
+	if err != nil {
+		metrics.Signaling.Add("candidates_rejected", 1)
+		return false
+	}
+
+	if !c.allows(privacy) {
+		metrics.Signaling.Add("candidates_dropped", 1)
+		return false
+	}
+
+	p.Candidate = c.String()
+
+	return true
+}
+
+// sanitizeSDP parses the session description, removes candidates forbidden by
+// the privacy policy and marshals it back. Media sections for which restricts
+// returns true are made receive only.
+func sanitizeSDP(p *sdpPayload, privacy service.Privacy, restricts func(*sdp.MediaDescription) bool, expectedTypes ...string) error {
+	if len(p.SDP) > maxSDPLength || !contains(expectedTypes, p.Type) {
+		return errInvalidSDP
+	}
+
+	var desc sdp.SessionDescription
+
+	if err := desc.UnmarshalString(p.SDP); err != nil {
+		return errInvalidSDP
+	}
+
+	for _, media := range desc.MediaDescriptions {
+		receiveOnly := restricts != nil && restricts(media)
+		attributes := media.Attributes[:0]
+
+		for _, attr := range media.Attributes {
+			if receiveOnly {
+				attr = restrictDirection(attr)
+			}
+
+			if !attr.IsICECandidate() {
+				attributes = append(attributes, attr)
+				continue
+			}
+
+			c, err := parseCandidate(attr.Value)
+
+			if err != nil {
+				metrics.Signaling.Add("candidates_rejected", 1)
+				continue
+			}
+
+			if !c.allows(privacy) {
+				metrics.Signaling.Add("candidates_dropped", 1)
+				continue
+			}
+
+			attr.Value = strings.TrimPrefix(c.String(), candidatePrefix)
+			attributes = append(attributes, attr)
+		}
+
+		media.Attributes = attributes
+
+		// The default connection address is the one of the default candidate so
+		// it should be hidden too.
+		if privacy == service.PrivacyRelay {
+			hideConnectionAddress(media.ConnectionInformation)
+		}
+	}
+
+	// The origin may carry the host address too
+	if privacy == service.PrivacyRelay {
+		hideConnectionAddress(desc.ConnectionInformation)
+		hideOriginAddress(&desc.Origin)
+	}
+
+	raw, err := desc.Marshal()
+
+	if err != nil {
+		return errInvalidSDP
+	}
+
+	p.SDP = string(raw)
+
+	return nil
+}
+
+// restrictDirection removes the sending part of a direction attribute.
+func restrictDirection(attr sdp.Attribute) sdp.Attribute {
+	switch attr.Key {
+	case "sendrecv":
+		attr.Key = "recvonly"
+	case "sendonly":
+		attr.Key = "inactive"
+	}
+
+	return attr
+}
+
+func hideConnectionAddress(info *sdp.ConnectionInformation) {
+	if info == nil || info.Address == nil {
+		return
+	}
+
+	if info.AddressType == "IP6" {
+		info.Address.Address = "::"
+	} else {
+		info.Address.Address = "0.0.0.0"
+	}
+}
+
+func hideOriginAddress(origin *sdp.Origin) {
+	if origin.AddressType == "IP6" {
+		origin.UnicastAddress = "::"
+	} else {
+		origin.UnicastAddress = "0.0.0.0"
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// handleSignaling validates offers, answers and candidates before they are
+// relayed. It returns false if the message should be dropped.
+func (h *hub) handleSignaling(m *message) bool {
+	room := h.service.GetRoom(m.room)
+
+	if room == nil {
+		return false
+	}
+
+	restricts := h.restricts(h.clients[m.From])
+
+	if m.Offer != nil {
+		if err := sanitizeSDP(m.Offer, room.Privacy, restricts, "offer"); err != nil {
+			metrics.Signaling.Add("sdp_rejected", 1)
+			return false
+		}
+	}
+
+	if m.Answer != nil {
+		if err := sanitizeSDP(m.Answer, room.Privacy, restricts, "answer", "pranswer"); err != nil {
+			metrics.Signaling.Add("sdp_rejected", 1)
+			return false
+		}
+	}
+
+	if m.ICE != nil && !sanitizeCandidate(m.ICE, room.Privacy) {
+		return false
+	}
+
+	return true
+}
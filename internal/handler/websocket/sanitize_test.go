@@ -0,0 +1,157 @@
+package websocket
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/yuukanoo/rtchat/internal/service"
+
+	"github.com/pion/sdp/v3"
+)
+
+func TestParseCandidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+		valid bool
+	}{
+		{"host", "candidate:1 1 udp 2122260223 192.168.1.2 54321 typ host", "candidate:1 1 udp 2122260223 192.168.1.2 54321 typ host", true},
+		{"without prefix", "1 1 UDP 2122260223 10.0.0.1 5000 typ host", "candidate:1 1 udp 2122260223 10.0.0.1 5000 typ host", true},
+		{"relay with extensions", "candidate:2 1 udp 41885439 203.0.113.4 3478 typ relay raddr 198.51.100.2 rport 6000", "candidate:2 1 udp 41885439 203.0.113.4 3478 typ relay raddr 198.51.100.2 rport 6000", true},
+		{"mdns", "candidate:3 1 udp 2122260223 0e5c4b9a-1f.local 5000 typ host", "candidate:3 1 udp 2122260223 0e5c4b9a-1f.local 5000 typ host", true},
+		{"tcp", "candidate:4 1 tcp 1518280447 192.168.1.2 9 typ host tcptype active", "candidate:4 1 tcp 1518280447 192.168.1.2 9 typ host tcptype active", true},
+		{"too short", "candidate:1 1 udp 2122260223 192.168.1.2 54321 typ", "", false},
+		{"missing typ", "candidate:1 1 udp 2122260223 192.168.1.2 54321 foo host", "", false},
+		{"unknown type", "candidate:1 1 udp 2122260223 192.168.1.2 54321 typ evil", "", false},
+		{"unknown transport", "candidate:1 1 sctp 2122260223 192.168.1.2 54321 typ host", "", false},
+		{"bad component", "candidate:1 0 udp 2122260223 192.168.1.2 54321 typ host", "", false},
+		{"bad priority", "candidate:1 1 udp -1 192.168.1.2 54321 typ host", "", false},
+		{"bad port", "candidate:1 1 udp 2122260223 192.168.1.2 70000 typ host", "", false},
+		{"bad address", "candidate:1 1 udp 2122260223 <script> 54321 typ host", "", false},
+		{"odd extensions", "candidate:1 1 udp 2122260223 192.168.1.2 54321 typ host raddr", "", false},
+		{"too long", "candidate:1 1 udp 2122260223 192.168.1.2 54321 typ host " + strings.Repeat("a b ", maxCandidateLength), "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseCandidate(tt.value)
+
+			if (err == nil) != tt.valid {
+				t.Fatalf("parseCandidate() error = %v, want valid %v", err, tt.valid)
+			}
+
+			if tt.valid && c.String() != tt.want {
+				t.Errorf("String() = %q, want %q", c.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeCandidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		candidate string
+		privacy   service.Privacy
+		want      string
+		relayed   bool
+	}{
+		{"end of candidates", "", service.PrivacyRelay, "", true},
+		{"host in public room", "candidate:1 1 udp 1 192.168.1.2 5000 typ host", service.PrivacyOpen, "candidate:1 1 udp 1 192.168.1.2 5000 typ host", true},
+		{"host in relay room", "candidate:1 1 udp 1 192.168.1.2 5000 typ host", service.PrivacyRelay, "", false},
+		{"srflx in relay room", "candidate:1 1 udp 1 203.0.113.4 5000 typ srflx raddr 192.168.1.2 rport 5000", service.PrivacyRelay, "", false},
+		{"relay in relay room", "candidate:1 1 udp 1 203.0.113.4 3478 typ relay raddr 198.51.100.2 rport 6000", service.PrivacyRelay, "candidate:1 1 udp 1 203.0.113.4 3478 typ relay raddr 0.0.0.0 rport 0", true},
+		{"invalid", "candidate:garbage", service.PrivacyOpen, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &icePayload{Candidate: tt.candidate}
+
+			if got := sanitizeCandidate(p, tt.privacy); got != tt.relayed {
+				t.Fatalf("sanitizeCandidate() = %v, want %v", got, tt.relayed)
+			}
+
+			if tt.relayed && p.Candidate != tt.want {
+				t.Errorf("candidate = %q, want %q", p.Candidate, tt.want)
+			}
+		})
+	}
+}
+
+const testOffer = "v=0\r\n" +
+	"o=- 1 1 IN IP4 192.168.1.2\r\n" +
+	"s=-\r\n" +
+	"c=IN IP4 192.168.1.2\r\n" +
+	"t=0 0\r\n" +
+	"m=video 5000 UDP/TLS/RTP/SAVPF 96\r\n" +
+	"c=IN IP4 192.168.1.2\r\n" +
+	"a=mid:0\r\n" +
+	"a=sendrecv\r\n" +
+	"a=candidate:1 1 udp 2122260223 192.168.1.2 5000 typ host\r\n" +
+	"a=candidate:2 1 udp 41885439 203.0.113.4 3478 typ relay raddr 192.168.1.2 rport 5000\r\n" +
+	"a=candidate:3 1 udp 1 <bad> 1 typ host\r\n"
+
+func TestSanitizeSDP(t *testing.T) {
+	tests := []struct {
+		name       string
+		payload    sdpPayload
+		privacy    service.Privacy
+		restricted bool
+		valid      bool
+		contains   []string
+		excludes   []string
+	}{
+		{
+			name:     "public room",
+			payload:  sdpPayload{Type: "offer", SDP: testOffer},
+			privacy:  service.PrivacyOpen,
+			valid:    true,
+			contains: []string{"typ host", "typ relay raddr 192.168.1.2", "a=sendrecv", "c=IN IP4 192.168.1.2"},
+			excludes: []string{"<bad>"},
+		},
+		{
+			name:     "relay room",
+			payload:  sdpPayload{Type: "offer", SDP: testOffer},
+			privacy:  service.PrivacyRelay,
+			valid:    true,
+			contains: []string{"typ relay raddr 0.0.0.0 rport 0", "c=IN IP4 0.0.0.0"},
+			excludes: []string{"typ host", "192.168.1.2"},
+		},
+		{
+			name:       "restricted media",
+			payload:    sdpPayload{Type: "offer", SDP: testOffer},
+			privacy:    service.PrivacyOpen,
+			restricted: true,
+			valid:      true,
+			contains:   []string{"a=recvonly"},
+			excludes:   []string{"a=sendrecv"},
+		},
+		{name: "unexpected type", payload: sdpPayload{Type: "answer", SDP: testOffer}, valid: false},
+		{name: "garbage", payload: sdpPayload{Type: "offer", SDP: "hello"}, valid: false},
+		{name: "too long", payload: sdpPayload{Type: "offer", SDP: testOffer + strings.Repeat("a=x\r\n", maxSDPLength)}, valid: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := tt.payload
+			err := sanitizeSDP(&p, tt.privacy, func(*sdp.MediaDescription) bool { return tt.restricted }, "offer")
+
+			if (err == nil) != tt.valid {
+				t.Fatalf("sanitizeSDP() error = %v, want valid %v", err, tt.valid)
+			}
+
+			for _, s := range tt.contains {
+				if !strings.Contains(p.SDP, s) {
+					t.Errorf("SDP should contain %q:\n%s", s, p.SDP)
+				}
+			}
+
+			for _, s := range tt.excludes {
+				if strings.Contains(p.SDP, s) {
+					t.Errorf("SDP should not contain %q:\n%s", s, p.SDP)
+				}
+			}
+		})
+	}
+}
@@ -3,30 +3,53 @@ package websocket
 import (
 	"fmt"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/yuukanoo/rtchat/internal/logging"
 	"github.com/yuukanoo/rtchat/internal/service"
-
-	"github.com/gorilla/websocket"
+	"github.com/yuukanoo/rtchat/internal/turn"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
-}
-
-const checkDelay = 15 * time.Second
+const (
+	checkDelay = 15 * time.Second
+	// resumeGrace is the time a client has to resume its session after its
+	// connection has been lost before being considered gone.
+	resumeGrace = 30 * time.Second
+	// switchGrace is the time given to clients to connect with each others
+	// before the forwarding unit leaves a room switching back to a mesh.
+	switchGrace = 15 * time.Second
+	// switchHysteresis prevents a room from switching back and forth when a
+	// participant comes and goes around the threshold.
+	switchHysteresis = 1
+)
 
 type (
 	// Server represents a Websocket server.
 	Server interface {
 		// Handle should be used in a router to process an incoming ws request.
 		Handle(http.ResponseWriter, *http.Request)
+		// HandleEvents should be used in a router to open a Server-Sent Events
+		// stream for clients which could not use websockets.
+		HandleEvents(http.ResponseWriter, *http.Request)
+		// HandlePost should be used in a router to process messages sent by
+		// clients connected with HandleEvents.
+		HandlePost(http.ResponseWriter, *http.Request)
 		// CheckEmptiness inform the websocket server to check the given room for
 		// emptiness in some time.
 		// This will prevent the creation of empty rooms which are not desirable
 		// for this tiny server.
 		CheckEmptiness(string)
+		// Join attaches an in-process participant to the given room, announcing the
+		// given capabilities.
+		Join(string, []string) (Pipe, error)
+		// Watch attaches an in-process viewer to the given room which only
+		// exchanges messages with the given participant and the forwarding unit.
+		Watch(string, string) (Pipe, error)
+		// Room retrieves a snapshot of what the server knows about the given room,
+		// nil once the server is closed.
+		Room(string) *RoomInfo
 		// Run the realtime server.
 		Run() error
 		// Close the current server and all connections.
@@ -37,48 +60,163 @@ type (
 	// no matter which router has been chosen.
 	GetRouteParamFunc func(*http.Request, string) string
 
+	// Controller starts and stops server side participants on behalf of the
+	// realtime server.
+	Controller interface {
+		// StartSFU makes the forwarding unit join the given room. It should
+		// announce CapabilitySFU when joining.
+		StartSFU(string) error
+		// StartRecorder makes a recorder join the given room. It should announce
+		// CapabilityRecorder when joining.
+		StartRecorder(string) error
+		// StopRecorder makes the recorder of the given room leave.
+		StopRecorder(string) error
+		// Mixing returns true if forwarding units could mix audio for clients
+		// announcing CapabilityMix.
+		Mixing() bool
+	}
+
+	// Options holds needed configuration for the realtime server.
+	Options interface {
+		// SFUThreshold is the number of participants from which rooms using the
+		// automatic topology switch to the forwarding unit, 0 to disable.
+		SFUThreshold() int
+		// Recording returns true if rooms could be recorded.
+		Recording() bool
+		// RoomCapacity is the maximum number of participants in a room, 0 for
+		// no limit.
+		RoomCapacity() int
+		// BroadcastCapacity is the maximum number of participants in a broadcast
+		// room, 0 for no limit.
+		BroadcastCapacity() int
+		// ScreenSharing is the policy deciding who may share its screen, one of
+		// ScreenShareAnyone, ScreenShareModerators or ScreenShareSingle.
+		ScreenSharing() string
+	}
+
+	// RoomInfo represents the state of a room as seen by the realtime server.
+	RoomInfo struct {
+		ID       string           `json:"id"`
+		Kind     string           `json:"kind"`
+		Topology string           `json:"topology"`
+		Members  []*memberPayload `json:"members"`
+
+		// admits is set when the handshake of the query could join the room.
+		admits bool
+	}
+
+	// roomQuery is used to retrieve a room snapshot from the hub goroutine. The
+	// handshake of a client about to join may be given to know if it fits.
+	roomQuery struct {
+		room  string
+		hs    *handshake
+		reply chan *RoomInfo
+	}
+
+	// registration represents an incoming connection which has been authorized
+	// for a room.
+	registration struct {
+		room string
+		conn connection
+		hs   *handshake
+	}
+
 	hub struct {
 		service       service.Service
 		logger        logging.Logger
-		isRunning     bool
+		options       Options
+		running       atomic.Bool
 		getRouteParam GetRouteParamFunc
-		register      chan *client
-		unregister    chan *client
-		quit          chan bool
+		controller    Controller
+		relay         Relay
+		register      chan *registration
+		unregister    chan *disconnection
+		expire        chan *client
+		query         chan *roomQuery
+		streams       *streams
+		done          chan struct{}
+		closing       sync.Once
 		clients       map[string]*client
 		rooms         map[string][]*client
 		check         chan string
+		retire        chan string
+		stalled       chan string
 		send          chan *message
+
+		// Rooms in which clients have been told to use the forwarding unit and
+		// rooms waiting for it to join.
+		forwarded map[string]bool
+		starting  map[string]bool
 	}
 )
 
 // New instantiates a new websocket server to process realtime requests.
 // It expects the route to have an url param named "id" which represents the room
-// identifier.
-func New(service service.Service, logger logging.Logger, fn GetRouteParamFunc) Server {
+// identifier. Allocation events of the given relay are forwarded to moderators,
+// it may be nil.
+func New(service service.Service, logger logging.Logger, fn GetRouteParamFunc, options Options, controller Controller, relay Relay) Server {
 	return &hub{
 		logger:        logger,
 		service:       service,
+		options:       options,
 		getRouteParam: fn,
-		register:      make(chan *client),
-		unregister:    make(chan *client),
-		quit:          make(chan bool),
+		controller:    controller,
+		relay:         relay,
+		register:      make(chan *registration),
+		unregister:    make(chan *disconnection),
+		expire:        make(chan *client),
+		query:         make(chan *roomQuery),
+		streams:       &streams{conns: make(map[string]*streamConn)},
+		done:          make(chan struct{}),
 		clients:       make(map[string]*client),
 		rooms:         make(map[string][]*client),
 		check:         make(chan string),
+		retire:        make(chan string),
+		stalled:       make(chan string),
 		send:          make(chan *message),
+		forwarded:     make(map[string]bool),
+		starting:      make(map[string]bool),
 	}
 }
 
 func (h *hub) CheckEmptiness(id string) {
 	go func() {
-		<-time.After(checkDelay)
-		h.check <- id
+		select {
+		case <-time.After(checkDelay):
+		case <-h.done:
+			return
+		}
+
+		select {
+		case h.check <- id:
+		case <-h.done:
+		}
 	}()
 }
 
+func (h *hub) Room(id string) *RoomInfo {
+	return h.snapshot(id, nil)
+}
+
+// snapshot retrieves the room info from the hub goroutine, nil once the hub
+// has stopped.
+func (h *hub) snapshot(id string, hs *handshake) *RoomInfo {
+	q := &roomQuery{
+		room:  id,
+		hs:    hs,
+		reply: make(chan *RoomInfo, 1),
+	}
+
+	select {
+	case h.query <- q:
+		return <-q.reply
+	case <-h.done:
+		return nil
+	}
+}
+
 func (h *hub) Handle(w http.ResponseWriter, r *http.Request) {
-	cred := r.Header.Get("Sec-WebSocket-Protocol")
+	hs := negotiate(r)
 
 	// Checks if the room exists first, if not, just returns a 404
 	room := h.service.GetRoom(h.getRouteParam(r, "id"))
@@ -90,132 +228,452 @@ func (h *hub) Handle(w http.ResponseWriter, r *http.Request) {
 
 	// Checks if credentials are good to prevent anyone to access the websocket and
 	// received messages for this room.
-	if room.Credential != cred {
+	if !hs.authorize(room.Credential) {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	hs.moderator = hs.moderates(room.ModeratorKey)
+
+	if !h.admits(room, hs) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := hs.upgrade(w, r)
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		// The upgrader has already replied to the client
 		return
 	}
 
-	h.register <- newClient(h, room.ID, conn)
+	h.enroll(&registration{room: room.ID, conn: conn, hs: hs})
+}
+
+// enroll hands the given registration to the hub. It returns false and closes
+// the connection if the hub has stopped.
+func (h *hub) enroll(reg *registration) bool {
+	select {
+	case h.register <- reg:
+		return true
+	case <-h.done:
+		reg.conn.Close()
+		return false
+	}
 }
 
 func (h *hub) Run() error {
-	if h.isRunning {
+	if !h.running.CompareAndSwap(false, true) {
 		return fmt.Errorf("server is already running")
 	}
 
-	h.isRunning = true
+	// A nil channel is never ready so events are simply not received without
+	// a relay
+	var events <-chan turn.Event
+
+	if h.relay != nil {
+		events = h.relay.Subscribe()
+		defer h.relay.Unsubscribe(events)
+	}
 
 	for {
 		select {
 
-		case c := <-h.register:
+		case reg := <-h.register:
+			if c := h.resumable(reg); c != nil {
+				c.reattach(reg.conn)
+				c.deliver(h.hello(c, true))
+				c.replay()
+
+				h.logger.Debug(`resumed:
+	user: %s
+	room: %s`, c.id, c.room)
+				continue
+			}
+
+			// Handlers have checked the capacity but the room may have filled
+			// up since then
+			if !h.fits(reg) {
+				h.logger.Debug("refusing a client in the full room %s", reg.room)
+				reg.conn.Close()
+				continue
+			}
+
+			c := newClient(h, reg.room, reg.conn, reg.hs)
 			clients := h.rooms[c.room]
 
+			if room := h.service.GetRoom(c.room); room != nil {
+				c.role = role(room, c)
+			}
+
 			h.rooms[c.room] = append(clients, c)
 			h.clients[c.id] = c
 
-			go c.readPump()
-			go c.writePump()
+			c.attach()
+
+			// Versioned clients always receive the hello as their first frame
+			// followed by the current members of the room
+			if c.version != legacyVersion {
+				c.deliver(h.hello(c, false))
+				c.deliver(h.roster(c))
+
+				for _, m := range h.history(c) {
+					c.deliver(m)
+				}
+			}
+
+			// The forwarding unit knows who is there before being told to connect
+			// with them
+			if c.isSFU() {
+				h.forward(c)
+			}
+
+			if c.isRecorder() {
+				h.announceRecording(c.room, true)
+			} else if h.recorder(c.room) != nil && c.notified() {
+				c.deliver(h.recordingNotice(c, true))
+			}
 
 			h.logger.Debug(`joined:
 	user: %s
 	room: %s`, c.id, c.room)
 
-			// Notify every other user in the same room that a new user has joined
-			go func() {
-				h.send <- &message{
-					room: c.room,
-					From: c.id,
+			// Notify every other user in the same room that a new user has joined.
+			// The forwarding unit is announced with a switch message instead.
+			if !c.isSFU() {
+				joined := &message{
+					room:   c.room,
+					From:   c.id,
+					viewer: c.isViewer(),
 					Joined: &joinedPayload{
-						ID: c.id,
+						ID:           c.id,
+						Role:         c.role,
+						Capabilities: capabilityList(c.capabilities),
 					},
 				}
-			}()
 
-		case c := <-h.unregister:
-			h.clients[c.id] = nil
-			delete(h.clients, c.id)
+				go func() {
+					select {
+					case h.send <- joined:
+					case <-h.done:
+					}
+				}()
+			}
+
+			h.balance(c.room)
 
-			clients := h.rooms[c.room]
+		case d := <-h.unregister:
+			c := d.client
 
-			for i, cli := range clients {
-				if cli == c {
-					clients[i] = nil
-					h.rooms[c.room] = append(clients[:i], clients[i+1:]...)
-					break
-				}
+			// Ignore disconnections of replaced connections or removed clients
+			if h.clients[c.id] != c || (!c.isDetached() && c.conn != d.conn) {
+				continue
+			}
+
+			if !c.canResume() {
+				h.remove(c)
+				continue
+			}
+
+			if !c.isDetached() {
+				c.detach()
 			}
 
-			h.logger.Debug(`left:
+			h.logger.Debug(`detached:
 	user: %s
 	room: %s`, c.id, c.room)
 
-			// Trigger a check for emptiness in a while
-			h.CheckEmptiness(c.room)
-
-			// Notify every other user in the same room that a user has left
+			// Give the client some time to resume its session
 			go func() {
-				h.send <- &message{
-					room: c.room,
-					From: c.id,
-					Left: &leftPayload{
-						ID: c.id,
-					},
+				select {
+				case <-time.After(resumeGrace):
+				case <-h.done:
+					return
+				}
+
+				select {
+				case h.expire <- c:
+				case <-h.done:
 				}
 			}()
 
+		case c := <-h.expire:
+			// Only remove the client if it has not resumed its session in the meantime
+			if h.clients[c.id] == c && c.isDetached() && time.Since(c.detachedAt) >= resumeGrace {
+				h.remove(c)
+			}
+
 		case id := <-h.check:
+			// In-process participants could not keep a room alive on their own
+			if h.participants(id) == 0 {
+				h.release(id)
+			}
+
 			// Delete the room if there is no more user
 			if len(h.rooms[id]) == 0 {
 				h.rooms[id] = nil
 				delete(h.rooms, id)
+				delete(h.forwarded, id)
+				delete(h.starting, id)
 				h.logger.Debug("No users left in %s, deleting", id)
 
 				go h.service.DeleteRoom(id)
 			}
 
+		case id := <-h.retire:
+			h.retireSFU(id)
+
+		case id := <-h.stalled:
+			// Let the next balance try to start the forwarding unit again
+			delete(h.starting, id)
+
+		case q := <-h.query:
+			info := h.roomInfo(q.room)
+
+			if q.hs != nil {
+				reg := &registration{room: q.room, hs: q.hs}
+				info.admits = h.resumable(reg) != nil || h.fits(reg)
+			}
+
+			q.reply <- info
+
+		case e := <-events:
+			h.handleRelay(e)
+
 		case m := <-h.send:
+			sender := h.clients[m.From]
+
+			if sender != nil {
+				m.viewer = sender.isViewer()
+			}
+
+			if m.Hello != nil {
+				h.handleHello(m)
+				continue
+			}
+
+			if m.Presence != nil && !h.handlePresence(m) {
+				continue
+			}
+
+			if m.Media != nil && !h.handleMedia(m) {
+				continue
+			}
+
+			if m.Reaction != nil && !h.handleReaction(m) {
+				continue
+			}
+
+			if m.Chat != nil {
+				h.handleChat(m)
+				continue
+			}
+
+			if m.Tracks != nil {
+				h.handleTracks(m)
+				continue
+			}
+
+			if m.Record != nil {
+				h.handleRecord(m)
+				continue
+			}
+
+			if m.Consent != nil && !h.handleConsent(m) {
+				continue
+			}
+
+			if (m.Offer != nil || m.Answer != nil || m.ICE != nil) && !h.handleSignaling(m) {
+				continue
+			}
+
 			if m.To != "" {
 				// If it should be sent to one client in particular
 				c := h.clients[m.To]
 
 				// Check the origin
-				if c.room == m.room {
-					c.send <- m
+				if c != nil && c.room == m.room && h.routes(m, sender, c) {
+					c.deliver(m)
 				}
 			} else {
 				// Else broadcast the message to everyone in the same room
 				clients := h.rooms[m.room]
 
 				for _, c := range clients {
-					if c.id != m.From {
-						c.send <- m
+					if c.id != m.From && h.routes(m, sender, c) {
+						c.deliver(m)
 					}
 				}
 			}
 
-		case <-h.quit:
+		case <-h.done:
 			for _, c := range h.clients {
-				c.conn.Close()
+				if !c.isDetached() {
+					c.detach()
+				}
 			}
 			return nil
 		}
 	}
 }
 
-func (h *hub) Close() error {
-	if !h.isRunning {
-		return nil
+// handleHello updates the capabilities of the sending client and acknowledges
+// them with a new hello.
+func (h *hub) handleHello(m *message) {
+	c := h.clients[m.From]
+
+	if c == nil || c.version == legacyVersion {
+		return
 	}
 
-	h.quit <- true
+	c.capabilities = parseCapabilities(m.Hello.Capabilities)
+	c.deliver(h.hello(c, false))
+}
+
+// handlePresence validates and stores the profile of the sending client. It
+// returns false if the message should be dropped.
+func (h *hub) handlePresence(m *message) bool {
+	c := h.clients[m.From]
+
+	if c == nil || !m.Presence.validate() {
+		return false
+	}
+
+	// Presence updates are always broadcasted to the whole room
+	m.To = ""
+	m.Presence.ID = c.id
+	c.presence = m.Presence
+
+	return true
+}
+
+// routes checks if the given message sent by the given client, nil for the
+// server, should be delivered to the recipient.
+func (h *hub) routes(m *message, sender, recipient *client) bool {
+	if !recipient.accepts(m) || (m.viewer && recipient.isViewer()) {
+		return false
+	}
+
+	return sender == nil || (sender.exchangesWith(recipient) && recipient.exchangesWith(sender))
+}
+
+// roster builds a snapshot of every other member in the room of the given
+// client. Viewers of broadcast rooms do not see each others.
+func (h *hub) roster(c *client) *message {
+	members := make([]*memberPayload, 0, len(h.rooms[c.room]))
+
+	for _, cli := range h.rooms[c.room] {
+		if cli != c && !cli.isSFU() && !(c.isViewer() && cli.isViewer()) && c.exchangesWith(cli) && cli.exchangesWith(c) {
+			members = append(members, cli.member())
+		}
+	}
+
+	return &message{
+		room: c.room,
+		To:   c.id,
+		Roster: &rosterPayload{
+			Members: members,
+		},
+	}
+}
+
+// roomInfo builds the snapshot of the given room.
+func (h *hub) roomInfo(id string) *RoomInfo {
+	clients := h.rooms[id]
+	info := &RoomInfo{
+		ID:       id,
+		Kind:     string(service.KindConference),
+		Topology: string(service.TopologyMesh),
+		Members:  make([]*memberPayload, len(clients)),
+	}
+
+	if room := h.service.GetRoom(id); room != nil {
+		info.Kind = string(room.Kind)
+	}
+
+	if h.forwarded[id] {
+		info.Topology = string(service.TopologySFU)
+	}
+
+	for i, c := range clients {
+		info.Members[i] = c.member()
+	}
+
+	return info
+}
+
+// resumable retrieves the detached client matching the given registration if
+// any.
+func (h *hub) resumable(reg *registration) *client {
+	for _, c := range h.rooms[reg.room] {
+		if c.canResume() && reg.hs.resumes(c.token) {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// remove the client from the hub and notify its room.
+func (h *hub) remove(c *client) {
+	if !c.isDetached() {
+		c.detach()
+	}
+
+	h.clients[c.id] = nil
+	delete(h.clients, c.id)
+
+	clients := h.rooms[c.room]
+
+	for i, cli := range clients {
+		if cli == c {
+			clients[i] = nil
+			h.rooms[c.room] = append(clients[:i], clients[i+1:]...)
+			break
+		}
+	}
+
+	h.logger.Debug(`left:
+	user: %s
+	room: %s`, c.id, c.room)
+
+	// Trigger a check for emptiness in a while
+	h.CheckEmptiness(c.room)
+
+	if c.isSFU() && h.forwarded[c.room] {
+		h.switchTo(c.room, "")
+	}
+
+	if c.isRecorder() {
+		h.announceRecording(c.room, false)
+	}
+
+	h.balance(c.room)
+
+	// Notify every other user in the same room that a user has left
+	left := &message{
+		room:   c.room,
+		From:   c.id,
+		viewer: c.isViewer(),
+		Left: &leftPayload{
+			ID: c.id,
+		},
+	}
+
+	go func() {
+		select {
+		case h.send <- left:
+		case <-h.done:
+		}
+	}()
+}
+
+// Close stops the hub, clients are detached by its goroutine if it was
+// running.
+func (h *hub) Close() error {
+	h.closing.Do(func() {
+		close(h.done)
+	})
 
 	return nil
 }
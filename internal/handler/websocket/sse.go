@@ -0,0 +1,268 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuukanoo/rtchat/internal/crypto"
+)
+
+const (
+	// maxPostSize is the maximum size of a message posted over HTTP.
+	maxPostSize = 128 * 1024
+	// incomingBufferSize is the number of posted messages waiting to be read by
+	// the hub.
+	incomingBufferSize = 16
+)
+
+var errStreamClosed = errors.New("event stream closed")
+
+type (
+	// streamConn is a connection made of a Server-Sent Events stream for server
+	// to client messages and HTTP POST requests for client to server ones.
+	streamConn struct {
+		id       string
+		room     string
+		w        http.ResponseWriter
+		flusher  http.Flusher
+		incoming chan []byte
+		done     chan struct{}
+
+		mutex  sync.Mutex
+		closed bool
+	}
+
+	// streams keeps track of opened event streams so posted messages can be
+	// routed to the right connection.
+	streams struct {
+		mutex sync.RWMutex
+		conns map[string]*streamConn
+	}
+)
+
+func newStreamConn(room string, w http.ResponseWriter, flusher http.Flusher) *streamConn {
+	return &streamConn{
+		id:       crypto.GenerateUID(32),
+		room:     room,
+		w:        w,
+		flusher:  flusher,
+		incoming: make(chan []byte, incomingBufferSize),
+		done:     make(chan struct{}),
+	}
+}
+
+func (c *streamConn) ReadJSON(v interface{}) error {
+	select {
+	case data := <-c.incoming:
+		return json.Unmarshal(data, v)
+	case <-c.done:
+		return errStreamClosed
+	}
+}
+
+func (c *streamConn) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+
+	if err != nil {
+		return err
+	}
+
+	return c.writeEvent("", data)
+}
+
+// writeEvent writes an event on the stream. Since JSON never contains raw line
+// breaks, the data always fits on a single line.
+func (c *streamConn) writeEvent(event string, data []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return errStreamClosed
+	}
+
+	if event != "" {
+		if _, err := fmt.Fprintf(c.w, "event: %s\n", event); err != nil {
+			return err
+		}
+	}
+
+	if _, err := fmt.Fprintf(c.w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+
+	c.flusher.Flush()
+
+	return nil
+}
+
+func (c *streamConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+
+	return nil
+}
+
+// post queues a message for the hub. It fails if the client is not reading
+// fast enough.
+func (c *streamConn) post(data []byte) error {
+	select {
+	case c.incoming <- data:
+		return nil
+	case <-c.done:
+		return errStreamClosed
+	default:
+		return fmt.Errorf("too many pending messages")
+	}
+}
+
+func (s *streams) add(c *streamConn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.conns[c.id] = c
+}
+
+func (s *streams) remove(c *streamConn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.conns[c.id] = nil
+	delete(s.conns, c.id)
+}
+
+func (s *streams) get(id string) *streamConn {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.conns[id]
+}
+
+// negotiateStream builds the handshake of an event stream request. Since the
+// EventSource API could not set headers, everything is given in the query
+// string.
+func negotiateStream(r *http.Request) *handshake {
+	query := r.URL.Query()
+
+	return &handshake{
+		version:      protocolVersion,
+		credential:   requestCredential(r),
+		resumeToken:  query.Get("resume"),
+		moderatorKey: query.Get("mod"),
+		capabilities: parseCapabilities(strings.Split(query.Get("caps"), ",")),
+	}
+}
+
+// requestCredential extracts the room credential from the Authorization header
+// or from the query string.
+func requestCredential(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	return r.URL.Query().Get("cred")
+}
+
+func (h *hub) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	hs := negotiateStream(r)
+	room := h.service.GetRoom(h.getRouteParam(r, "id"))
+
+	if room == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !hs.authorize(room.Credential) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	hs.moderator = hs.moderates(room.ModeratorKey)
+
+	if !h.admits(room, hs) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// The stream lives as long as the client is here so the server write timeout
+	// should not apply.
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	conn := newStreamConn(room.ID, w, flusher)
+
+	h.streams.add(conn)
+	defer h.streams.remove(conn)
+
+	// The first event gives the stream identifier needed to post messages
+	if err := conn.writeEvent("session", []byte(conn.id)); err != nil {
+		return
+	}
+
+	if !h.enroll(&registration{room: room.ID, conn: conn, hs: hs}) {
+		return
+	}
+
+	select {
+	case <-conn.done:
+	case <-r.Context().Done():
+		conn.Close()
+	}
+}
+
+func (h *hub) HandlePost(w http.ResponseWriter, r *http.Request) {
+	room := h.service.GetRoom(h.getRouteParam(r, "id"))
+
+	if room == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	hs := &handshake{credential: requestCredential(r)}
+
+	if !hs.authorize(room.Credential) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	conn := h.streams.get(r.URL.Query().Get("session"))
+
+	if conn == nil || conn.room != room.ID {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var m message
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxPostSize+1))
+
+	if err != nil || len(data) > maxPostSize || json.Unmarshal(data, &m) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err = conn.post(data); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
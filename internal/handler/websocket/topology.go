@@ -0,0 +1,193 @@
+package websocket
+
+import (
+	"time"
+
+	"github.com/yuukanoo/rtchat/internal/service"
+)
+
+// sfu retrieves the in-process participant forwarding media in the given room
+// if any.
+func (h *hub) sfu(room string) *client {
+	for _, c := range h.rooms[room] {
+		if c.isSFU() {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// hello builds the hello message of the given client, telling it who forwards
+// media in its room and if it could be recorded.
+func (h *hub) hello(c *client, resumed bool) *message {
+	m := c.hello(resumed)
+	m.Hello.Features.Recording = h.options.Recording()
+	m.Hello.Features.Mixing = h.controller.Mixing()
+
+	// Server side peers could not join relay only rooms
+	if room := h.service.GetRoom(c.room); room != nil && room.IsRelayOnly() {
+		m.Hello.Features.Recording = false
+		m.Hello.Features.Mixing = false
+	}
+
+	if sfu := h.sfu(c.room); sfu != nil && h.forwarded[c.room] {
+		m.Hello.SFU = sfu.id
+	}
+
+	return m
+}
+
+// participants counts remote clients in the given room.
+func (h *hub) participants(room string) int {
+	count := 0
+
+	for _, c := range h.rooms[room] {
+		if !c.local {
+			count++
+		}
+	}
+
+	return count
+}
+
+// release disconnects in-process participants of the given room. They will be
+// removed once their read pump has noticed it.
+func (h *hub) release(room string) {
+	for _, c := range h.rooms[room] {
+		if c.local && !c.isDetached() {
+			c.detach()
+		}
+	}
+}
+
+// forward is called when the forwarding unit has joined a room and tells
+// clients to use it if needed.
+func (h *hub) forward(sfu *client) {
+	delete(h.starting, sfu.room)
+
+	room := h.service.GetRoom(sfu.room)
+
+	if room == nil {
+		return
+	}
+
+	if room.IsForwarded() || (room.IsSwitchable() && h.participants(sfu.room) >= h.options.SFUThreshold()) {
+		h.switchTo(sfu.room, sfu.id)
+		return
+	}
+
+	// The room has shrunk while the forwarding unit was starting
+	h.scheduleRetire(sfu.room)
+}
+
+// balance switches rooms using the automatic topology to the forwarding unit
+// when they reach the threshold and back to a mesh when they shrink.
+func (h *hub) balance(id string) {
+	threshold := h.options.SFUThreshold()
+
+	if threshold <= 0 {
+		return
+	}
+
+	room := h.service.GetRoom(id)
+
+	if room == nil || !room.IsSwitchable() {
+		return
+	}
+
+	count := h.participants(id)
+
+	switch {
+	case count >= threshold && !h.forwarded[id]:
+		// The forwarding unit may still be there if the room has just shrunk
+		if sfu := h.sfu(id); sfu != nil {
+			h.switchTo(id, sfu.id)
+			return
+		}
+
+		if h.starting[id] {
+			return
+		}
+
+		h.starting[id] = true
+
+		go func() {
+			if err := h.controller.StartSFU(id); err != nil {
+				h.logger.Error("could not start the forwarding unit of %s: %s", id, err)
+
+				select {
+				case h.stalled <- id:
+				case <-h.done:
+				}
+			}
+		}()
+
+	case count < threshold-switchHysteresis && h.forwarded[id]:
+		h.switchTo(id, "")
+		h.scheduleRetire(id)
+	}
+}
+
+// switchTo tells every client of a room to use the given forwarding unit, or to
+// connect with each others if empty. The forwarding unit is prepared before
+// this message is sent so clients could keep their current connections until
+// the new ones are up.
+func (h *hub) switchTo(room string, sfu string) {
+	topology := service.TopologyMesh
+
+	if sfu != "" {
+		topology = service.TopologySFU
+		h.forwarded[room] = true
+	} else {
+		delete(h.forwarded, room)
+	}
+
+	for _, c := range h.rooms[room] {
+		if c.version == legacyVersion {
+			continue
+		}
+
+		c.deliver(&message{
+			room: room,
+			To:   c.id,
+			Switch: &switchPayload{
+				Topology: string(topology),
+				SFU:      sfu,
+			},
+		})
+	}
+
+	h.logger.Debug(`switched:
+	room: %s
+	topology: %s`, room, topology)
+}
+
+// scheduleRetire makes the forwarding unit leave the given room in a while if
+// it is still not needed.
+func (h *hub) scheduleRetire(room string) {
+	go func() {
+		select {
+		case <-time.After(switchGrace):
+		case <-h.done:
+			return
+		}
+
+		select {
+		case h.retire <- room:
+		case <-h.done:
+		}
+	}()
+}
+
+// retireSFU disconnects the forwarding unit of a room which is not forwarded
+// anymore.
+func (h *hub) retireSFU(room string) {
+	if h.forwarded[room] {
+		return
+	}
+
+	if sfu := h.sfu(room); sfu != nil && !sfu.isDetached() {
+		sfu.detach()
+	}
+}
@@ -0,0 +1,40 @@
+package websocket
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/yuukanoo/rtchat/internal/service"
+)
+
+func TestBalanceRetriesAfterAFailedStart(t *testing.T) {
+	controller := testController{sfu: make(chan string, 4), err: errors.New("unreachable")}
+	h, svc := startTestHub(t, testOptions{threshold: 2}, controller)
+	room := svc.GetRoom(svc.CreateRoom(service.RoomOptions{Topology: service.TopologyAuto}))
+
+	started := func() bool {
+		select {
+		case <-controller.sfu:
+			return true
+		case <-time.After(time.Second):
+			return false
+		}
+	}
+
+	dial(t, h, room)
+	dial(t, h, room)
+
+	if !started() {
+		t.Fatal("the forwarding unit should be started once the threshold is reached")
+	}
+
+	// Leave the hub some time to learn about the failure
+	time.Sleep(100 * time.Millisecond)
+
+	dial(t, h, room)
+
+	if !started() {
+		t.Fatal("the forwarding unit should be started again after a failure")
+	}
+}
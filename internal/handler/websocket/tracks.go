@@ -0,0 +1,165 @@
+package websocket
+
+import (
+	"strings"
+
+	"github.com/pion/sdp/v3"
+)
+
+const (
+	// ScreenShareAnyone lets every participant share its screen.
+	ScreenShareAnyone = "anyone"
+	// ScreenShareModerators only lets moderators share their screen.
+	ScreenShareModerators = "moderators"
+	// ScreenShareSingle lets one participant share its screen at a time.
+	ScreenShareSingle = "single"
+
+	purposeCamera     = "camera"
+	purposeMicrophone = "microphone"
+	purposeScreen     = "screen"
+
+	maxTracks = 8
+	// maxMSIDLength is the maximum length of stream and track identifiers as
+	// defined by the msid attribute.
+	maxMSIDLength = 64
+)
+
+// validate checks that the tracks are within bounds and have a known purpose.
+func (p *tracksPayload) validate() bool {
+	if len(p.Tracks) > maxTracks {
+		return false
+	}
+
+	for _, t := range p.Tracks {
+		if t == nil || !isValidMSID(t.Stream) || !isValidMSID(t.Track) {
+			return false
+		}
+
+		switch t.Purpose {
+		case purposeCamera, purposeMicrophone, purposeScreen:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// isValidMSID checks the given identifier only contains token characters.
+func isValidMSID(id string) bool {
+	if id == "" || len(id) > maxMSIDLength {
+		return false
+	}
+
+	for _, r := range id {
+		if r <= ' ' || r > '~' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sharesScreen checks if this client has an accepted screen track.
+func (c *client) sharesScreen() bool {
+	for _, t := range c.tracks {
+		if t.Purpose == purposeScreen {
+			return true
+		}
+	}
+
+	return false
+}
+
+// declares checks if this client has accepted the track with the given
+// identifier.
+func (c *client) declares(track string) bool {
+	for _, t := range c.tracks {
+		if t.Track == track {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mayShareScreen applies the screen sharing policy to the given client. Clients
+// which have lost their connection do not share anything until they resume.
+func (h *hub) mayShareScreen(c *client) bool {
+	switch h.options.ScreenSharing() {
+	case ScreenShareModerators:
+		return c.moderator || c.local
+	case ScreenShareSingle:
+		for _, cli := range h.rooms[c.room] {
+			if cli != c && !cli.isDetached() && cli.sharesScreen() {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// handleTracks stores the purpose of the tracks published by the sending client
+// and broadcasts them to the whole room. Screen tracks refused by the policy
+// are removed so the sender knows they will not be relayed.
+func (h *hub) handleTracks(m *message) {
+	c := h.clients[m.From]
+
+	if c == nil || c.isViewer() || !m.Tracks.validate() {
+		return
+	}
+
+	allowed := h.mayShareScreen(c)
+	tracks := make([]*trackPayload, 0, len(m.Tracks.Tracks))
+
+	for _, t := range m.Tracks.Tracks {
+		if t.Purpose == purposeScreen && !allowed {
+			continue
+		}
+
+		tracks = append(tracks, t)
+	}
+
+	m.To = ""
+	m.Tracks.ID = c.id
+	m.Tracks.Tracks = tracks
+	c.tracks = tracks
+
+	for _, cli := range h.rooms[c.room] {
+		if cli.accepts(m) {
+			cli.deliver(m)
+		}
+	}
+}
+
+// restricts returns whether a media section sent by the given client should be
+// made receive only, nil if every media section could be sent.
+func (h *hub) restricts(c *client) func(*sdp.MediaDescription) bool {
+	if c == nil {
+		return nil
+	}
+
+	// Viewers of broadcast rooms only receive media
+	if c.isViewer() {
+		return func(*sdp.MediaDescription) bool { return true }
+	}
+
+	// Under a restrictive policy, only tracks whose purpose has been accepted
+	// could be sent so undeclared ones could not bypass it. Legacy clients
+	// could not declare their tracks and do not share their screen.
+	if h.options.ScreenSharing() == ScreenShareAnyone || c.local || c.version == legacyVersion {
+		return nil
+	}
+
+	return func(media *sdp.MediaDescription) bool {
+		if media.MediaName.Media != "audio" && media.MediaName.Media != "video" {
+			return false
+		}
+
+		msid, _ := media.Attribute("msid")
+		fields := strings.Fields(msid)
+
+		return len(fields) != 2 || !c.declares(fields[1])
+	}
+}
@@ -0,0 +1,112 @@
+package websocket
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pion/sdp/v3"
+)
+
+func TestTracksPayloadValidate(t *testing.T) {
+	track := func(stream, id, purpose string) *trackPayload {
+		return &trackPayload{Stream: stream, Track: id, Purpose: purpose}
+	}
+
+	tooMany := make([]*trackPayload, maxTracks+1)
+
+	for i := range tooMany {
+		tooMany[i] = track("stream", "track", purposeCamera)
+	}
+
+	tests := []struct {
+		name   string
+		tracks []*trackPayload
+		valid  bool
+	}{
+		{"empty", nil, true},
+		{"every purpose", []*trackPayload{track("s", "a", purposeMicrophone), track("s", "v", purposeCamera), track("d", "d", purposeScreen)}, true},
+		{"unknown purpose", []*trackPayload{track("s", "a", "music")}, false},
+		{"missing track", []*trackPayload{nil}, false},
+		{"empty stream", []*trackPayload{track("", "a", purposeCamera)}, false},
+		{"empty track", []*trackPayload{track("s", "", purposeCamera)}, false},
+		{"separator", []*trackPayload{track("s", "a b", purposeCamera)}, false},
+		{"special character", []*trackPayload{track("s", "a:b", purposeCamera)}, false},
+		{"non ascii", []*trackPayload{track("s", "é", purposeCamera)}, false},
+		{"longest identifier", []*trackPayload{track("s", strings.Repeat("a", maxMSIDLength), purposeCamera)}, true},
+		{"too long identifier", []*trackPayload{track("s", strings.Repeat("a", maxMSIDLength+1), purposeCamera)}, false},
+		{"too many tracks", tooMany, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &tracksPayload{Tracks: test.tracks}
+
+			if got := p.validate(); got != test.valid {
+				t.Errorf("expected %v, got %v", test.valid, got)
+			}
+		})
+	}
+}
+
+func TestRestrictsUndeclaredTracks(t *testing.T) {
+	media := func(kind, msid string) *sdp.MediaDescription {
+		m := &sdp.MediaDescription{MediaName: sdp.MediaName{Media: kind}}
+
+		if msid != "" {
+			m = m.WithValueAttribute("msid", msid)
+		}
+
+		return m
+	}
+
+	c := &client{version: protocolVersion, tracks: []*trackPayload{{Stream: "stream", Track: "camera", Purpose: purposeCamera}}}
+	legacy := &client{version: legacyVersion}
+
+	tests := []struct {
+		name       string
+		policy     string
+		client     *client
+		media      *sdp.MediaDescription
+		restricted bool
+	}{
+		{"declared", ScreenShareSingle, c, media("video", "stream camera"), false},
+		{"undeclared", ScreenShareSingle, c, media("video", "stream screen"), true},
+		{"without stream", ScreenShareModerators, c, media("audio", "- microphone"), true},
+		{"without msid", ScreenShareModerators, c, media("video", ""), true},
+		{"data channel", ScreenShareModerators, c, media("application", ""), false},
+		{"anyone", ScreenShareAnyone, c, media("video", "stream screen"), false},
+		{"legacy camera", ScreenShareModerators, legacy, media("video", "stream camera"), false},
+		{"legacy microphone", ScreenShareSingle, legacy, media("audio", "stream microphone"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := &hub{options: testOptions{screen: test.policy}}
+			restricts := h.restricts(test.client)
+
+			if got := restricts != nil && restricts(test.media); got != test.restricted {
+				t.Errorf("expected %v, got %v", test.restricted, got)
+			}
+		})
+	}
+}
+
+func TestDetachedClientsDoNotShareTheirScreen(t *testing.T) {
+	screen := []*trackPayload{{Stream: "display", Track: "display", Purpose: purposeScreen}}
+	sharer := &client{id: "sharer", room: "room", tracks: screen, conn: newPipeConn()}
+	other := &client{id: "other", room: "room", conn: newPipeConn()}
+	h := &hub{
+		options: testOptions{screen: ScreenShareSingle},
+		rooms:   map[string][]*client{"room": {sharer, other}},
+	}
+
+	if h.mayShareScreen(other) {
+		t.Error("only one participant should share its screen at a time")
+	}
+
+	sharer.conn = nil
+
+	if !h.mayShareScreen(other) {
+		t.Error("a participant who has lost its connection should not prevent others from sharing")
+	}
+}
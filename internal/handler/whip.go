@@ -0,0 +1,235 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/yuukanoo/rtchat/internal/handler/websocket"
+	"github.com/yuukanoo/rtchat/internal/rtc"
+	"github.com/yuukanoo/rtchat/internal/service"
+
+	"github.com/go-chi/chi"
+)
+
+// maxOfferSize is the maximum size of an SDP offer posted to WHIP and WHEP
+// endpoints.
+const maxOfferSize = 64 * 1024
+
+type (
+	// endpoints keeps track of active WHIP and WHEP sessions so they could be
+	// terminated with a DELETE request.
+	endpoints struct {
+		mutex sync.Mutex
+		items map[string]*rtc.Endpoint
+	}
+)
+
+func (e *endpoints) add(ep *rtc.Endpoint) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.items[ep.ID] = ep
+
+	// Forget about it as soon as it is closed
+	go func() {
+		<-ep.Done()
+		e.remove(ep.ID)
+	}()
+}
+
+func (e *endpoints) remove(id string) *rtc.Endpoint {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	ep := e.items[id]
+	delete(e.items, id)
+	return ep
+}
+
+// removeFrom removes the given endpoint only if it belongs to the given room.
+func (e *endpoints) removeFrom(room, id string) *rtc.Endpoint {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	ep := e.items[id]
+
+	if ep == nil || ep.Room != room {
+		return nil
+	}
+
+	delete(e.items, id)
+	return ep
+}
+
+func (e *endpoints) closeAll() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for id, ep := range e.items {
+		ep.Close()
+		delete(e.items, id)
+	}
+}
+
+// authorizedRoom retrieves the room targeted by a WHIP or WHEP request and
+// checks the bearer token against the room credential or its moderator key.
+func (r *router) authorizedRoom(w http.ResponseWriter, req *http.Request) *service.Room {
+	room := r.service.GetRoom(chi.URLParam(req, "id"))
+
+	if room == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	token, bearer := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+
+	if !(bearer && subtle.ConstantTimeCompare([]byte(token), []byte(room.Credential)) == 1) && !room.IsModerator(moderatorKey(req)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil
+	}
+
+	return room
+}
+
+// reachableRoom checks that server side peers could connect in the given room
+// and writes the appropriate status if not.
+func reachableRoom(w http.ResponseWriter, room *service.Room) bool {
+	if room.IsRelayOnly() {
+		http.Error(w, errRelayOnly.Error(), http.StatusConflict)
+		return false
+	}
+
+	return true
+}
+
+// readOffer reads the SDP offer in the request body.
+func readOffer(w http.ResponseWriter, req *http.Request) (string, bool) {
+	if !strings.HasPrefix(req.Header.Get("Content-Type"), "application/sdp") {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return "", false
+	}
+
+	offer, err := io.ReadAll(io.LimitReader(req.Body, maxOfferSize+1))
+
+	if err != nil || len(offer) == 0 || len(offer) > maxOfferSize {
+		w.WriteHeader(http.StatusBadRequest)
+		return "", false
+	}
+
+	return string(offer), true
+}
+
+// negotiate joins the room with the given function and creates the endpoint
+// with the other one.
+func (r *router) negotiate(w http.ResponseWriter, req *http.Request, room *service.Room, join func() (websocket.Pipe, error), offer string, create func(rtc.Signal) (*rtc.Endpoint, error)) {
+	pipe, err := join()
+
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	ep, err := create(pipe)
+
+	if err != nil {
+		pipe.Close()
+		r.logger.Error("could not negotiate %s: %s", req.URL.Path, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	r.endpoints.add(ep)
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", req.URL.Path+"/"+ep.ID)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, ep.Answer)
+}
+
+// Publish handles WHIP requests to publish a stream in a room.
+func (r *router) Publish(w http.ResponseWriter, req *http.Request) {
+	room := r.authorizedRoom(w, req)
+
+	if room == nil {
+		return
+	}
+
+	if !reachableRoom(w, room) {
+		return
+	}
+
+	// Only presenters publish in broadcast rooms
+	if room.IsBroadcast() && !room.IsModerator(moderatorKey(req)) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	offer, ok := readOffer(w, req)
+
+	if !ok {
+		return
+	}
+
+	join := func() (websocket.Pipe, error) {
+		return r.ws.Join(room.ID, []string{websocket.CapabilityPresenter})
+	}
+
+	r.negotiate(w, req, room, join, offer, func(signal rtc.Signal) (*rtc.Endpoint, error) {
+		return r.engine.Publish(room, signal, offer)
+	})
+}
+
+// View handles WHEP requests to watch a participant of a room.
+func (r *router) View(w http.ResponseWriter, req *http.Request) {
+	room := r.authorizedRoom(w, req)
+
+	if room == nil {
+		return
+	}
+
+	if !reachableRoom(w, room) {
+		return
+	}
+
+	participant := req.URL.Query().Get("participant")
+
+	if participant == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	offer, ok := readOffer(w, req)
+
+	if !ok {
+		return
+	}
+
+	// The viewer only talks with the watched participant so other peers do not
+	// try to connect with it
+	join := func() (websocket.Pipe, error) {
+		return r.ws.Watch(room.ID, participant)
+	}
+
+	r.negotiate(w, req, room, join, offer, func(signal rtc.Signal) (*rtc.Endpoint, error) {
+		return r.engine.View(room, signal, participant, offer)
+	})
+}
+
+// StopEndpoint terminates a WHIP or WHEP session of the authorized room.
+func (r *router) StopEndpoint(w http.ResponseWriter, req *http.Request) {
+	room := r.authorizedRoom(w, req)
+
+	if room == nil {
+		return
+	}
+
+	ep := r.endpoints.removeFrom(room.ID, chi.URLParam(req, "resource"))
+
+	if ep == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	ep.Close()
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,280 @@
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yuukanoo/rtchat/internal/handler/websocket"
+	"github.com/yuukanoo/rtchat/internal/ice"
+	"github.com/yuukanoo/rtchat/internal/logging"
+	"github.com/yuukanoo/rtchat/internal/service"
+
+	pionlogging "github.com/pion/logging"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+type testOptions struct{}
+
+func (testOptions) ICEServers() []ice.Server                 { return nil }
+func (testOptions) LoggerFactory() pionlogging.LoggerFactory { return nil }
+func (testOptions) Anonymous() bool                          { return false }
+func (testOptions) SFUThreshold() int                        { return 0 }
+func (testOptions) RecordDir() string                        { return "" }
+func (testOptions) Recording() bool                          { return false }
+func (testOptions) RoomCapacity() int                        { return 0 }
+func (testOptions) BroadcastCapacity() int                   { return 0 }
+func (testOptions) ScreenSharing() string                    { return websocket.ScreenShareAnyone }
+
+// TestMain runs tests from the root of the repository where templates are.
+func TestMain(m *testing.M) {
+	if err := os.Chdir("../.."); err != nil {
+		panic(err)
+	}
+
+	os.Exit(m.Run())
+}
+
+func TestWHIPAndWHEP(t *testing.T) {
+	svc := service.New()
+	rt, err := New(svc, logging.New(false), testOptions{}, nil, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rt.Close()
+
+	srv := httptest.NewServer(rt.Handler())
+	defer srv.Close()
+
+	room := svc.GetRoom(svc.CreateRoom(service.RoomOptions{}))
+
+	// A participant of the room sees the published stream as another peer
+	pipe, err := rt.(*router).ws.Join(room.ID, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer pipe.Close()
+
+	publisher := make(chan string, 1)
+
+	go func() {
+		for {
+			data, err := pipe.Read()
+
+			if err != nil {
+				return
+			}
+
+			var m struct {
+				From     string `json:"from"`
+				Presence *struct {
+					Name string `json:"name"`
+				} `json:"presence"`
+			}
+
+			if json.Unmarshal(data, &m) == nil && m.Presence != nil && m.Presence.Name == "Live stream" {
+				publisher <- m.From
+			}
+		}
+	}()
+
+	// Publish an audio track with WHIP
+	whip, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer whip.Close()
+
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "encoder")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = whip.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+
+	whipResource := exchange(t, whip, srv.URL+"/whip/"+room.ID, room.Credential)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+
+		for seq := uint16(0); ; seq++ {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				track.WriteRTP(&rtp.Packet{
+					Header:  rtp.Header{Version: 2, PayloadType: 111, SequenceNumber: seq, Timestamp: uint32(seq) * 960},
+					Payload: []byte{0xf8, 0xff, 0xfe},
+				})
+			}
+		}
+	}()
+
+	var id string
+
+	select {
+	case id = <-publisher:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the published stream has not joined the room")
+	}
+
+	// Pull it back with WHEP
+	whep, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer whep.Close()
+
+	if _, err = whep.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan struct{}, 1)
+
+	whep.OnTrack(func(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		if _, _, err := remote.ReadRTP(); err == nil {
+			received <- struct{}{}
+		}
+	})
+
+	whepResource := exchange(t, whep, srv.URL+"/whep/"+room.ID+"?participant="+id, room.Credential)
+
+	select {
+	case <-received:
+	case <-time.After(15 * time.Second):
+		t.Fatal("the WHEP viewer has not received the published stream")
+	}
+
+	// The credential of another room could not stop these sessions
+	other := svc.GetRoom(svc.CreateRoom(service.RoomOptions{}))
+
+	for _, resource := range []string{whepResource, whipResource} {
+		req, _ := http.NewRequest(http.MethodDelete, srv.URL+strings.Replace(resource, room.ID, other.ID, 1), nil)
+		req.Header.Set("Authorization", "Bearer "+other.Credential)
+		res, err := http.DefaultClient.Do(req)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusNotFound {
+			t.Errorf("DELETE %s from another room returned %d", resource, res.StatusCode)
+		}
+	}
+
+	for _, resource := range []string{whepResource, whipResource} {
+		req, _ := http.NewRequest(http.MethodDelete, srv.URL+resource, nil)
+		req.Header.Set("Authorization", "Bearer "+room.Credential)
+		res, err := http.DefaultClient.Do(req)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("DELETE %s returned %d", resource, res.StatusCode)
+		}
+	}
+}
+
+func TestWHIPUnauthorized(t *testing.T) {
+	svc := service.New()
+	rt, err := New(svc, logging.New(false), testOptions{}, nil, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rt.Close()
+
+	srv := httptest.NewServer(rt.Handler())
+	defer srv.Close()
+
+	room := svc.GetRoom(svc.CreateRoom(service.RoomOptions{}))
+
+	for _, auth := range []string{"", "Bearer ", "Bearer " + room.Credential + "x", room.Credential} {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/whip/"+room.ID, strings.NewReader("v=0"))
+		req.Header.Set("Content-Type", "application/sdp")
+		req.Header.Set("Authorization", auth)
+		res, err := http.DefaultClient.Do(req)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Authorization %q returned %d", auth, res.StatusCode)
+		}
+	}
+}
+
+// exchange posts the offer of the given peer connection to a WHIP or WHEP
+// endpoint, applies the answer and returns the location of the resource.
+func exchange(t *testing.T, pc *webrtc.PeerConnection, url, credential string) string {
+	t.Helper()
+
+	offer, err := pc.CreateOffer(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gathered := webrtc.GatheringCompletePromise(pc)
+
+	if err = pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+
+	<-gathered
+
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(pc.LocalDescription().SDP))
+	req.Header.Set("Content-Type", "application/sdp")
+	req.Header.Set("Authorization", "Bearer "+credential)
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	answer, _ := io.ReadAll(res.Body)
+
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("POST %s returned %d", url, res.StatusCode)
+	}
+
+	if err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(answer)}); err != nil {
+		t.Fatal(err)
+	}
+
+	return res.Header.Get("Location")
+}
@@ -0,0 +1,231 @@
+// Package health watches the SAM bridge through which rtchat is reachable and
+// rebuilds the I2P sessions of its components when they are lost, for example
+// after a restart of the router.
+package health
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-i2p/sam3"
+	"github.com/yuukanoo/rtchat/internal/logging"
+)
+
+// State of the SAM bridge and of the sessions built on it.
+type State string
+
+const (
+	// StateUp means the bridge is reachable and every session is alive.
+	StateUp State = "up"
+	// StateDown means the bridge is unreachable or a session has been lost.
+	StateDown State = "down"
+	// StateReconnecting means sessions are being rebuilt.
+	StateReconnecting State = "reconnecting"
+)
+
+type (
+	// Status is a snapshot of the health of the bridge.
+	Status struct {
+		State State     `json:"state"`
+		Since time.Time `json:"since"`
+		// Error which made the bridge go down, if any.
+		Error string `json:"error,omitempty"`
+		// Reconnections is the number of times sessions have been rebuilt.
+		Reconnections int `json:"reconnections"`
+	}
+
+	// Supervisor probes the bridge and reconnects every watched component
+	// when the bridge comes back, or only the ones which report a lost session
+	// while it stays up.
+	Supervisor struct {
+		address    string
+		interval   time.Duration
+		logger     logging.Logger
+		mutex      sync.Mutex
+		status     Status
+		components []component
+		// Names of the components whose sessions should be rebuilt.
+		stale   map[string]bool
+		lost    chan error
+		done    chan struct{}
+		closing sync.Once
+	}
+
+	component struct {
+		name      string
+		reconnect func() error
+	}
+)
+
+// New builds a supervisor probing the bridge at the given address every
+// interval. The bridge is considered up until a probe fails.
+func New(address string, interval time.Duration, logger logging.Logger) *Supervisor {
+	return &Supervisor{
+		address:  address,
+		interval: interval,
+		logger:   logger,
+		status:   Status{State: StateUp, Since: time.Now()},
+		stale:    make(map[string]bool),
+		lost:     make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// Watch registers a component whose sessions should be rebuilt with the given
+// function. Components are reconnected in the order they are registered.
+func (s *Supervisor) Watch(name string, reconnect func() error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.components = append(s.components, component{name, reconnect})
+}
+
+// Lost reports that a component has lost its session, it is reconnected as
+// soon as possible.
+func (s *Supervisor) Lost(name string, err error) {
+	s.mutex.Lock()
+	s.stale[name] = true
+	s.mutex.Unlock()
+
+	select {
+	case s.lost <- fmt.Errorf("%s: %w", name, err):
+	default:
+	}
+}
+
+// Status retrieves the current health of the bridge.
+func (s *Supervisor) Status() Status {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.status
+}
+
+// Run probes the bridge until the supervisor is closed.
+func (s *Supervisor) Run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case err := <-s.lost:
+			s.fail(err)
+			s.recover()
+		case <-ticker.C:
+			if err := probe(s.address); err != nil {
+				s.down(err)
+				continue
+			}
+
+			// Sessions die with the router so they are rebuilt once it is back
+			if s.Status().State != StateUp {
+				s.recover()
+			}
+		}
+	}
+}
+
+// Close stops probing the bridge.
+func (s *Supervisor) Close() {
+	s.closing.Do(func() {
+		close(s.done)
+	})
+}
+
+// recover rebuilds the sessions of the stale components. It gives up on the
+// first failure and waits for the next probe to try again.
+func (s *Supervisor) recover() {
+	if err := probe(s.address); err != nil {
+		s.down(err)
+		return
+	}
+
+	s.set(StateReconnecting, nil)
+
+	s.mutex.Lock()
+	components := s.components
+	s.mutex.Unlock()
+
+	for _, c := range components {
+		s.mutex.Lock()
+		stale := s.stale[c.name]
+		s.mutex.Unlock()
+
+		if !stale {
+			continue
+		}
+
+		if err := c.reconnect(); err != nil {
+			s.fail(fmt.Errorf("%s: %w", c.name, err))
+			return
+		}
+
+		s.mutex.Lock()
+		delete(s.stale, c.name)
+		s.mutex.Unlock()
+	}
+
+	s.mutex.Lock()
+	s.status.Reconnections++
+	s.mutex.Unlock()
+
+	s.set(StateUp, nil)
+	s.logger.Info("sam: sessions rebuilt on the bridge at %s", s.address)
+}
+
+// down marks the bridge as unreachable, every session dies with it.
+func (s *Supervisor) down(err error) {
+	s.mutex.Lock()
+
+	for _, c := range s.components {
+		s.stale[c.name] = true
+	}
+
+	s.mutex.Unlock()
+
+	s.fail(err)
+}
+
+// fail marks the bridge as down. Only the first error is logged so an
+// unreachable bridge does not flood the logs.
+func (s *Supervisor) fail(err error) {
+	if s.set(StateDown, err) {
+		s.logger.Error("sam: bridge at %s is down: %s", s.address, err)
+	}
+}
+
+// set changes the state of the bridge and returns true if it was not already
+// in this state.
+func (s *Supervisor) set(state State, err error) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	changed := s.status.State != state
+
+	if changed {
+		s.status.State = state
+		s.status.Since = time.Now()
+	}
+
+	s.status.Error = ""
+
+	if err != nil {
+		s.status.Error = err.Error()
+	}
+
+	return changed
+}
+
+// probe checks that the bridge answers a hello.
+func probe(address string) error {
+	bridge, err := sam3.NewSAM(address)
+
+	if err != nil {
+		return err
+	}
+
+	return bridge.Close()
+}
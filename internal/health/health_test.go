@@ -0,0 +1,110 @@
+package health
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/yuukanoo/rtchat/internal/logging"
+)
+
+// bridge answers the hello of a SAM client on every connection.
+func bridge(t *testing.T) net.Listener {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				if _, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+					conn.Write([]byte("HELLO REPLY RESULT=OK VERSION=3.1\n"))
+				}
+			}()
+		}
+	}()
+
+	return l
+}
+
+func TestRecoverOnlyReconnectsLostComponents(t *testing.T) {
+	l := bridge(t)
+	defer l.Close()
+
+	s := New(l.Addr().String(), time.Hour, logging.New(false))
+	reconnected := make(map[string]int)
+
+	for _, name := range []string{"web", "turn"} {
+		s.Watch(name, func() error {
+			reconnected[name]++
+			return nil
+		})
+	}
+
+	s.Lost("turn", errors.New("session lost"))
+	s.fail(<-s.lost)
+	s.recover()
+
+	if reconnected["web"] != 0 || reconnected["turn"] != 1 {
+		t.Fatalf("expected only turn to be reconnected, got %v", reconnected)
+	}
+
+	if state := s.Status().State; state != StateUp {
+		t.Errorf("expected the bridge to be %s, got %s", StateUp, state)
+	}
+
+	// Every session dies with the bridge
+	s.down(errors.New("bridge down"))
+	s.recover()
+
+	if reconnected["web"] != 1 || reconnected["turn"] != 2 {
+		t.Errorf("expected every component to be reconnected, got %v", reconnected)
+	}
+}
+
+func TestRecoverRetriesFailedComponents(t *testing.T) {
+	l := bridge(t)
+	defer l.Close()
+
+	s := New(l.Addr().String(), time.Hour, logging.New(false))
+	failing := true
+	reconnected := 0
+
+	s.Watch("web", func() error { return nil })
+	s.Watch("turn", func() error {
+		if failing {
+			return errors.New("bridge busy")
+		}
+
+		reconnected++
+		return nil
+	})
+
+	s.Lost("turn", errors.New("session lost"))
+	s.recover()
+
+	if state := s.Status().State; state != StateDown {
+		t.Fatalf("expected the bridge to be %s, got %s", StateDown, state)
+	}
+
+	failing = false
+	s.recover()
+
+	if reconnected != 1 || s.Status().State != StateUp {
+		t.Errorf("expected turn to be reconnected on the next try, got %d reconnections and state %s", reconnected, s.Status().State)
+	}
+}
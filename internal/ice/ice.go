@@ -0,0 +1,211 @@
+// Package ice describes the STUN and TURN servers advertised to peers, the
+// built-in one as well as external ones.
+package ice
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/yuukanoo/rtchat/internal/service"
+)
+
+const (
+	// TransportClearnet servers are reached directly and learn the addresses of
+	// peers.
+	TransportClearnet = "clearnet"
+	// TransportI2P servers are reached over I2P.
+	TransportI2P = "i2p"
+	// TransportTor servers are reached over Tor.
+	TransportTor = "tor"
+
+	// CredentialNone is used by servers which do not authenticate peers such as
+	// STUN ones.
+	CredentialNone = "none"
+	// CredentialStatic uses the same username and password for every room.
+	CredentialStatic = "static"
+	// CredentialSecret derives short lived credentials from a secret shared
+	// with the server, as done by the TURN REST API.
+	CredentialSecret = "secret"
+	// CredentialRoom mints a username for each peer of the room, signed with a
+	// secret of the room. This is how the built-in server authenticates peers.
+	CredentialRoom = "room"
+
+	// defaultTTL is the lifetime of credentials derived from a shared secret.
+	defaultTTL = 24 * time.Hour
+)
+
+type (
+	// Server is a STUN or TURN server which could be advertised to peers.
+	Server struct {
+		URLs       []string `json:"urls"`
+		Transport  string   `json:"transport"`
+		Credential string   `json:"credential"`
+		Username   string   `json:"username,omitempty"`
+		Password   string   `json:"password,omitempty"`
+		Secret     string   `json:"secret,omitempty"`
+		// TTL of credentials derived from the secret, such as "12h".
+		TTL string `json:"ttl,omitempty"`
+	}
+
+	// ICEServer is the configuration of a server given to a peer connection of
+	// a room.
+	ICEServer struct {
+		URLs       []string `json:"urls"`
+		Username   string   `json:"username,omitempty"`
+		Credential string   `json:"credential,omitempty"`
+	}
+)
+
+// Load reads external servers from the given JSON file, which contains an
+// array of servers.
+func Load(path string) ([]Server, error) {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var servers []Server
+
+	if err := json.Unmarshal(data, &servers); err != nil {
+		return nil, fmt.Errorf("ice: could not parse %s: %w", path, err)
+	}
+
+	for i := range servers {
+		if err := servers[i].Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return servers, nil
+}
+
+// Validate checks that the server is correctly described, defaulting its
+// transport to the clearnet and its credential mode to none.
+func (s *Server) Validate() error {
+	if len(s.URLs) == 0 {
+		return fmt.Errorf("ice: server without urls")
+	}
+
+	for _, u := range s.URLs {
+		if !strings.HasPrefix(u, "stun:") && !strings.HasPrefix(u, "stuns:") && !strings.HasPrefix(u, "turn:") && !strings.HasPrefix(u, "turns:") {
+			return fmt.Errorf("ice: unknown scheme for %s", u)
+		}
+	}
+
+	if s.Transport == "" {
+		s.Transport = TransportClearnet
+	}
+
+	switch s.Transport {
+	case TransportClearnet, TransportI2P, TransportTor:
+	default:
+		return fmt.Errorf("ice: unknown transport %q for %s", s.Transport, s.URLs[0])
+	}
+
+	if s.Credential == "" {
+		s.Credential = CredentialNone
+	}
+
+	switch s.Credential {
+	case CredentialNone, CredentialRoom:
+	case CredentialStatic:
+		if s.Username == "" || s.Password == "" {
+			return fmt.Errorf("ice: static credential of %s needs a username and a password", s.URLs[0])
+		}
+	case CredentialSecret:
+		if s.Secret == "" {
+			return fmt.Errorf("ice: secret credential of %s needs a secret", s.URLs[0])
+		}
+
+		if _, err := s.ttl(); err != nil {
+			return fmt.Errorf("ice: invalid ttl for %s: %w", s.URLs[0], err)
+		}
+	default:
+		return fmt.Errorf("ice: unknown credential mode %q for %s", s.Credential, s.URLs[0])
+	}
+
+	return nil
+}
+
+// ICEServer builds the configuration of this server for the given room.
+func (s *Server) ICEServer(room *service.Room) ICEServer {
+	server := ICEServer{URLs: s.URLs}
+
+	switch s.Credential {
+	case CredentialStatic:
+		server.Username = s.Username
+		server.Credential = s.Password
+	case CredentialSecret:
+		ttl, _ := s.ttl()
+		server.Username = fmt.Sprintf("%d:%s", time.Now().Add(ttl).Unix(), room.ID)
+
+		mac := hmac.New(sha1.New, []byte(s.Secret))
+		mac.Write([]byte(server.Username))
+		server.Credential = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	case CredentialRoom:
+		server.Username = room.RelayUsername()
+		server.Credential = room.RelayPassword(server.Username)
+	}
+
+	return server
+}
+
+// Allows checks if the server could be used by peers of the given room.
+// Clearnet servers would learn the addresses of peers so they are never given
+// to relay only rooms.
+func (s *Server) Allows(room *service.Room) bool {
+	return !room.IsRelayOnly() || s.Transport != TransportClearnet
+}
+
+// IsTURN checks if the server relays streams.
+func (s *Server) IsTURN() bool {
+	for _, u := range s.URLs {
+		if strings.HasPrefix(u, "turn:") || strings.HasPrefix(u, "turns:") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Server) ttl() (time.Duration, error) {
+	if s.TTL == "" {
+		return defaultTTL, nil
+	}
+
+	return time.ParseDuration(s.TTL)
+}
+
+// Relays checks if one of the given servers could relay the streams of relay
+// only rooms, which could not connect without it.
+func Relays(servers []Server) bool {
+	relayOnly := &service.Room{Privacy: service.PrivacyRelay}
+
+	for i := range servers {
+		if servers[i].IsTURN() && servers[i].Allows(relayOnly) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Configure builds the configuration of the servers allowed in the given room.
+func Configure(room *service.Room, servers []Server) []ICEServer {
+	config := make([]ICEServer, 0, len(servers))
+
+	for i := range servers {
+		if servers[i].Allows(room) {
+			config = append(config, servers[i].ICEServer(room))
+		}
+	}
+
+	return config
+}
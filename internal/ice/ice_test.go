@@ -0,0 +1,117 @@
+package ice
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yuukanoo/rtchat/internal/service"
+)
+
+func TestServerICEServer(t *testing.T) {
+	room := &service.Room{ID: "room", Credential: "credential", RelaySecret: "secret"}
+	urls := []string{"turn:relay.example.org:3478"}
+
+	tests := []struct {
+		name     string
+		server   Server
+		username string
+		password string
+	}{
+		{"none", Server{URLs: urls, Credential: CredentialNone, Username: "ignored", Password: "ignored"}, "", ""},
+		{"static", Server{URLs: urls, Credential: CredentialStatic, Username: "rtchat", Password: "secret"}, "rtchat", "secret"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.server.ICEServer(room)
+
+			if len(got.URLs) != 1 || got.URLs[0] != urls[0] {
+				t.Errorf("expected urls %v, got %v", urls, got.URLs)
+			}
+
+			if got.Username != test.username || got.Credential != test.password {
+				t.Errorf("expected %q:%q, got %q:%q", test.username, test.password, got.Username, got.Credential)
+			}
+		})
+	}
+
+	t.Run("room", func(t *testing.T) {
+		server := Server{URLs: urls, Credential: CredentialRoom}
+		got, other := server.ICEServer(room), server.ICEServer(room)
+
+		if service.RelayRoom(got.Username) != room.ID || got.Credential != room.RelayPassword(got.Username) {
+			t.Errorf("expected a credential of %s signed by the room, got %q:%q", room.ID, got.Username, got.Credential)
+		}
+
+		if got.Username == other.Username {
+			t.Error("expected every peer to get its own credential")
+		}
+	})
+
+	for _, ttl := range []struct {
+		value    string
+		duration time.Duration
+	}{
+		{"", defaultTTL},
+		{"12h", 12 * time.Hour},
+	} {
+		t.Run(fmt.Sprintf("secret with ttl %q", ttl.value), func(t *testing.T) {
+			server := Server{URLs: urls, Credential: CredentialSecret, Secret: "shared", TTL: ttl.value}
+			got := server.ICEServer(room)
+
+			expiry, id, found := strings.Cut(got.Username, ":")
+
+			if !found || id != room.ID {
+				t.Fatalf("expected a username of the form expiry:%s, got %q", room.ID, got.Username)
+			}
+
+			at, err := strconv.ParseInt(expiry, 10, 64)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if d := time.Until(time.Unix(at, 0)); d < ttl.duration-time.Minute || d > ttl.duration {
+				t.Errorf("expected credentials to expire in %s, got %s", ttl.duration, d)
+			}
+
+			mac := hmac.New(sha1.New, []byte("shared"))
+			mac.Write([]byte(got.Username))
+
+			if expected := base64.StdEncoding.EncodeToString(mac.Sum(nil)); got.Credential != expected {
+				t.Errorf("expected credential %q, got %q", expected, got.Credential)
+			}
+		})
+	}
+}
+
+func TestRelays(t *testing.T) {
+	stun := Server{URLs: []string{"stun:stun.example.org:3478"}, Transport: TransportI2P}
+	clearnet := Server{URLs: []string{"turn:relay.example.org:3478"}, Transport: TransportClearnet}
+	i2p := Server{URLs: []string{"stun:relay.b32.i2p:3478", "turn:relay.b32.i2p:3478"}, Transport: TransportI2P}
+
+	tests := []struct {
+		name    string
+		servers []Server
+		relays  bool
+	}{
+		{"no server", nil, false},
+		{"clearnet turn", []Server{clearnet}, false},
+		{"i2p stun", []Server{stun, clearnet}, false},
+		{"i2p turn", []Server{clearnet, i2p}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Relays(test.servers); got != test.relays {
+				t.Errorf("expected %v, got %v", test.relays, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package logging
+
+import (
+	"fmt"
+	"strings"
+
+	pion "github.com/pion/logging"
+)
+
+// defaultPionLevel is the level of pion scopes which have not been given one.
+const defaultPionLevel = pion.LogLevelWarn
+
+type (
+	// pionFactory creates loggers for pion components, such as the turn server
+	// or peer connections, which write to a Logger.
+	pionFactory struct {
+		logger   Logger
+		fallback pion.LogLevel
+		levels   map[string]pion.LogLevel
+	}
+
+	// pionLogger drops messages above the level of its scope. Trace and debug
+	// messages are only printed in debug mode.
+	pionLogger struct {
+		logger Logger
+		scope  string
+		level  pion.LogLevel
+	}
+)
+
+// NewPionFactory builds a pion LoggerFactory writing to the given logger. Levels
+// are given as a comma separated list of scope=level pairs, a level without
+// scope applies to every other scope, for example "error,turn=debug".
+func NewPionFactory(logger Logger, levels string) (pion.LoggerFactory, error) {
+	f := &pionFactory{
+		logger:   logger,
+		fallback: defaultPionLevel,
+		levels:   make(map[string]pion.LogLevel),
+	}
+
+	for _, entry := range strings.Split(levels, ",") {
+		entry = strings.TrimSpace(entry)
+
+		if entry == "" {
+			continue
+		}
+
+		scope, name, scoped := strings.Cut(entry, "=")
+
+		if !scoped {
+			name = scope
+		}
+
+		level, err := parsePionLevel(name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if scoped {
+			f.levels[strings.TrimSpace(scope)] = level
+		} else {
+			f.fallback = level
+		}
+	}
+
+	return f, nil
+}
+
+// parsePionLevel converts a level name such as "warn" to a pion level.
+func parsePionLevel(name string) (pion.LogLevel, error) {
+	for level := pion.LogLevelDisabled; level <= pion.LogLevelTrace; level++ {
+		if strings.EqualFold(strings.TrimSpace(name), level.String()) {
+			return level, nil
+		}
+	}
+
+	return pion.LogLevelDisabled, fmt.Errorf("logging: unknown pion level %q", name)
+}
+
+func (f *pionFactory) NewLogger(scope string) pion.LeveledLogger {
+	level, found := f.levels[scope]
+
+	if !found {
+		level = f.fallback
+	}
+
+	return &pionLogger{
+		logger: f.logger,
+		scope:  scope,
+		level:  level,
+	}
+}
+
+func (l *pionLogger) Trace(msg string) { l.Tracef("%s", msg) }
+func (l *pionLogger) Debug(msg string) { l.Debugf("%s", msg) }
+func (l *pionLogger) Info(msg string)  { l.Infof("%s", msg) }
+func (l *pionLogger) Warn(msg string)  { l.Warnf("%s", msg) }
+func (l *pionLogger) Error(msg string) { l.Errorf("%s", msg) }
+
+func (l *pionLogger) Tracef(format string, args ...interface{}) {
+	if l.level >= pion.LogLevelTrace {
+		l.logger.Debug(l.scope+": "+format, args...)
+	}
+}
+
+func (l *pionLogger) Debugf(format string, args ...interface{}) {
+	if l.level >= pion.LogLevelDebug {
+		l.logger.Debug(l.scope+": "+format, args...)
+	}
+}
+
+func (l *pionLogger) Infof(format string, args ...interface{}) {
+	if l.level >= pion.LogLevelInfo {
+		l.logger.Info(l.scope+": "+format, args...)
+	}
+}
+
+func (l *pionLogger) Warnf(format string, args ...interface{}) {
+	if l.level >= pion.LogLevelWarn {
+		l.logger.Info(l.scope+": warning: "+format, args...)
+	}
+}
+
+func (l *pionLogger) Errorf(format string, args ...interface{}) {
+	if l.level >= pion.LogLevelError {
+		l.logger.Error(l.scope+": "+format, args...)
+	}
+}
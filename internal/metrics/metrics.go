@@ -0,0 +1,23 @@
+// Package metrics exposes counters collected by the different components of
+// rtchat using the expvar standard package.
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+)
+
+var (
+	// Signaling counters related to messages relayed by the realtime server.
+	Signaling = expvar.NewMap("signaling")
+	// Relay counters related to allocations of the TURN server.
+	Relay = expvar.NewMap("relay")
+)
+
+// Handler serves rtchat metrics as JSON. Unlike expvar.Handler, it does not
+// expose the command line nor the memory statistics of the process.
+func Handler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n%q: %s,\n%q: %s\n}\n", "signaling", Signaling.String(), "relay", Relay.String())
+}
@@ -0,0 +1,116 @@
+// Package rtc contains server side WebRTC participants built on top of
+// pion/webrtc. They join rooms through the realtime server exactly like
+// browsers do and exchange media with them.
+package rtc
+
+import (
+	"github.com/yuukanoo/rtchat/internal/ice"
+	"github.com/yuukanoo/rtchat/internal/logging"
+	"github.com/yuukanoo/rtchat/internal/service"
+
+	"github.com/pion/interceptor"
+	pionlogging "github.com/pion/logging"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	// opusCodec is the only audio codec negotiated by server side peers so
+	// packets could be forwarded between them without transcoding.
+	opusCodec = webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeOpus,
+		ClockRate:   48000,
+		Channels:    2,
+		SDPFmtpLine: "minptime=10;useinbandfec=1",
+	}
+
+	// vp8Codec is the only video codec negotiated by server side peers.
+	vp8Codec = webrtc.RTPCodecCapability{
+		MimeType:  webrtc.MimeTypeVP8,
+		ClockRate: 90000,
+	}
+)
+
+type (
+	// Options needed by the engine to configure peer connections.
+	Options interface {
+		// ICEServers lists STUN and TURN servers used by server side peers.
+		ICEServers() []ice.Server
+		// LoggerFactory creates the loggers of peer connections.
+		LoggerFactory() pionlogging.LoggerFactory
+	}
+
+	// Engine creates peer connections sharing the same codecs and interceptors.
+	Engine struct {
+		api     *webrtc.API
+		options Options
+		logger  logging.Logger
+	}
+)
+
+// New instantiates a new engine.
+func New(logger logging.Logger, options Options) (*Engine, error) {
+	m := &webrtc.MediaEngine{}
+
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: opusCodec,
+		PayloadType:        111,
+	}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, err
+	}
+
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: vp8Codec,
+		PayloadType:        96,
+	}, webrtc.RTPCodecTypeVideo); err != nil {
+		return nil, err
+	}
+
+	i := &interceptor.Registry{}
+
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, err
+	}
+
+	// Peer connections log through the application logger
+	settings := webrtc.SettingEngine{LoggerFactory: options.LoggerFactory()}
+
+	return &Engine{
+		api:     webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(settings)),
+		options: options,
+		logger:  logger,
+	}, nil
+}
+
+// configuration builds the peer connection configuration for the given room,
+// using the servers it is allowed to use and its privacy policy.
+func (e *Engine) configuration(room *service.Room) webrtc.Configuration {
+	var config webrtc.Configuration
+
+	for _, server := range ice.Configure(room, e.options.ICEServers()) {
+		config.ICEServers = append(config.ICEServers, webrtc.ICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: server.Credential,
+		})
+	}
+
+	if room.IsRelayOnly() {
+		config.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	}
+
+	return config
+}
+
+// newPeerConnection creates a peer connection for the given room.
+func (e *Engine) newPeerConnection(room *service.Room) (*webrtc.PeerConnection, error) {
+	return e.api.NewPeerConnection(e.configuration(room))
+}
+
+// codecFor returns the codec used for the given kind of track.
+func codecFor(kind webrtc.RTPCodecType) webrtc.RTPCodecCapability {
+	if kind == webrtc.RTPCodecTypeVideo {
+		return vp8Codec
+	}
+
+	return opusCodec
+}
@@ -0,0 +1,296 @@
+package rtc
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/yuukanoo/rtchat/internal/handler/websocket"
+	"github.com/yuukanoo/rtchat/internal/logging"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+const (
+	// mixFrameDuration is the duration of the audio frames mixed together.
+	mixFrameDuration = 20 * time.Millisecond
+	// mixFrameSize is the number of samples in a frame, audio is mixed in mono
+	// at 48kHz.
+	mixFrameSize = 960
+	// maxDecodedSize is the number of samples of the longest Opus packet.
+	maxDecodedSize = 6 * mixFrameSize
+	// mixQueueSize is the number of frames buffered for each participant, older
+	// ones are dropped to keep the latency low.
+	mixQueueSize = 10
+)
+
+var errMixingUnavailable = errors.New("rtc: audio mixing is not available, build with the opus tag")
+
+type (
+	opusDecoder interface {
+		Decode([]byte, []int16) (int, error)
+	}
+
+	opusEncoder interface {
+		Encode([]int16, []byte) (int, error)
+	}
+
+	// mixer decodes the audio tracks of every participant and produces one
+	// track per listener containing every voice but its own.
+	mixer struct {
+		logger    logging.Logger
+		mutex     sync.Mutex
+		sources   map[mixKey]*mixSource
+		listeners map[string]*mixListener
+		done      chan struct{}
+		closing   sync.Once
+	}
+
+	// mixKey identifies an audio track being mixed since a participant may
+	// publish several of them.
+	mixKey struct {
+		participant string
+		track       string
+	}
+
+	mixSource struct {
+		decoder opusDecoder
+		pcm     []int16
+		frames  chan []int16
+		current []int16
+	}
+
+	mixListener struct {
+		encoder opusEncoder
+		track   *webrtc.TrackLocalStaticSample
+		buf     []byte
+	}
+)
+
+var (
+	// newOpusDecoder and newOpusEncoder are only set when built with libopus.
+	newOpusDecoder func() (opusDecoder, error)
+	newOpusEncoder func() (opusEncoder, error)
+)
+
+// CanMix checks if the engine could mix audio for clients announcing
+// websocket.CapabilityMix.
+func (e *Engine) CanMix() bool {
+	return newOpusDecoder != nil && newOpusEncoder != nil
+}
+
+// newMixer creates a mixer and starts producing frames.
+func newMixer(logger logging.Logger) (*mixer, error) {
+	if newOpusDecoder == nil || newOpusEncoder == nil {
+		return nil, errMixingUnavailable
+	}
+
+	m := &mixer{
+		logger:    logger,
+		sources:   make(map[mixKey]*mixSource),
+		listeners: make(map[string]*mixListener),
+		done:      make(chan struct{}),
+	}
+
+	go m.run()
+
+	return m, nil
+}
+
+// addSource starts mixing the given audio track of a participant.
+func (m *mixer) addSource(key mixKey) error {
+	decoder, err := newOpusDecoder()
+
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.sources[key] = &mixSource{
+		decoder: decoder,
+		pcm:     make([]int16, maxDecodedSize),
+		frames:  make(chan []int16, mixQueueSize),
+	}
+
+	return nil
+}
+
+func (m *mixer) removeSource(key mixKey) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.sources, key)
+}
+
+// push decodes an Opus packet of the given track. Packets are expected in order
+// since there is no jitter buffer.
+func (m *mixer) push(key mixKey, payload []byte) {
+	m.mutex.Lock()
+	source := m.sources[key]
+	m.mutex.Unlock()
+
+	if source == nil {
+		return
+	}
+
+	n, err := source.decoder.Decode(payload, source.pcm)
+
+	if err != nil {
+		return
+	}
+
+	for i := 0; i+mixFrameSize <= n; i += mixFrameSize {
+		frame := make([]int16, mixFrameSize)
+		copy(frame, source.pcm[i:i+mixFrameSize])
+
+		select {
+		case source.frames <- frame:
+		default:
+			// Too late, drop the oldest frame
+			select {
+			case <-source.frames:
+			default:
+			}
+
+			source.frames <- frame
+		}
+	}
+}
+
+// addListener creates the track on which the given participant receives the
+// mix.
+func (m *mixer) addListener(id string) (*webrtc.TrackLocalStaticSample, error) {
+	encoder, err := newOpusEncoder()
+
+	if err != nil {
+		return nil, err
+	}
+
+	track, err := webrtc.NewTrackLocalStaticSample(opusCodec, "mix", websocket.CapabilityMix)
+
+	if err != nil {
+		return nil, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.listeners[id] = &mixListener{
+		encoder: encoder,
+		track:   track,
+		buf:     make([]byte, 1500),
+	}
+
+	return track, nil
+}
+
+// removeListener stops mixing for the given participant and returns its track.
+func (m *mixer) removeListener(id string) *webrtc.TrackLocalStaticSample {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	l := m.listeners[id]
+
+	if l == nil {
+		return nil
+	}
+
+	delete(m.listeners, id)
+
+	return l.track
+}
+
+// listens checks if the given participant receives the mix.
+func (m *mixer) listens(id string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.listeners[id] != nil
+}
+
+func (m *mixer) close() {
+	m.closing.Do(func() { close(m.done) })
+}
+
+func (m *mixer) run() {
+	ticker := time.NewTicker(mixFrameDuration)
+	defer ticker.Stop()
+
+	sum := make([]int32, mixFrameSize)
+	own := make([]int32, mixFrameSize)
+	mix := make([]int16, mixFrameSize)
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			m.mix(sum, own, mix)
+		}
+	}
+}
+
+// mix takes one frame from every track and sends every listener the sum of
+// them without its own ones.
+func (m *mixer) mix(sum []int32, own []int32, mix []int16) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i := range sum {
+		sum[i] = 0
+	}
+
+	for _, source := range m.sources {
+		select {
+		case source.current = <-source.frames:
+		default:
+			source.current = nil
+		}
+
+		for i, v := range source.current {
+			sum[i] += int32(v)
+		}
+	}
+
+	for id, l := range m.listeners {
+		copy(own, sum)
+
+		for key, source := range m.sources {
+			if key.participant != id {
+				continue
+			}
+
+			for i, v := range source.current {
+				own[i] -= int32(v)
+			}
+		}
+
+		for i, v := range own {
+			mix[i] = clip(v)
+		}
+
+		n, err := l.encoder.Encode(mix, l.buf)
+
+		if err != nil {
+			m.logger.Debug("rtc: could not encode the mix: %s", err)
+			continue
+		}
+
+		l.track.WriteSample(media.Sample{Data: l.buf[:n], Duration: mixFrameDuration})
+	}
+}
+
+// clip converts a sum of samples back to a sample without overflowing.
+func clip(v int32) int16 {
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	}
+
+	if v < math.MinInt16 {
+		return math.MinInt16
+	}
+
+	return int16(v)
+}
@@ -0,0 +1,16 @@
+//go:build opus
+
+package rtc
+
+import "gopkg.in/hraban/opus.v2"
+
+// Audio mixing needs libopus, build with the opus tag to enable it.
+func init() {
+	newOpusDecoder = func() (opusDecoder, error) {
+		return opus.NewDecoder(48000, 1)
+	}
+
+	newOpusEncoder = func() (opusEncoder, error) {
+		return opus.NewEncoder(48000, 1, opus.AppVoIP)
+	}
+}
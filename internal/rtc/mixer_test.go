@@ -0,0 +1,75 @@
+package rtc
+
+import (
+	"testing"
+
+	"github.com/yuukanoo/rtchat/internal/logging"
+)
+
+// constantDecoder decodes a packet to a frame whose samples all equal its
+// first byte.
+type constantDecoder struct{}
+
+func (constantDecoder) Decode(payload []byte, pcm []int16) (int, error) {
+	for i := 0; i < mixFrameSize; i++ {
+		pcm[i] = int16(payload[0])
+	}
+
+	return mixFrameSize, nil
+}
+
+// recordingEncoder keeps the first sample of the last encoded frame.
+type recordingEncoder struct {
+	sample *int16
+}
+
+func (e recordingEncoder) Encode(pcm []int16, data []byte) (int, error) {
+	*e.sample = pcm[0]
+	return 1, nil
+}
+
+func TestMixerKeepsEveryTrackOfAParticipant(t *testing.T) {
+	samples := make(map[string]*int16)
+	listener := ""
+
+	defer func(decoder func() (opusDecoder, error), encoder func() (opusEncoder, error)) {
+		newOpusDecoder, newOpusEncoder = decoder, encoder
+	}(newOpusDecoder, newOpusEncoder)
+
+	newOpusDecoder = func() (opusDecoder, error) { return constantDecoder{}, nil }
+	newOpusEncoder = func() (opusEncoder, error) {
+		samples[listener] = new(int16)
+		return recordingEncoder{samples[listener]}, nil
+	}
+
+	m := &mixer{
+		logger:    logging.New(false),
+		sources:   make(map[mixKey]*mixSource),
+		listeners: make(map[string]*mixListener),
+	}
+
+	for _, key := range []mixKey{{"alice", "microphone"}, {"alice", "music"}, {"bob", "microphone"}} {
+		if err := m.addSource(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, id := range []string{"alice", "bob", "carol"} {
+		listener = id
+
+		if _, err := m.addListener(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m.push(mixKey{"alice", "microphone"}, []byte{1})
+	m.push(mixKey{"alice", "music"}, []byte{2})
+	m.push(mixKey{"bob", "microphone"}, []byte{4})
+	m.mix(make([]int32, mixFrameSize), make([]int32, mixFrameSize), make([]int16, mixFrameSize))
+
+	for id, expected := range map[string]int16{"alice": 4, "bob": 3, "carol": 7} {
+		if *samples[id] != expected {
+			t.Errorf("%s should hear %d, got %d", id, expected, *samples[id])
+		}
+	}
+}
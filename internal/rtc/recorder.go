@@ -0,0 +1,173 @@
+package rtc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuukanoo/rtchat/internal/service"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+)
+
+var errUnsupportedCodec = errors.New("rtc: could not record this codec")
+
+// Recorder is a server side participant which writes the tracks of every other
+// participant to disk, Opus audio in Ogg files and VP8 video in IVF files.
+type Recorder struct {
+	session *Session
+	dir     string
+	consent bool
+
+	mutex     sync.Mutex
+	consented map[string]bool
+}
+
+// Record creates a recorder for the given room. Files are written in a new
+// directory under the given one. Run must be called to start processing
+// signaling messages.
+func (e *Engine) Record(room *service.Room, signal Signal, dir string) (*Recorder, error) {
+	dir = filepath.Join(dir, fileName(room.ID), time.Now().UTC().Format("20060102-150405"))
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	r := &Recorder{
+		dir:       dir,
+		consent:   room.RequireConsent,
+		consented: make(map[string]bool),
+	}
+
+	r.session = e.NewSession(room, signal, SessionOptions{
+		Name:      "Recorder",
+		OnTrack:   r.record,
+		OnConsent: r.setConsent,
+	})
+
+	return r, nil
+}
+
+// Run processes signaling messages until the signal is closed.
+func (r *Recorder) Run() {
+	r.session.Run()
+}
+
+// Done is closed when the recorder has stopped.
+func (r *Recorder) Done() <-chan struct{} {
+	return r.session.Done()
+}
+
+// Close stops the recording and leaves the room.
+func (r *Recorder) Close() error {
+	return r.session.Close()
+}
+
+func (r *Recorder) setConsent(id string, given bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.consented[id] = given
+}
+
+// allows checks if the given participant could be recorded. The hub only tells
+// the recorder about participants who have been notified of the recording,
+// others could still be relayed by the forwarding unit.
+func (r *Recorder) allows(id string) bool {
+	if !r.session.isMember(id) {
+		return false
+	}
+
+	if !r.consent {
+		return true
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.consented[id]
+}
+
+// record writes the given track until it ends. Packets are dropped while its
+// owner has not agreed to be recorded.
+func (r *Recorder) record(from string, remote *webrtc.TrackRemote) {
+	owner := r.session.owner(from, remote)
+
+	var writer media.Writer
+
+	defer func() {
+		if writer != nil {
+			writer.Close()
+		}
+	}()
+
+	for {
+		packet, _, err := remote.ReadRTP()
+
+		if err != nil {
+			return
+		}
+
+		if !r.allows(owner) {
+			continue
+		}
+
+		if writer == nil {
+			if writer, err = r.create(owner, remote); err != nil {
+				r.session.engine.logger.Error("rtc: could not record track of %s: %s", owner, err)
+				return
+			}
+		}
+
+		if err = writer.WriteRTP(packet); err != nil {
+			r.session.engine.logger.Error("rtc: could not record track of %s: %s", owner, err)
+			return
+		}
+	}
+}
+
+// create the file for a track of the given participant.
+func (r *Recorder) create(owner string, remote *webrtc.TrackRemote) (media.Writer, error) {
+	name := filepath.Join(r.dir, fmt.Sprintf("%s-%d", fileName(owner), time.Now().UnixNano()))
+
+	var (
+		writer media.Writer
+		err    error
+	)
+
+	// Writers are only assigned on success so a nil pointer never ends up in
+	// the interface
+	switch mime := remote.Codec().MimeType; {
+	case strings.EqualFold(mime, webrtc.MimeTypeOpus):
+		var w *oggwriter.OggWriter
+
+		if w, err = oggwriter.New(name+".ogg", opusCodec.ClockRate, opusCodec.Channels); err == nil {
+			writer = w
+		}
+	case strings.EqualFold(mime, webrtc.MimeTypeVP8):
+		var w *ivfwriter.IVFWriter
+
+		if w, err = ivfwriter.New(name + ".ivf"); err == nil {
+			writer = w
+		}
+	default:
+		err = errUnsupportedCodec
+	}
+
+	return writer, err
+}
+
+// fileName makes the given identifier safe to use in a path.
+func fileName(id string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, id)
+}
@@ -0,0 +1,710 @@
+package rtc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/yuukanoo/rtchat/internal/service"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// keyframeInterval is the delay between two picture loss indications sent
+	// to video sources so new receivers get a keyframe quickly.
+	keyframeInterval = 3 * time.Second
+	// migrationDelay is the time given to the forwarding unit to take over
+	// before connections made in the mesh are closed.
+	migrationDelay = 5 * time.Second
+)
+
+type (
+	// SessionOptions customizes how a session behaves in its room.
+	SessionOptions struct {
+		// Name displayed to other participants.
+		Name string
+		// Tracks sent to every accepted participant.
+		Tracks []webrtc.TrackLocal
+		// Accept decides if a connection should be made with the given
+		// participant. Every participant is accepted if nil.
+		Accept func(string) bool
+		// OnTrack is called when a participant sends a track.
+		OnTrack func(string, *webrtc.TrackRemote)
+		// OnLeave is called when a participant leaves the room.
+		OnLeave func(string)
+		// OnConsent is called when a participant tells whether it agrees to be
+		// recorded.
+		OnConsent func(string, bool)
+		// OnJoin is called with the capabilities of every participant in the
+		// room, before any connection is made with it.
+		OnJoin func(string, []string)
+		// Excludes decides if a track added with AddTrack should not be sent to
+		// the given participant.
+		Excludes func(string, webrtc.TrackLocal) bool
+		// SFU makes this session the forwarding unit of its room. It always
+		// offers to receive media and every participant connects to it only.
+		SFU bool
+	}
+
+	// Session is a server side participant of a room. It makes one peer
+	// connection with every accepted participant, like browsers do in the mesh
+	// topology.
+	Session struct {
+		engine  *Engine
+		room    *service.Room
+		signal  Signal
+		options SessionOptions
+
+		mutex   sync.Mutex
+		id      string
+		sfu     string
+		members map[string]bool
+		tracks  []*sessionTrack
+		peers   map[string]*sessionPeer
+		done    chan struct{}
+		closing sync.Once
+	}
+
+	// sessionTrack is a track added while the session is running, sent to every
+	// participant but its source or to its target only.
+	sessionTrack struct {
+		track  webrtc.TrackLocal
+		source string
+		target string
+	}
+
+	sessionPeer struct {
+		pc        *webrtc.PeerConnection
+		pending   []webrtc.ICECandidateInit
+		senders   map[webrtc.TrackLocal]*webrtc.RTPSender
+		receiving bool
+		// Set while an offer is waiting for its answer, another negotiation is
+		// needed once it is received if renegotiate is set.
+		negotiating bool
+		renegotiate bool
+	}
+)
+
+// NewSession creates a session in the given room. Run must be called to start
+// processing signaling messages.
+func (e *Engine) NewSession(room *service.Room, signal Signal, options SessionOptions) *Session {
+	return &Session{
+		engine:  e,
+		room:    room,
+		signal:  signal,
+		options: options,
+		members: make(map[string]bool),
+		peers:   make(map[string]*sessionPeer),
+		done:    make(chan struct{}),
+	}
+}
+
+// ID returns the identifier of this session in the room once known.
+func (s *Session) ID() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.id
+}
+
+// Run processes signaling messages until the signal is closed.
+func (s *Session) Run() {
+	defer s.Close()
+
+	for {
+		m, err := readMessage(s.signal)
+
+		if err != nil {
+			return
+		}
+
+		switch {
+		case m.Hello != nil:
+			s.mutex.Lock()
+			s.id = m.Hello.ID
+			s.sfu = m.Hello.SFU
+			s.mutex.Unlock()
+
+			if s.options.Name != "" {
+				s.send(&message{Presence: &presencePayload{Name: s.options.Name}})
+			}
+
+		case m.Roster != nil:
+			for _, member := range m.Roster.Members {
+				s.join(member.ID, member.Capabilities)
+
+				if member.Consent && s.options.OnConsent != nil {
+					s.options.OnConsent(member.ID, true)
+				}
+			}
+
+			// The forwarding unit connects with everyone already there
+			if s.isForwarding() {
+				s.offerMissing()
+			}
+
+		case m.Joined != nil:
+			s.join(m.Joined.ID, m.Joined.Capabilities)
+
+			// Existing participants make the offer to newcomers
+			if s.isForwarding() {
+				s.offerMissing()
+			} else if !s.options.SFU && s.accepts(m.Joined.ID) {
+				s.offer(m.Joined.ID)
+			}
+
+		case m.Left != nil:
+			s.leave(m.Left.ID)
+			s.remove(m.Left.ID)
+
+			if s.options.OnLeave != nil {
+				s.options.OnLeave(m.Left.ID)
+			}
+
+		case m.Switch != nil:
+			s.switchTo(m.Switch.SFU)
+
+		case m.Consent != nil:
+			if s.options.OnConsent != nil {
+				s.options.OnConsent(m.Consent.ID, m.Consent.Recording)
+			}
+
+		case m.Offer != nil:
+			if s.accepts(m.From) {
+				s.answer(m.From, m.Offer)
+			}
+
+		case m.Answer != nil:
+			s.setAnswer(m.From, m.Answer)
+
+		case m.ICE != nil:
+			s.addCandidate(m.From, m.ICE)
+		}
+	}
+}
+
+// Close every peer connection and leave the room.
+func (s *Session) Close() error {
+	s.closing.Do(func() {
+		close(s.done)
+		s.signal.Close()
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		for id, p := range s.peers {
+			p.pc.Close()
+			delete(s.peers, id)
+		}
+	})
+
+	return nil
+}
+
+// Done is closed when the session has ended.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// AddTrack sends a track to every participant but its source, renegotiating
+// existing connections.
+func (s *Session) AddTrack(track webrtc.TrackLocal, source string) {
+	s.mutex.Lock()
+	s.tracks = append(s.tracks, &sessionTrack{track: track, source: source})
+	ids := make([]string, 0, len(s.peers))
+
+	for id := range s.peers {
+		if id != source {
+			ids = append(ids, id)
+		}
+	}
+
+	s.mutex.Unlock()
+
+	for _, id := range ids {
+		s.renegotiate(id)
+	}
+}
+
+// AddTrackTo sends a track to the given participant only.
+func (s *Session) AddTrackTo(track webrtc.TrackLocal, target string) {
+	s.mutex.Lock()
+	s.tracks = append(s.tracks, &sessionTrack{track: track, target: target})
+	s.mutex.Unlock()
+
+	s.renegotiate(target)
+}
+
+// RemoveTrack stops sending a track added with AddTrack.
+func (s *Session) RemoveTrack(track webrtc.TrackLocal) {
+	s.mutex.Lock()
+
+	for i, t := range s.tracks {
+		if t.track == track {
+			s.tracks = append(s.tracks[:i], s.tracks[i+1:]...)
+			break
+		}
+	}
+
+	ids := make([]string, 0, len(s.peers))
+
+	for id, p := range s.peers {
+		if sender := p.senders[track]; sender != nil {
+			delete(p.senders, track)
+			p.pc.RemoveTrack(sender)
+			ids = append(ids, id)
+		}
+	}
+
+	s.mutex.Unlock()
+
+	for _, id := range ids {
+		s.renegotiate(id)
+	}
+}
+
+func (s *Session) join(id string, capabilities []string) {
+	s.mutex.Lock()
+	s.members[id] = true
+	s.mutex.Unlock()
+
+	if s.options.OnJoin != nil {
+		s.options.OnJoin(id, capabilities)
+	}
+}
+
+func (s *Session) leave(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.members, id)
+}
+
+// isMember checks if the hub has told this session about the given participant.
+func (s *Session) isMember(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.members[id]
+}
+
+// isForwarding checks if this session is the forwarding unit currently used by
+// its room.
+func (s *Session) isForwarding() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.options.SFU && s.id != "" && s.sfu == s.id
+}
+
+// offerMissing makes an offer to every accepted member without a connection.
+func (s *Session) offerMissing() {
+	s.mutex.Lock()
+	ids := make([]string, 0, len(s.members))
+
+	for id := range s.members {
+		if s.peers[id] == nil && (s.options.SFU || s.id < id) {
+			ids = append(ids, id)
+		}
+	}
+
+	s.mutex.Unlock()
+
+	for _, id := range ids {
+		if s.options.SFU || s.accepts(id) {
+			s.offer(id)
+		}
+	}
+}
+
+// switchTo follows a topology change of the room. The forwarding unit connects
+// with every member while others either wait for its offer or, when going back
+// to a mesh, offer to members with a greater identifier.
+func (s *Session) switchTo(sfu string) {
+	s.mutex.Lock()
+	s.sfu = sfu
+	s.mutex.Unlock()
+
+	if s.options.SFU {
+		if s.isForwarding() {
+			s.offerMissing()
+		}
+
+		return
+	}
+
+	if sfu == "" {
+		s.offerMissing()
+		return
+	}
+
+	// Mesh connections are kept until the forwarding unit had the time to
+	// take over
+	go func() {
+		select {
+		case <-time.After(migrationDelay):
+		case <-s.done:
+			return
+		}
+
+		s.mutex.Lock()
+		ids := make([]string, 0, len(s.peers))
+
+		for id := range s.peers {
+			if s.sfu == sfu && id != sfu {
+				ids = append(ids, id)
+			}
+		}
+
+		s.mutex.Unlock()
+
+		for _, id := range ids {
+			s.remove(id)
+		}
+	}()
+}
+
+// owner returns the participant a track received from the given one belongs
+// to, which differs for tracks relayed by the forwarding unit.
+func (s *Session) owner(from string, track *webrtc.TrackRemote) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.sfu != "" && from == s.sfu {
+		return track.StreamID()
+	}
+
+	return from
+}
+
+// accepts checks if a connection should be made with the given participant. In
+// rooms using a forwarding unit, it is the only participant to connect with.
+func (s *Session) accepts(id string) bool {
+	if id == "" {
+		return false
+	}
+
+	s.mutex.Lock()
+	sfu := s.sfu
+	s.mutex.Unlock()
+
+	if sfu != "" && !s.options.SFU {
+		return id == sfu
+	}
+
+	return s.options.Accept == nil || s.options.Accept(id)
+}
+
+func (s *Session) send(m *message) {
+	if err := writeMessage(s.signal, m); err != nil {
+		s.engine.logger.Debug("rtc: could not send signaling message: %s", err)
+	}
+}
+
+// peer retrieves or creates the peer connection with the given participant.
+func (s *Session) peer(id string) (*sessionPeer, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if p := s.peers[id]; p != nil {
+		return p, nil
+	}
+
+	pc, err := s.engine.newPeerConnection(s.room)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+
+		init := c.ToJSON()
+		s.send(&message{To: id, ICE: &init})
+	})
+
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			go requestKeyframes(pc, track)
+		}
+
+		if s.options.OnTrack != nil {
+			s.options.OnTrack(id, track)
+		}
+	})
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed {
+			s.remove(id)
+		}
+	})
+
+	p := &sessionPeer{
+		pc:      pc,
+		senders: make(map[webrtc.TrackLocal]*webrtc.RTPSender),
+	}
+	s.peers[id] = p
+
+	return p, nil
+}
+
+// addTracks adds the tracks the given participant is not receiving yet to its
+// peer connection.
+func (s *Session) addTracks(id string, p *sessionPeer) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tracks := make([]webrtc.TrackLocal, 0, len(s.options.Tracks)+len(s.tracks))
+	tracks = append(tracks, s.options.Tracks...)
+
+	for _, t := range s.tracks {
+		if t.source == id || (t.target != "" && t.target != id) {
+			continue
+		}
+
+		if s.options.Excludes != nil && s.options.Excludes(id, t.track) {
+			continue
+		}
+
+		tracks = append(tracks, t.track)
+	}
+
+	for _, track := range tracks {
+		if p.senders[track] != nil {
+			continue
+		}
+
+		sender, err := p.pc.AddTrack(track)
+
+		if err != nil {
+			return err
+		}
+
+		p.senders[track] = sender
+		go drainRTCP(sender)
+	}
+
+	return nil
+}
+
+// renegotiate updates the tracks sent to the given participant and makes a new
+// offer.
+func (s *Session) renegotiate(id string) {
+	s.mutex.Lock()
+	p := s.peers[id]
+	s.mutex.Unlock()
+
+	if p != nil {
+		s.offer(id)
+	}
+}
+
+func (s *Session) offer(id string) {
+	p, err := s.peer(id)
+
+	if err != nil {
+		s.engine.logger.Error("rtc: could not make an offer: %s", err)
+		return
+	}
+
+	// Only one offer could be waiting for an answer at a time
+	s.mutex.Lock()
+
+	if p.negotiating {
+		p.renegotiate = true
+		s.mutex.Unlock()
+		return
+	}
+
+	p.negotiating = true
+	receive := !p.receiving && (s.options.SFU || (len(s.options.Tracks) == 0 && s.options.OnTrack != nil))
+	p.receiving = p.receiving || receive
+	s.mutex.Unlock()
+
+	err = s.addTracks(id, p)
+
+	// Without tracks to send, we still want to receive the participant ones
+	if err == nil && receive {
+		for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+			if _, err = p.pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+				Direction: webrtc.RTPTransceiverDirectionRecvonly,
+			}); err != nil {
+				break
+			}
+		}
+	}
+
+	var offer webrtc.SessionDescription
+
+	if err == nil {
+		offer, err = p.pc.CreateOffer(nil)
+	}
+
+	if err == nil {
+		err = p.pc.SetLocalDescription(offer)
+	}
+
+	if err != nil {
+		s.engine.logger.Error("rtc: could not make an offer: %s", err)
+		s.remove(id)
+		return
+	}
+
+	s.send(&message{To: id, Offer: &offer})
+}
+
+func (s *Session) answer(id string, offer *webrtc.SessionDescription) {
+	p, err := s.peer(id)
+
+	if err == nil {
+		s.mutex.Lock()
+		p.negotiating = true
+		s.mutex.Unlock()
+
+		err = p.pc.SetRemoteDescription(*offer)
+	}
+
+	// Tracks are added after the remote description so existing transceivers
+	// are reused
+	if err == nil {
+		err = s.addTracks(id, p)
+	}
+
+	var answer webrtc.SessionDescription
+
+	if err == nil {
+		answer, err = p.pc.CreateAnswer(nil)
+	}
+
+	if err == nil {
+		err = p.pc.SetLocalDescription(answer)
+	}
+
+	if err != nil {
+		s.engine.logger.Error("rtc: could not answer an offer: %s", err)
+		s.remove(id)
+		return
+	}
+
+	s.flushCandidates(p)
+	s.send(&message{To: id, Answer: &answer})
+	s.negotiated(id, p)
+}
+
+func (s *Session) setAnswer(id string, answer *webrtc.SessionDescription) {
+	s.mutex.Lock()
+	p := s.peers[id]
+	s.mutex.Unlock()
+
+	if p == nil {
+		return
+	}
+
+	if err := p.pc.SetRemoteDescription(*answer); err != nil {
+		s.engine.logger.Error("rtc: could not set answer: %s", err)
+		s.remove(id)
+		return
+	}
+
+	s.flushCandidates(p)
+	s.negotiated(id, p)
+}
+
+// negotiated is called when the connection with the given participant is back
+// to a stable state.
+func (s *Session) negotiated(id string, p *sessionPeer) {
+	s.mutex.Lock()
+	again := p.renegotiate
+	p.negotiating = false
+	p.renegotiate = false
+	s.mutex.Unlock()
+
+	// Tracks have changed during the negotiation
+	if again {
+		s.offer(id)
+	}
+}
+
+// addCandidate adds a remote candidate or keeps it until the remote
+// description is known.
+func (s *Session) addCandidate(id string, candidate *webrtc.ICECandidateInit) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	p := s.peers[id]
+
+	if p == nil {
+		return
+	}
+
+	if p.pc.RemoteDescription() == nil {
+		p.pending = append(p.pending, *candidate)
+		return
+	}
+
+	p.pc.AddICECandidate(*candidate)
+}
+
+func (s *Session) flushCandidates(p *sessionPeer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, c := range p.pending {
+		p.pc.AddICECandidate(c)
+	}
+
+	p.pending = nil
+}
+
+func (s *Session) remove(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if p := s.peers[id]; p != nil {
+		p.pc.Close()
+		delete(s.peers, id)
+	}
+}
+
+// requestKeyframes periodically asks the sender of a video track for a
+// keyframe until the connection is closed.
+func requestKeyframes(pc *webrtc.PeerConnection, track *webrtc.TrackRemote) {
+	ticker := time.NewTicker(keyframeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := pc.WriteRTCP([]rtcp.Packet{
+			&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())},
+		}); err != nil {
+			return
+		}
+	}
+}
+
+// drainRTCP reads incoming RTCP packets so interceptors could process them.
+func drainRTCP(sender *webrtc.RTPSender) {
+	buf := make([]byte, 1500)
+
+	for {
+		if _, _, err := sender.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+// forward copies RTP packets from a remote track to a local one until the
+// remote track ends.
+func forward(remote *webrtc.TrackRemote, local *webrtc.TrackLocalStaticRTP) {
+	buf := make([]byte, 1500)
+
+	for {
+		n, _, err := remote.Read(buf)
+
+		if err != nil {
+			return
+		}
+
+		// Errors are ignored since they only mean nobody is bound to the local
+		// track yet
+		local.Write(buf[:n])
+	}
+}
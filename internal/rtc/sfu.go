@@ -0,0 +1,155 @@
+package rtc
+
+import (
+	"github.com/yuukanoo/rtchat/internal/handler/websocket"
+	"github.com/yuukanoo/rtchat/internal/service"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// SFU is a selective forwarding unit. Every participant of its room makes a
+// single peer connection with it and it forwards their tracks to all the
+// others. Forwarded tracks use the participant identifier as their stream
+// identifier so clients know who they belong to.
+//
+// When the engine can mix audio, participants announcing
+// websocket.CapabilityMix receive a single mixed audio track instead of every
+// audio track.
+type SFU struct {
+	session *Session
+	mixer   *mixer
+}
+
+// NewSFU creates the forwarding unit of the given room. Run must be called to
+// start processing signaling messages.
+func (e *Engine) NewSFU(room *service.Room, signal Signal) *SFU {
+	f := &SFU{}
+	options := SessionOptions{
+		SFU:     true,
+		OnTrack: f.forward,
+	}
+
+	if e.CanMix() {
+		m, err := newMixer(e.logger)
+
+		if err != nil {
+			e.logger.Error("rtc: could not start the audio mixer: %s", err)
+		} else {
+			f.mixer = m
+			options.OnJoin = f.join
+			options.OnLeave = f.leave
+			options.Excludes = f.excludes
+		}
+	}
+
+	f.session = e.NewSession(room, signal, options)
+
+	return f
+}
+
+// Run processes signaling messages until the signal is closed.
+func (f *SFU) Run() {
+	f.session.Run()
+
+	if f.mixer != nil {
+		f.mixer.close()
+	}
+}
+
+// Done is closed when the forwarding unit has stopped.
+func (f *SFU) Done() <-chan struct{} {
+	return f.session.Done()
+}
+
+// Close every connection and leave the room.
+func (f *SFU) Close() error {
+	return f.session.Close()
+}
+
+// forward sends the given track to every other participant until it ends.
+func (f *SFU) forward(from string, remote *webrtc.TrackRemote) {
+	local, err := webrtc.NewTrackLocalStaticRTP(remote.Codec().RTPCodecCapability, remote.ID(), from)
+
+	if err != nil {
+		f.session.engine.logger.Error("rtc: could not forward track: %s", err)
+		return
+	}
+
+	f.session.AddTrack(local, from)
+	defer f.session.RemoveTrack(local)
+
+	if f.mixer == nil || remote.Kind() != webrtc.RTPCodecTypeAudio {
+		forward(remote, local)
+		return
+	}
+
+	source := mixKey{from, remote.ID()}
+
+	if err = f.mixer.addSource(source); err != nil {
+		f.session.engine.logger.Error("rtc: could not mix track: %s", err)
+		forward(remote, local)
+		return
+	}
+
+	defer f.mixer.removeSource(source)
+
+	f.mix(source, remote, local)
+}
+
+// mix forwards an audio track and gives its packets to the mixer.
+func (f *SFU) mix(source mixKey, remote *webrtc.TrackRemote, local *webrtc.TrackLocalStaticRTP) {
+	buf := make([]byte, 1500)
+	packet := &rtp.Packet{}
+
+	for {
+		n, _, err := remote.Read(buf)
+
+		if err != nil {
+			return
+		}
+
+		local.Write(buf[:n])
+
+		if err = packet.Unmarshal(buf[:n]); err == nil {
+			f.mixer.push(source, packet.Payload)
+		}
+	}
+}
+
+// join gives a mixed audio track to participants asking for it.
+func (f *SFU) join(id string, capabilities []string) {
+	if !contains(capabilities, websocket.CapabilityMix) || f.mixer.listens(id) {
+		return
+	}
+
+	track, err := f.mixer.addListener(id)
+
+	if err != nil {
+		f.session.engine.logger.Error("rtc: could not mix audio for %s: %s", id, err)
+		return
+	}
+
+	f.session.AddTrackTo(track, id)
+}
+
+func (f *SFU) leave(id string) {
+	if track := f.mixer.removeListener(id); track != nil {
+		f.session.RemoveTrack(track)
+	}
+}
+
+// excludes forwarded audio tracks for participants receiving the mix.
+func (f *SFU) excludes(id string, track webrtc.TrackLocal) bool {
+	return track.Kind() == webrtc.RTPCodecTypeAudio && track.StreamID() != websocket.CapabilityMix && f.mixer.listens(id)
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
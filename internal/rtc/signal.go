@@ -0,0 +1,96 @@
+package rtc
+
+import (
+	"encoding/json"
+
+	"github.com/pion/webrtc/v3"
+)
+
+type (
+	// Signal is the channel used by server side peers to talk to the realtime
+	// server. Messages are the same JSON documents browsers exchange.
+	Signal interface {
+		// Read the next message sent to this participant.
+		Read() ([]byte, error)
+		// Write a message for the room.
+		Write([]byte) error
+		// Close the channel and leave the room.
+		Close() error
+	}
+
+	helloPayload struct {
+		ID  string `json:"id"`
+		SFU string `json:"sfu,omitempty"`
+	}
+
+	memberPayload struct {
+		ID           string   `json:"id"`
+		Capabilities []string `json:"capabilities,omitempty"`
+		Consent      bool     `json:"consent,omitempty"`
+	}
+
+	consentPayload struct {
+		ID        string `json:"id"`
+		Recording bool   `json:"recording"`
+	}
+
+	rosterPayload struct {
+		Members []memberPayload `json:"members"`
+	}
+
+	switchPayload struct {
+		Topology string `json:"topology"`
+		SFU      string `json:"sfu,omitempty"`
+	}
+
+	presencePayload struct {
+		Name   string `json:"name"`
+		Avatar string `json:"avatar,omitempty"`
+		Status string `json:"status,omitempty"`
+	}
+
+	// message is the subset of the signaling protocol understood by server side
+	// peers.
+	message struct {
+		From string `json:"from,omitempty"`
+		To   string `json:"to,omitempty"`
+
+		Hello    *helloPayload    `json:"hello,omitempty"`
+		Joined   *memberPayload   `json:"joined,omitempty"`
+		Left     *memberPayload   `json:"left,omitempty"`
+		Roster   *rosterPayload   `json:"roster,omitempty"`
+		Switch   *switchPayload   `json:"switch,omitempty"`
+		Consent  *consentPayload  `json:"consent,omitempty"`
+		Presence *presencePayload `json:"presence,omitempty"`
+
+		Offer  *webrtc.SessionDescription `json:"offer,omitempty"`
+		Answer *webrtc.SessionDescription `json:"answer,omitempty"`
+		ICE    *webrtc.ICECandidateInit   `json:"ice,omitempty"`
+	}
+)
+
+func readMessage(signal Signal) (*message, error) {
+	data, err := signal.Read()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var m message
+
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+func writeMessage(signal Signal, m *message) error {
+	data, err := json.Marshal(m)
+
+	if err != nil {
+		return err
+	}
+
+	return signal.Write(data)
+}
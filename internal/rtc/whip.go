@@ -0,0 +1,238 @@
+package rtc
+
+import (
+	"errors"
+
+	"github.com/yuukanoo/rtchat/internal/crypto"
+	"github.com/yuukanoo/rtchat/internal/service"
+
+	"github.com/pion/webrtc/v3"
+)
+
+var errNoMedia = errors.New("rtc: the offer does not contain any media")
+
+type (
+	// Endpoint is a WHIP publisher or a WHEP viewer. It holds an HTTP negotiated
+	// peer connection and a session in the room.
+	Endpoint struct {
+		ID     string
+		Answer string
+		// Room in which the endpoint has been negotiated.
+		Room string
+
+		pc      *webrtc.PeerConnection
+		session *Session
+	}
+)
+
+// Publish ingests the stream offered by a WHIP client. The stream appears to
+// room participants as another peer. The signal is owned by the endpoint on
+// success only.
+func (e *Engine) Publish(room *service.Room, signal Signal, offer string) (*Endpoint, error) {
+	ep := &Endpoint{ID: crypto.GenerateUID(16), Room: room.ID}
+	pc, err := e.newPeerConnection(room)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ep.pc = pc
+
+	if err = pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer,
+	}); err != nil {
+		ep.Close()
+		return nil, err
+	}
+
+	// One local track is forwarded to participants for each kind of media
+	// published by the client.
+	locals := make(map[webrtc.RTPCodecType]*webrtc.TrackLocalStaticRTP)
+	tracks := make([]webrtc.TrackLocal, 0, 2)
+
+	for _, t := range pc.GetTransceivers() {
+		kind := t.Kind()
+
+		if locals[kind] != nil {
+			continue
+		}
+
+		local, err := webrtc.NewTrackLocalStaticRTP(codecFor(kind), kind.String(), "whip-"+ep.ID)
+
+		if err != nil {
+			ep.Close()
+			return nil, err
+		}
+
+		locals[kind] = local
+		tracks = append(tracks, local)
+	}
+
+	if len(tracks) == 0 {
+		ep.Close()
+		return nil, errNoMedia
+	}
+
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			go requestKeyframes(pc, track)
+		}
+
+		if local := locals[track.Kind()]; local != nil {
+			forward(track, local)
+		}
+	})
+
+	if err = ep.negotiate(); err != nil {
+		ep.Close()
+		return nil, err
+	}
+
+	ep.session = e.NewSession(room, signal, SessionOptions{
+		Name:   "Live stream",
+		Tracks: tracks,
+	})
+
+	go ep.run()
+	ep.watch()
+
+	return ep, nil
+}
+
+// View sends the tracks of the given participant to a WHEP client. The signal
+// is owned by the endpoint on success only.
+func (e *Engine) View(room *service.Room, signal Signal, participant string, offer string) (*Endpoint, error) {
+	ep := &Endpoint{ID: crypto.GenerateUID(16), Room: room.ID}
+	pc, err := e.newPeerConnection(room)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ep.pc = pc
+
+	if err = pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer,
+	}); err != nil {
+		ep.Close()
+		return nil, err
+	}
+
+	locals := make(map[webrtc.RTPCodecType]*webrtc.TrackLocalStaticRTP)
+
+	for _, t := range pc.GetTransceivers() {
+		kind := t.Kind()
+
+		if locals[kind] != nil {
+			continue
+		}
+
+		local, err := webrtc.NewTrackLocalStaticRTP(codecFor(kind), kind.String(), participant)
+
+		if err == nil {
+			var sender *webrtc.RTPSender
+
+			if sender, err = pc.AddTrack(local); err == nil {
+				go drainRTCP(sender)
+			}
+		}
+
+		if err != nil {
+			ep.Close()
+			return nil, err
+		}
+
+		locals[kind] = local
+	}
+
+	if len(locals) == 0 {
+		ep.Close()
+		return nil, errNoMedia
+	}
+
+	if err = ep.negotiate(); err != nil {
+		ep.Close()
+		return nil, err
+	}
+
+	ep.session = e.NewSession(room, signal, SessionOptions{
+		Name: "Viewer",
+		Accept: func(id string) bool {
+			return id == participant
+		},
+		OnTrack: func(from string, track *webrtc.TrackRemote) {
+			// Tracks relayed by a forwarding unit are identified by their stream
+			if from != participant && track.StreamID() != participant {
+				return
+			}
+
+			if local := locals[track.Kind()]; local != nil {
+				forward(track, local)
+			}
+		},
+		OnLeave: func(id string) {
+			// Nothing left to watch
+			if id == participant {
+				ep.Close()
+			}
+		},
+	})
+
+	go ep.run()
+	ep.watch()
+
+	return ep, nil
+}
+
+// negotiate creates the answer without trickle ICE since WHIP and WHEP clients
+// expect every candidate in the answer.
+func (ep *Endpoint) negotiate() error {
+	answer, err := ep.pc.CreateAnswer(nil)
+
+	if err != nil {
+		return err
+	}
+
+	gathered := webrtc.GatheringCompletePromise(ep.pc)
+
+	if err = ep.pc.SetLocalDescription(answer); err != nil {
+		return err
+	}
+
+	<-gathered
+
+	ep.Answer = ep.pc.LocalDescription().SDP
+
+	return nil
+}
+
+// run the session in the room and close the endpoint when it ends.
+func (ep *Endpoint) run() {
+	ep.session.Run()
+	ep.Close()
+}
+
+// watch closes the endpoint when the HTTP negotiated connection fails.
+func (ep *Endpoint) watch() {
+	ep.pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			ep.Close()
+		}
+	})
+}
+
+// Done is closed when the endpoint has been closed.
+func (ep *Endpoint) Done() <-chan struct{} {
+	return ep.session.Done()
+}
+
+// Close the endpoint, its peer connection and its session in the room.
+func (ep *Endpoint) Close() error {
+	if ep.session != nil {
+		ep.session.Close()
+	}
+
+	return ep.pc.Close()
+}
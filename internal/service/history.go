@@ -0,0 +1,61 @@
+package service
+
+import "time"
+
+const (
+	// historySize is the maximum number of chat messages kept for a room.
+	historySize = 100
+	// historyAge is the maximum age of chat messages kept for a room.
+	historyAge = time.Hour
+)
+
+// Message posted in the chat of a room.
+type Message struct {
+	ID   string
+	From string
+	Text string
+	Time time.Time
+}
+
+func (s *service) PostMessage(id string, m Message) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	room := s.rooms[id]
+
+	if room == nil {
+		return
+	}
+
+	if len(room.history) >= historySize {
+		room.history = room.history[1:]
+	}
+
+	room.history = append(room.history, m)
+}
+
+func (s *service) History(id string) []Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	room := s.rooms[id]
+
+	if room == nil {
+		return nil
+	}
+
+	// Drop messages which are too old, they are ordered by time
+	limit := time.Now().Add(-historyAge)
+	i := 0
+
+	for i < len(room.history) && room.history[i].Time.Before(limit) {
+		i++
+	}
+
+	room.history = room.history[i:]
+
+	history := make([]Message, len(room.history))
+	copy(history, room.history)
+
+	return history
+}
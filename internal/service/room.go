@@ -2,6 +2,11 @@
 package service
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
 	"sync"
 
 	"github.com/yuukanoo/rtchat/internal/crypto"
@@ -12,19 +17,59 @@ type (
 	// this application is lightweight, it should suffice for now.
 	Service interface {
 		// CreateRoom creates a room and returns its unique identity.
-		CreateRoom() string
+		CreateRoom(RoomOptions) string
 		// DeleteRoom deletes a room given its unique identity.
 		DeleteRoom(string)
 		// GetRoom retrieves a Room object from its identity.
 		GetRoom(string) *Room
+		// PostMessage appends a chat message to the history of a room.
+		PostMessage(string, Message)
+		// History retrieves recent chat messages of a room, oldest first.
+		History(string) []Message
 	}
 
 	// Room object which contains TURN credential for this particular room.
 	Room struct {
 		ID         string
 		Credential string
+		// ModeratorKey is given to the room creator and grants access to the
+		// moderation features.
+		ModeratorKey string
+		// RelaySecret signs the credentials of the built-in TURN server, it is
+		// never given to participants.
+		RelaySecret string
+		// Privacy policy applied to ICE candidates exchanged in this room.
+		Privacy Privacy
+		// Topology used by participants to exchange media.
+		Topology Topology
+		// RequireConsent makes recordings only include participants who have
+		// agreed to be recorded.
+		RequireConsent bool
+		// Kind of the room which determines who could publish media.
+		Kind Kind
+
+		history []Message
+	}
+
+	// RoomOptions represents settings chosen when creating a room.
+	RoomOptions struct {
+		Privacy        Privacy
+		Topology       Topology
+		RequireConsent bool
+		Kind           Kind
 	}
 
+	// Privacy policy of a room which determines which ICE candidates peers are
+	// allowed to exchange.
+	Privacy string
+
+	// Topology determines how media flows between the participants of a room.
+	Topology string
+
+	// Kind of a room, either a conference where everyone publishes media or a
+	// broadcast where only presenters do.
+	Kind string
+
 	// service implements the Service interface with an in memory map, it should
 	// suffice for now.
 	service struct {
@@ -40,12 +85,90 @@ func New() Service {
 	}
 }
 
-func (s *service) CreateRoom() string {
+const (
+	// PrivacyOpen allows every kind of ICE candidates.
+	PrivacyOpen Privacy = "open"
+	// PrivacyRelay only allows relay candidates so peers never learn each
+	// others addresses and every stream goes through the TURN server.
+	PrivacyRelay Privacy = "relay"
+)
+
+// ParsePrivacy converts the given string to a privacy policy, defaulting to
+// PrivacyOpen for unknown values.
+func ParsePrivacy(value string) Privacy {
+	if Privacy(value) == PrivacyRelay {
+		return PrivacyRelay
+	}
+
+	return PrivacyOpen
+}
+
+const (
+	// TopologyMesh makes every participant connect to every other one.
+	TopologyMesh Topology = "mesh"
+	// TopologySFU makes every participant connect to the server only, which
+	// forwards the streams to the others. It scales better for larger rooms.
+	TopologySFU Topology = "sfu"
+	// TopologyAuto starts as a mesh and switches to the forwarding unit when
+	// the room becomes too large.
+	TopologyAuto Topology = "auto"
+)
+
+// ParseTopology converts the given string to a topology, defaulting to
+// TopologyMesh for unknown values.
+func ParseTopology(value string) Topology {
+	switch t := Topology(value); t {
+	case TopologySFU, TopologyAuto:
+		return t
+	default:
+		return TopologyMesh
+	}
+}
+
+const (
+	// KindConference makes every participant publish media.
+	KindConference Kind = "conference"
+	// KindBroadcast makes moderators the presenters of the room, every other
+	// participant only receives their media.
+	KindBroadcast Kind = "broadcast"
+)
+
+// ParseKind converts the given string to a room kind, defaulting to
+// KindConference for unknown values.
+func ParseKind(value string) Kind {
+	if Kind(value) == KindBroadcast {
+		return KindBroadcast
+	}
+
+	return KindConference
+}
+
+func (s *service) CreateRoom(options RoomOptions) string {
 	id := crypto.GenerateUID(32)
 
 	r := &Room{
 		ID:         id,
 		Credential: crypto.GenerateUID(32), // And use a random string has the credential
+
+		ModeratorKey: crypto.GenerateUID(32),
+		RelaySecret:  crypto.GenerateUID(32),
+		Privacy:      options.Privacy,
+		Topology:     options.Topology,
+
+		RequireConsent: options.RequireConsent,
+		Kind:           options.Kind,
+	}
+
+	if r.Privacy == "" {
+		r.Privacy = PrivacyOpen
+	}
+
+	if r.Topology == "" {
+		r.Topology = TopologyMesh
+	}
+
+	if r.Kind == "" {
+		r.Kind = KindConference
 	}
 
 	s.mutex.Lock()
@@ -68,3 +191,54 @@ func (s *service) GetRoom(id string) *Room {
 	room := s.rooms[id]
 	return room
 }
+
+// IsRelayOnly checks if peers of this room should only exchange relay
+// candidates.
+func (r *Room) IsRelayOnly() bool {
+	return r.Privacy == PrivacyRelay
+}
+
+// IsForwarded checks if media in this room should always go through the
+// server.
+func (r *Room) IsForwarded() bool {
+	return r.Topology == TopologySFU
+}
+
+// IsSwitchable checks if this room could switch between topologies depending
+// on its size.
+func (r *Room) IsSwitchable() bool {
+	return r.Topology == TopologyAuto
+}
+
+// IsBroadcast checks if only presenters publish media in this room.
+func (r *Room) IsBroadcast() bool {
+	return r.Kind == KindBroadcast
+}
+
+// IsModerator checks if the given key grants moderation rights on this room.
+func (r *Room) IsModerator(key string) bool {
+	return key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(r.ModeratorKey)) == 1
+}
+
+// RelayUsername mints a username of the built-in TURN server for a participant
+// of this room. Each participant gets its own so the server could tell their
+// allocations apart.
+func (r *Room) RelayUsername() string {
+	return r.ID + ":" + crypto.GenerateUID(12)
+}
+
+// RelayPassword derives the password of the given username of the built-in
+// TURN server.
+func (r *Room) RelayPassword(username string) string {
+	mac := hmac.New(sha1.New, []byte(r.RelaySecret))
+	mac.Write([]byte(username))
+
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// RelayRoom extracts the identity of the room from a username minted by
+// RelayUsername.
+func RelayRoom(username string) string {
+	id, _, _ := strings.Cut(username, ":")
+	return id
+}
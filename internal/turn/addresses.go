@@ -0,0 +1,292 @@
+package turn
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-i2p/i2pkeys"
+	"github.com/pion/turn/v2"
+)
+
+const (
+	// mappedPort is the port of the mapped address of datagrams, each
+	// destination gets its own IP.
+	mappedPort = 9
+	// streamPorts is the first port given to streams, each stream of a
+	// destination gets its own port so they are told apart like TCP
+	// connections.
+	streamPorts = 1024
+)
+
+var (
+	// mappedPrefix is the unique local prefix of the addresses mapped to I2P
+	// destinations.
+	mappedPrefix = []byte{0xfd, 0x72, 0x74, 0x63, 0x68, 0x61, 0x74, 0x00}
+
+	errUnmapped = errors.New("turn: address not mapped to an I2P destination")
+)
+
+type (
+	// addressBook maps I2P destinations to IPv6 addresses since pion/turn only
+	// handles UDP and TCP addresses. Destinations are identified by their
+	// base32 address. Those of clients are forgotten when they have not been
+	// seen for a while, those of relays are pinned as long as they are
+	// allocated so their address does not change.
+	addressBook struct {
+		mutex         sync.Mutex
+		next          uint64
+		byDestination map[string]*mapping
+		byIP          map[string]*mapping
+		prunedAt      time.Time
+	}
+
+	// mapping of a destination to its address.
+	mapping struct {
+		destination i2pkeys.I2PAddr
+		addr        *net.UDPAddr
+		pins        int
+		seenAt      time.Time
+	}
+
+	// mappedConn translates the destinations of an I2P session to mapped
+	// addresses and back.
+	mappedConn struct {
+		net.PacketConn
+		book *addressBook
+		// Local destination of a relay, unpinned on close.
+		relay     i2pkeys.I2PAddr
+		closeOnce sync.Once
+	}
+
+	// mappedListener gives the mapped address of the destination of each
+	// accepted stream.
+	mappedListener struct {
+		net.Listener
+		book    *addressBook
+		streams atomic.Uint32
+	}
+
+	// mappedStream is a stream whose remote destination is pinned as long as it
+	// is open.
+	mappedStream struct {
+		net.Conn
+		book        *addressBook
+		destination i2pkeys.I2PAddr
+		remote      *net.UDPAddr
+		closeOnce   sync.Once
+	}
+
+	// mappedGenerator wraps a generator of I2P relays so the turn server is
+	// given mapped addresses.
+	mappedGenerator struct {
+		turn.RelayAddressGenerator
+		book *addressBook
+	}
+)
+
+func newAddressBook() *addressBook {
+	return &addressBook{
+		byDestination: make(map[string]*mapping),
+		byIP:          make(map[string]*mapping),
+		prunedAt:      time.Now(),
+	}
+}
+
+// lookup retrieves the address of the given destination, mapping it if needed.
+func (b *addressBook) lookup(destination i2pkeys.I2PAddr) *net.UDPAddr {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.mapping(destination).addr
+}
+
+// pin retrieves the address of the given destination, which is kept until it
+// is unpinned.
+func (b *addressBook) pin(destination i2pkeys.I2PAddr) *net.UDPAddr {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	m := b.mapping(destination)
+	m.pins++
+
+	return m.addr
+}
+
+// unpin lets the given destination be forgotten once it is not seen anymore.
+func (b *addressBook) unpin(destination i2pkeys.I2PAddr) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if m := b.byDestination[destination.Base32()]; m != nil {
+		m.pins--
+		m.seenAt = time.Now()
+	}
+}
+
+// destination retrieves the destination mapped to the given address, whatever
+// its port.
+func (b *addressBook) destination(addr net.Addr) (i2pkeys.I2PAddr, bool) {
+	udp, ok := addr.(*net.UDPAddr)
+
+	if !ok {
+		return "", false
+	}
+
+	return b.resolve(udp.IP)
+}
+
+// resolve retrieves the destination mapped to the given IP.
+func (b *addressBook) resolve(ip net.IP) (i2pkeys.I2PAddr, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	m := b.byIP[ip.String()]
+
+	if m == nil {
+		return "", false
+	}
+
+	m.seenAt = time.Now()
+
+	return m.destination, true
+}
+
+// mapping retrieves the mapping of the given destination or creates it, the
+// mutex must be held.
+func (b *addressBook) mapping(destination i2pkeys.I2PAddr) *mapping {
+	now := time.Now()
+
+	if now.Sub(b.prunedAt) > clientExpiry {
+		for key, m := range b.byDestination {
+			if m.pins <= 0 && now.Sub(m.seenAt) > clientExpiry {
+				delete(b.byDestination, key)
+				delete(b.byIP, m.addr.IP.String())
+			}
+		}
+
+		b.prunedAt = now
+	}
+
+	key := destination.Base32()
+
+	if m := b.byDestination[key]; m != nil {
+		m.seenAt = now
+		return m
+	}
+
+	b.next++
+
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, mappedPrefix)
+	binary.BigEndian.PutUint64(ip[8:], b.next)
+
+	m := &mapping{
+		destination: destination,
+		addr:        &net.UDPAddr{IP: ip, Port: mappedPort},
+		seenAt:      now,
+	}
+
+	b.byDestination[key] = m
+	b.byIP[ip.String()] = m
+
+	return m
+}
+
+// ReadFrom gives the mapped address of the sender.
+func (c *mappedConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+
+		if err != nil {
+			return n, addr, err
+		}
+
+		if destination, ok := addr.(i2pkeys.I2PAddr); ok {
+			return n, c.book.lookup(destination), nil
+		}
+	}
+}
+
+// WriteTo sends to the destination mapped to the given address.
+func (c *mappedConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	destination, ok := c.book.destination(addr)
+
+	if !ok {
+		return 0, errUnmapped
+	}
+
+	return c.PacketConn.WriteTo(p, destination)
+}
+
+// Close unpins the destination of the relay.
+func (c *mappedConn) Close() error {
+	c.closeOnce.Do(func() {
+		if c.relay != "" {
+			c.book.unpin(c.relay)
+		}
+	})
+
+	return c.PacketConn.Close()
+}
+
+// Accept pins the destination of the accepted stream and gives it a port of
+// its own.
+func (l *mappedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if destination, ok := conn.RemoteAddr().(i2pkeys.I2PAddr); ok {
+			pinned := l.book.pin(destination)
+			port := streamPorts + int(l.streams.Add(1)%(0xffff-streamPorts))
+
+			return &mappedStream{
+				Conn:        conn,
+				book:        l.book,
+				destination: destination,
+				remote:      &net.UDPAddr{IP: pinned.IP, Port: port},
+			}, nil
+		}
+
+		conn.Close()
+	}
+}
+
+func (c *mappedStream) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Close unpins the destination of the stream.
+func (c *mappedStream) Close() error {
+	c.closeOnce.Do(func() {
+		c.book.unpin(c.destination)
+	})
+
+	return c.Conn.Close()
+}
+
+// AllocatePacketConn pins the destination of the relay and gives its mapped
+// address.
+func (g *mappedGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	conn, addr, err := g.RelayAddressGenerator.AllocatePacketConn(network, requestedPort)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	relay, ok := addr.(i2pkeys.I2PAddr)
+
+	if !ok {
+		conn.Close()
+		return nil, nil, errUnmapped
+	}
+
+	return &mappedConn{PacketConn: conn, book: g.book, relay: relay}, g.book.pin(relay), nil
+}
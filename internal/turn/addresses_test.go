@@ -0,0 +1,125 @@
+package turn
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAddressBookMapsDestinations(t *testing.T) {
+	b := newAddressBook()
+	client, relay := destination(1), destination(2)
+
+	addr := b.lookup(client)
+
+	if !addr.IP.Equal(b.lookup(client).IP) {
+		t.Error("a destination should keep its address")
+	}
+
+	pinned := b.pin(relay)
+
+	if addr.IP.Equal(pinned.IP) {
+		t.Error("destinations should get their own address")
+	}
+
+	if d, ok := b.destination(addr); !ok || d != client {
+		t.Errorf("expected %s to be mapped to the client, got %v", addr, ok)
+	}
+
+	if d, ok := b.destination(&net.UDPAddr{IP: addr.IP, Port: 3478}); !ok || d != client {
+		t.Error("streams of the client should be resolved whatever their port")
+	}
+
+	if _, ok := b.resolve(net.ParseIP("fd72:7463:6861:7400::ffff")); ok {
+		t.Error("unknown addresses should not be resolved")
+	}
+
+	// Clients are forgotten once they have not been seen for a while, relays
+	// are kept while allocated
+	for _, m := range b.byDestination {
+		m.seenAt = m.seenAt.Add(-2 * clientExpiry)
+	}
+
+	b.prunedAt = b.prunedAt.Add(-2 * clientExpiry)
+	b.lookup(destination(3))
+
+	if _, ok := b.resolve(addr.IP); ok {
+		t.Error("clients not seen for a while should be forgotten")
+	}
+
+	if d, ok := b.resolve(pinned.IP); !ok || d != relay {
+		t.Error("pinned relays should be kept")
+	}
+
+	b.unpin(relay)
+	b.byDestination[relay.Base32()].seenAt = time.Now().Add(-2 * clientExpiry)
+	b.prunedAt = b.prunedAt.Add(-2 * clientExpiry)
+	b.lookup(destination(3))
+
+	if _, ok := b.resolve(pinned.IP); ok {
+		t.Error("unpinned relays should be forgotten")
+	}
+}
+
+type (
+	// testListener accepts the given connections.
+	testListener struct {
+		net.Listener
+		conns chan net.Conn
+	}
+
+	// testStream is a stream from the given address.
+	testStream struct {
+		net.Conn
+		remote net.Addr
+		closed bool
+	}
+)
+
+func (l *testListener) Accept() (net.Conn, error) { return <-l.conns, nil }
+
+func (c *testStream) RemoteAddr() net.Addr { return c.remote }
+func (c *testStream) Close() error         { c.closed = true; return nil }
+
+func TestMappedListenerPinsStreams(t *testing.T) {
+	b := newAddressBook()
+	clearnet := &testStream{remote: udpAddr("192.0.2.1:1000")}
+	stream := &testStream{remote: destination(1)}
+	l := &mappedListener{Listener: &testListener{conns: make(chan net.Conn, 2)}, book: b}
+
+	l.Listener.(*testListener).conns <- clearnet
+	l.Listener.(*testListener).conns <- stream
+
+	conn, err := l.Accept()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !clearnet.closed {
+		t.Error("streams which do not come from I2P should be closed")
+	}
+
+	if d, ok := b.destination(conn.RemoteAddr()); !ok || d != destination(1) {
+		t.Fatalf("expected the stream to come from a mapped address, got %s", conn.RemoteAddr())
+	}
+
+	if b.byDestination[destination(1).Base32()].pins != 1 {
+		t.Error("the destination should be pinned while the stream is open")
+	}
+
+	l.Listener.(*testListener).conns <- &testStream{remote: destination(1)}
+	other, _ := l.Accept()
+
+	if other.RemoteAddr().String() == conn.RemoteAddr().String() {
+		t.Error("streams of a destination should get their own port")
+	}
+
+	other.Close()
+	conn.Close()
+	conn.Close()
+
+	if !stream.closed || b.byDestination[destination(1).Base32()].pins != 0 {
+		t.Error("the destination should be unpinned once when the stream is closed")
+	}
+}
@@ -0,0 +1,78 @@
+package turn
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/pion/stun"
+)
+
+// protoTCP is the protocol number of TCP in a REQUESTED-TRANSPORT attribute.
+const protoTCP = 6
+
+var (
+	bindingRequest  = stun.NewType(stun.MethodBinding, stun.ClassRequest)
+	bindingError    = stun.NewType(stun.MethodBinding, stun.ClassErrorResponse)
+	allocateRequest = stun.NewType(stun.MethodAllocate, stun.ClassRequest)
+	allocateError   = stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse)
+
+	errTCPAllocation = errors.New("turn: tcp allocations are only relayed over tls")
+)
+
+// isBinding checks if the given packet is a STUN binding request.
+func isBinding(b []byte) bool {
+	return stun.IsMessage(b) && binary.BigEndian.Uint16(b) == bindingRequest.Value()
+}
+
+// isTCPAllocation checks if the given packet is an allocate request for a TCP
+// relay. pion/turn v2 would serve it with a datagram relay since it does not
+// handle the Connect and ConnectionBind requests of RFC 6062, they are handled
+// by the tcpRelays of the TLS listener.
+func isTCPAllocation(b []byte) bool {
+	if !stun.IsMessage(b) || binary.BigEndian.Uint16(b) != allocateRequest.Value() {
+		return false
+	}
+
+	request := &stun.Message{Raw: append([]byte(nil), b...)}
+
+	if err := request.Decode(); err != nil {
+		return false
+	}
+
+	transport, err := request.Get(stun.AttrRequestedTransport)
+
+	return err == nil && len(transport) > 0 && transport[0] == protoTCP
+}
+
+// bind answers a binding request coming from an I2P destination. The address
+// mapped to it by the server means nothing to the client so the request is
+// refused right away, which lets the ICE agent of the client give up without
+// waiting for a timeout.
+func (c *sourceConn) bind(b []byte, addr net.Addr) {
+	c.refuse(b, addr, bindingError, stun.CodeBadRequest, "I2P destinations could not be mapped")
+}
+
+// refuse answers the given request with an error response.
+func (c *sourceConn) refuse(b []byte, addr net.Addr, t stun.MessageType, code stun.ErrorCode, reason string) {
+	request := &stun.Message{Raw: append([]byte(nil), b...)}
+
+	if err := request.Decode(); err != nil {
+		return
+	}
+
+	response, err := stun.Build(
+		stun.NewTransactionIDSetter(request.TransactionID),
+		t,
+		stun.ErrorCodeAttribute{Code: code, Reason: []byte(reason)},
+		stun.Fingerprint,
+	)
+
+	if err != nil {
+		return
+	}
+
+	if _, err := c.PacketConn.WriteTo(response.Raw, addr); err != nil {
+		c.logger.Debug("turn: could not answer request from %s: %v", addr.Network(), err)
+	}
+}
@@ -0,0 +1,43 @@
+package turn
+
+import (
+	"testing"
+
+	"github.com/pion/stun"
+)
+
+func TestIsTCPAllocation(t *testing.T) {
+	build := func(setters ...stun.Setter) []byte {
+		m, err := stun.Build(append([]stun.Setter{stun.TransactionID}, setters...)...)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return m.Raw
+	}
+
+	transport := func(protocol byte) stun.Setter {
+		return stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{protocol, 0, 0, 0}}
+	}
+
+	tests := []struct {
+		name   string
+		packet []byte
+		tcp    bool
+	}{
+		{"tcp allocation", build(allocateRequest, transport(protoTCP)), true},
+		{"udp allocation", build(allocateRequest, transport(17)), false},
+		{"missing transport", build(allocateRequest), false},
+		{"binding", build(bindingRequest, transport(protoTCP)), false},
+		{"not stun", []byte("hello"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isTCPAllocation(test.packet); got != test.tcp {
+				t.Errorf("expected %v, got %v", test.tcp, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package turn
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yuukanoo/rtchat/internal/logging"
+
+	"github.com/go-i2p/i2pkeys"
+	"github.com/pion/turn/v2"
+)
+
+// clientExpiry is the time after which a client which has not authenticated
+// any request is forgotten. Clients refresh their allocations and permissions
+// well before that.
+const clientExpiry = 15 * time.Minute
+
+var (
+	errUnauthenticated = errors.New("turn: allocation from an unauthenticated client")
+	errNotI2P          = errors.New("turn: relay is not an I2P destination")
+)
+
+type (
+	// isolation restricts permissions and relayed data to relays allocated by
+	// this server for the room of each allocation, so it could not be used to
+	// reach arbitrary hosts nor peers of other rooms. Addresses given by clients
+	// in their candidates are never trusted. Relays are identified by the base32
+	// address of their destination.
+	isolation struct {
+		logger logging.Logger
+		book   *addressBook
+
+		mutex    sync.Mutex
+		clients  map[string]*roomClient
+		relays   map[string]string
+		prunedAt time.Time
+	}
+
+	// roomClient represents a client source address authenticated for a room.
+	roomClient struct {
+		room   string
+		seenAt time.Time
+	}
+
+	// isolatedGenerator wraps a relay address generator so every relay is
+	// recorded for the room of the client allocating it and only exchanges data
+	// with other relays of this room. Its listener tells which client is
+	// allocating.
+	isolatedGenerator struct {
+		turn.RelayAddressGenerator
+		isolation *isolation
+		listener  clientSource
+	}
+
+	// isolatedConn drops packets going to or coming from addresses which are
+	// not relays of its room.
+	isolatedConn struct {
+		net.PacketConn
+		isolation *isolation
+		relay     i2pkeys.I2PAddr
+		room      string
+
+		mutex     sync.Mutex
+		warned    bool
+		closeOnce sync.Once
+	}
+)
+
+func newIsolation(logger logging.Logger, book *addressBook) *isolation {
+	return &isolation{
+		logger:   logger,
+		book:     book,
+		clients:  make(map[string]*roomClient),
+		relays:   make(map[string]string),
+		prunedAt: time.Now(),
+	}
+}
+
+// authenticated records the room for which the given client address has sent
+// a request. It is called before every permission check of this client.
+func (i *isolation) authenticated(clientAddr net.Addr, room string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(i.prunedAt) > clientExpiry {
+		for addr, c := range i.clients {
+			if now.Sub(c.seenAt) > clientExpiry {
+				delete(i.clients, addr)
+			}
+		}
+
+		i.prunedAt = now
+	}
+
+	i.clients[clientAddr.String()] = &roomClient{room: room, seenAt: now}
+}
+
+// roomOf retrieves the room for which the given client has authenticated, an
+// empty string if it has not.
+func (i *isolation) roomOf(clientAddr net.Addr) string {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if c := i.clients[clientAddr.String()]; c != nil {
+		return c.room
+	}
+
+	return ""
+}
+
+// allocated records a relay handed out to a client of the given room.
+func (i *isolation) allocated(relay i2pkeys.I2PAddr, room string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.relays[relay.Base32()] = room
+}
+
+// released forgets a relay once its allocation is over.
+func (i *isolation) released(relay i2pkeys.I2PAddr) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	delete(i.relays, relay.Base32())
+}
+
+// isRelayOf checks if the given address is a relay allocated for the room.
+func (i *isolation) isRelayOf(addr net.Addr, room string) bool {
+	destination, ok := addr.(i2pkeys.I2PAddr)
+
+	if !ok {
+		return false
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	r, ok := i.relays[destination.Base32()]
+
+	return ok && r == room
+}
+
+// permits checks if the given client may install a permission or bind a
+// channel to the given peer, which must be mapped to a relay of its room.
+func (i *isolation) permits(clientAddr net.Addr, peerIP net.IP) bool {
+	peer, mapped := i.book.resolve(peerIP)
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	c := i.clients[clientAddr.String()]
+
+	if c == nil {
+		i.logger.Error("turn: denied permission to an unauthenticated %s client", clientAddr.Network())
+		return false
+	}
+
+	if room, ok := i.relays[peer.Base32()]; !mapped || !ok || room != c.room {
+		i.logger.Error("turn: denied permission to a peer outside of room %s", c.room)
+		return false
+	}
+
+	return true
+}
+
+// AllocatePacketConn records the relay for the room of the client being
+// handled and isolates it.
+func (g *isolatedGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	room := g.isolation.roomOf(g.listener.client())
+
+	if room == "" {
+		return nil, nil, errUnauthenticated
+	}
+
+	conn, addr, err := g.RelayAddressGenerator.AllocatePacketConn(network, requestedPort)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	relay, ok := addr.(i2pkeys.I2PAddr)
+
+	if !ok {
+		conn.Close()
+		return nil, nil, errNotI2P
+	}
+
+	g.isolation.allocated(relay, room)
+
+	return &isolatedConn{
+		PacketConn: conn,
+		isolation:  g.isolation,
+		relay:      relay,
+		room:       room,
+	}, addr, nil
+}
+
+// ReadFrom skips packets sent by peers outside of the room.
+func (c *isolatedConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+
+		if err != nil || c.allows(addr) {
+			return n, addr, err
+		}
+	}
+}
+
+// WriteTo silently drops packets sent to peers outside of the room.
+func (c *isolatedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if !c.allows(addr) {
+		return len(b), nil
+	}
+
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// Close forgets the relay.
+func (c *isolatedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.isolation.released(c.relay)
+	})
+
+	return c.PacketConn.Close()
+}
+
+// allows checks if the given peer is a relay of the room. The first denial of
+// a relay is logged.
+func (c *isolatedConn) allows(addr net.Addr) bool {
+	if c.isolation.isRelayOf(addr, c.room) {
+		return true
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.warned {
+		c.warned = true
+		c.isolation.logger.Error("turn: denied relaying to a peer outside of the room of %s", c.relay.Base32())
+	}
+
+	return false
+}
@@ -0,0 +1,124 @@
+package turn
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/yuukanoo/rtchat/internal/logging"
+
+	"github.com/go-i2p/i2pkeys"
+	"github.com/pion/turn/v2"
+)
+
+type (
+	// testSource pretends every request comes from the same client.
+	testSource struct {
+		addr net.Addr
+	}
+
+	// testGenerator hands out the next relay address.
+	testGenerator struct {
+		turn.RelayAddressGenerator
+		relays []net.Addr
+	}
+
+	nopConn struct {
+		net.PacketConn
+	}
+)
+
+func (s *testSource) client() net.Addr { return s.addr }
+
+func (g *testGenerator) AllocatePacketConn(string, int) (net.PacketConn, net.Addr, error) {
+	addr := g.relays[0]
+	g.relays = g.relays[1:]
+
+	return nopConn{}, addr, nil
+}
+
+func (nopConn) Close() error { return nil }
+
+func udpAddr(s string) *net.UDPAddr {
+	addr, _ := net.ResolveUDPAddr("udp", s)
+	return addr
+}
+
+// destination builds a fake I2P destination out of the given byte.
+func destination(seed byte) i2pkeys.I2PAddr {
+	addr, _ := i2pkeys.NewI2PAddrFromBytes(bytes.Repeat([]byte{seed}, 387))
+	return addr
+}
+
+func TestIsolationOnlyTrustsAllocatedRelays(t *testing.T) {
+	book := newAddressBook()
+	i := newIsolation(logging.New(false), book)
+	source := &testSource{}
+	generator := &mappedGenerator{
+		RelayAddressGenerator: &isolatedGenerator{
+			RelayAddressGenerator: &testGenerator{relays: []net.Addr{destination(1), destination(2), destination(3)}},
+			isolation:             i,
+			listener:              source,
+		},
+		book: book,
+	}
+
+	alice, bob, mallory := book.lookup(destination(10)), book.lookup(destination(11)), book.lookup(destination(12))
+	stranger := book.lookup(destination(13))
+
+	allocate := func(client net.Addr, room string) (*isolatedConn, net.IP) {
+		i.authenticated(client, room)
+		source.addr = client
+		conn, addr, err := generator.AllocatePacketConn("udp4", 0)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return conn.(*mappedConn).PacketConn.(*isolatedConn), addr.(*net.UDPAddr).IP
+	}
+
+	source.addr = stranger
+
+	if _, _, err := generator.AllocatePacketConn("udp4", 0); err != errUnauthenticated {
+		t.Errorf("unauthenticated clients should not allocate, got %v", err)
+	}
+
+	aliceRelay, aliceIP := allocate(alice, "room")
+	bobRelay, bobIP := allocate(bob, "room")
+	_, malloryIP := allocate(mallory, "other")
+
+	permissions := []struct {
+		name    string
+		client  net.Addr
+		peer    net.IP
+		allowed bool
+	}{
+		{"relay of the room", bob, aliceIP, true},
+		{"relay of another room", bob, malloryIP, false},
+		{"client of the room", bob, alice.IP, false},
+		{"unmapped peer", bob, net.ParseIP("10.0.0.1"), false},
+		{"from another room", mallory, aliceIP, false},
+		{"unauthenticated client", stranger, aliceIP, false},
+	}
+
+	for _, p := range permissions {
+		if got := i.permits(p.client, p.peer); got != p.allowed {
+			t.Errorf("%s: expected %v, got %v", p.name, p.allowed, got)
+		}
+	}
+
+	if !aliceRelay.allows(destination(2)) {
+		t.Error("relays of the same room should exchange data")
+	}
+
+	if aliceRelay.allows(destination(3)) || aliceRelay.allows(destination(10)) || aliceRelay.allows(udpAddr("198.51.100.1:5000")) {
+		t.Error("relays should not exchange data outside of their room")
+	}
+
+	bobRelay.Close()
+
+	if aliceRelay.allows(destination(2)) || i.permits(alice, bobIP) {
+		t.Error("released relays should be forgotten")
+	}
+}
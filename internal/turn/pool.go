@@ -0,0 +1,246 @@
+package turn
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-i2p/i2pkeys"
+	"github.com/go-i2p/sam3"
+	"github.com/yuukanoo/rtchat/internal/logging"
+)
+
+type (
+	// sessionPool keeps datagram sessions ready to be handed out to allocations
+	// since building I2P tunnels takes a while. Sessions are returned to the
+	// pool when their allocation expires.
+	sessionPool struct {
+		samAddress string
+		logger     logging.Logger
+		idle       chan *sam3.DatagramSession
+		done       chan struct{}
+		closing    sync.Once
+	}
+
+	// pooledConn is the relay of an allocation. Closing it gives the session
+	// back to the pool once pending reads have returned.
+	pooledConn struct {
+		*sam3.DatagramSession
+		pool    *sessionPool
+		mutex   sync.Mutex
+		closed  bool
+		readers sync.WaitGroup
+	}
+)
+
+// newSessionPool creates a pool keeping the given number of idle sessions and
+// starts building them.
+func newSessionPool(samAddress string, size int, logger logging.Logger) *sessionPool {
+	p := &sessionPool{
+		samAddress: samAddress,
+		logger:     logger,
+		idle:       make(chan *sam3.DatagramSession, size),
+		done:       make(chan struct{}),
+	}
+
+	for i := 0; i < size; i++ {
+		go p.add()
+	}
+
+	return p
+}
+
+// get an idle session, a new one is built in the background to replace it. If
+// none is ready, the caller waits for a session to be built.
+func (p *sessionPool) get() (net.PacketConn, net.Addr, error) {
+	var (
+		session *sam3.DatagramSession
+		err     error
+	)
+
+	select {
+	case session = <-p.idle:
+		go p.add()
+	default:
+		p.logger.Info("turn: no idle relay session, consider increasing the pool size")
+
+		if session, err = newDatagramSession(p.samAddress); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return &pooledConn{DatagramSession: session, pool: p}, session.LocalI2PAddr(), nil
+}
+
+// add builds a session and makes it available.
+func (p *sessionPool) add() {
+	session, err := newDatagramSession(p.samAddress)
+
+	if err != nil {
+		p.logger.Error("turn: could not build a relay session: %s", err)
+		return
+	}
+
+	p.put(session)
+}
+
+// put makes the given session available again, it is closed if the pool is
+// already full or closed.
+func (p *sessionPool) put(session *sam3.DatagramSession) {
+	session.SetReadDeadline(time.Time{})
+
+	select {
+	case <-p.done:
+		session.Close()
+		return
+	default:
+	}
+
+	select {
+	case p.idle <- session:
+	default:
+		session.Close()
+	}
+}
+
+// refill replaces idle sessions, which die with the router.
+func (p *sessionPool) refill() {
+	for {
+		select {
+		case session := <-p.idle:
+			session.Close()
+		default:
+			for i := 0; i < cap(p.idle); i++ {
+				go p.add()
+			}
+
+			return
+		}
+	}
+}
+
+// close every idle session. Sessions still in use are closed when returned.
+func (p *sessionPool) close() {
+	p.closing.Do(func() {
+		close(p.done)
+
+		for {
+			select {
+			case session := <-p.idle:
+				session.Close()
+			default:
+				return
+			}
+		}
+	})
+}
+
+var (
+	errRelayClosed = errors.New("turn: relay closed")
+
+	datagramSessions uint64
+	streamSessions   uint64
+)
+
+// newDatagramSession builds a session with transient keys and a unique name.
+func newDatagramSession(samAddress string) (*sam3.DatagramSession, error) {
+	s, err := sam3.NewSAM(samAddress)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := s.NewKeys()
+
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	id := fmt.Sprintf("rtcchat-turn-udp-%d", atomic.AddUint64(&datagramSessions, 1))
+	session, err := s.NewDatagramSession(id, keys, sam3.Options_Medium, 0)
+
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// newStreamSession builds a session with transient keys and a unique name.
+func newStreamSession(samAddress string) (*sam3.StreamSession, error) {
+	s, err := sam3.NewSAM(samAddress)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := s.NewKeys()
+
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	id := fmt.Sprintf("rtcchat-turn-tcp-%d", atomic.AddUint64(&streamSessions, 1))
+	session, err := s.NewStreamSession(id, keys, sam3.Options_Medium)
+
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func (c *pooledConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mutex.Lock()
+
+	if c.closed {
+		c.mutex.Unlock()
+		return 0, i2pkeys.I2PAddr(""), errRelayClosed
+	}
+
+	c.readers.Add(1)
+	c.mutex.Unlock()
+
+	defer c.readers.Done()
+
+	return c.DatagramSession.ReadFrom(b)
+}
+
+func (c *pooledConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	closed := c.closed
+	c.mutex.Unlock()
+
+	if closed {
+		return 0, errRelayClosed
+	}
+
+	return c.DatagramSession.WriteTo(b, addr)
+}
+
+// Close interrupts pending reads and returns the session to the pool.
+func (c *pooledConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	c.closed = true
+	c.DatagramSession.SetReadDeadline(time.Now())
+
+	go func() {
+		c.readers.Wait()
+		c.pool.put(c.DatagramSession)
+	}()
+
+	return nil
+}
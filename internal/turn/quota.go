@@ -0,0 +1,461 @@
+package turn
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yuukanoo/rtchat/internal/logging"
+	"github.com/yuukanoo/rtchat/internal/metrics"
+	"github.com/yuukanoo/rtchat/internal/service"
+
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2"
+)
+
+// pendingExpiry is the time given to an authenticated client to allocate its
+// relay. It counts against the quota of its room in the meantime.
+const pendingExpiry = 30 * time.Second
+
+type (
+	// Usage of the relay by a room.
+	Usage struct {
+		Allocations int    `json:"allocations"`
+		Bytes       uint64 `json:"bytes"`
+		Packets     uint64 `json:"packets"`
+		Dropped     uint64 `json:"dropped"`
+	}
+
+	// quotas limits allocations and the bandwidth used by relays and keeps track
+	// of the usage of each room.
+	quotas struct {
+		events
+		service service.Service
+		options Options
+		logger  logging.Logger
+		// Shared by every relay, nil for no limit.
+		bandwidth *bucket
+
+		mutex       sync.Mutex
+		prunedAt    time.Time
+		pending     map[string]*allocation
+		allocations map[string]*allocation
+		rooms       map[string]*Usage
+		credentials map[string]int
+	}
+
+	// allocation represents a relay handed out to a client on behalf of a room.
+	allocation struct {
+		client     string
+		room       string
+		credential string
+		createdAt  time.Time
+		expired    bool
+		bytes      uint64
+		packets    uint64
+	}
+
+	// quotaGenerator wraps a relay address generator so every UDP allocation
+	// respects the quotas. Its listener tells which client is allocating.
+	quotaGenerator struct {
+		turn.RelayAddressGenerator
+		quotas   *quotas
+		listener clientSource
+	}
+
+	// clientSource tells which client has sent the request being handled by a
+	// listener of the turn server.
+	clientSource interface {
+		client() net.Addr
+	}
+
+	// quotaConn drops packets exceeding the bitrate of its allocation or the
+	// bandwidth of the server and stops relaying once the allocation is too old.
+	quotaConn struct {
+		net.PacketConn
+		quotas     *quotas
+		allocation *allocation
+		bitrate    *bucket
+		expiry     *time.Timer
+		closeOnce  sync.Once
+	}
+
+	// sourceConn remembers the source of the last packet read by the listener.
+	// The turn server handles requests of a packet listener one at a time so it
+	// is the client of the request being handled.
+	sourceConn struct {
+		net.PacketConn
+		book      *addressBook
+		last      net.Addr
+		refreshed func(net.Addr)
+		logger    logging.Logger
+	}
+
+	// bucket is a token bucket limiting a rate in bytes per second.
+	bucket struct {
+		mutex  sync.Mutex
+		rate   float64
+		tokens float64
+		last   time.Time
+	}
+)
+
+func newQuotas(service service.Service, logger logging.Logger, options Options) *quotas {
+	return &quotas{
+		service:     service,
+		options:     options,
+		logger:      logger,
+		bandwidth:   newBucket(options.RelayBandwidth()),
+		prunedAt:    time.Now(),
+		pending:     make(map[string]*allocation),
+		allocations: make(map[string]*allocation),
+		rooms:       make(map[string]*Usage),
+		credentials: make(map[string]int),
+	}
+}
+
+// admits checks if a request authenticated with the given credential of a room
+// may be handled. Clients without an allocation are about to allocate one and
+// must respect the allocation quotas, those with an expired one could not
+// refresh it.
+func (q *quotas) admits(clientAddr net.Addr, room, credential string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	client := clientAddr.String()
+	now := time.Now()
+
+	// Clients authenticated without allocating anything are forgotten after a
+	// while
+	if now.Sub(q.prunedAt) > pendingExpiry {
+		for c, a := range q.pending {
+			if now.Sub(a.createdAt) > pendingExpiry {
+				delete(q.pending, c)
+			}
+		}
+
+		q.prunedAt = now
+	}
+
+	if a := q.allocations[client]; a != nil {
+		if a.expired {
+			q.logger.Info("turn: refusing to refresh an expired allocation of room %s", a.room)
+			return false
+		}
+
+		return true
+	}
+
+	// Concurrent allocations of the room are counted so they could not
+	// overshoot the quota together
+	if max := q.options.RoomAllocations(); max > 0 && q.usage(room).Allocations+q.pendingIn(room, client) >= max {
+		q.logger.Error("turn: room %s reached its quota of %d allocations", room, max)
+		return false
+	}
+
+	if max := q.options.CredentialAllocations(); max > 0 && q.credentials[credential]+q.pendingWith(credential, client) >= max {
+		q.logger.Error("turn: a credential of room %s reached its quota of %d allocations", room, max)
+		return false
+	}
+
+	q.pending[client] = &allocation{
+		client:     client,
+		room:       room,
+		credential: credential,
+		createdAt:  now,
+	}
+
+	return true
+}
+
+// acquire counts a new allocation for the given client.
+func (q *quotas) acquire(clientAddr net.Addr) *allocation {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	client := clientAddr.String()
+	a := q.pending[client]
+
+	if a == nil {
+		a = &allocation{client: client}
+	}
+
+	delete(q.pending, client)
+
+	a.createdAt = time.Now()
+	q.allocations[client] = a
+	q.usage(a.room).Allocations++
+	q.credentials[a.credential]++
+	q.notify(EventCreated, a)
+
+	return a
+}
+
+// release forgets the given allocation. The usage of a room is kept as long as
+// the room exists.
+func (q *quotas) release(a *allocation) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.allocations[a.client] == a {
+		delete(q.allocations, a.client)
+	}
+
+	q.credentials[a.credential]--
+
+	if q.credentials[a.credential] <= 0 {
+		delete(q.credentials, a.credential)
+	}
+
+	usage := q.usage(a.room)
+	usage.Allocations--
+	q.notify(EventDeleted, a)
+
+	if usage.Allocations <= 0 && q.service.GetRoom(a.room) == nil {
+		delete(q.rooms, a.room)
+	}
+}
+
+// expire stops relaying for the given allocation and prevents it from being
+// refreshed.
+func (q *quotas) expire(a *allocation) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if !a.expired {
+		a.expired = true
+		q.logger.Info("turn: an allocation of room %s reached the maximum lifetime", a.room)
+	}
+}
+
+// account records n bytes relayed for the given allocation, or dropped if
+// they are not allowed or if it has expired. It returns true if they could be
+// relayed.
+func (q *quotas) account(a *allocation, n int, allowed bool) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	usage := q.usage(a.room)
+	allowed = allowed && !a.expired
+
+	if allowed {
+		usage.Bytes += uint64(n)
+		usage.Packets++
+		a.bytes += uint64(n)
+		a.packets++
+		metrics.Relay.Add("bytes", int64(n))
+		metrics.Relay.Add("packets", 1)
+	} else {
+		usage.Dropped += uint64(n)
+		metrics.Relay.Add("dropped", int64(n))
+	}
+
+	return allowed
+}
+
+// pendingIn counts the allocations of the given room being made by other
+// clients, the mutex must be held.
+func (q *quotas) pendingIn(room, client string) int {
+	count := 0
+
+	for c, a := range q.pending {
+		if c != client && a.room == room && time.Since(a.createdAt) <= pendingExpiry {
+			count++
+		}
+	}
+
+	return count
+}
+
+// pendingWith counts the allocations being made with the given credential by
+// other clients, the mutex must be held.
+func (q *quotas) pendingWith(credential, client string) int {
+	count := 0
+
+	for c, a := range q.pending {
+		if c != client && a.credential == credential && time.Since(a.createdAt) <= pendingExpiry {
+			count++
+		}
+	}
+
+	return count
+}
+
+// usage retrieves the usage of a room, the mutex must be held.
+func (q *quotas) usage(room string) *Usage {
+	usage := q.rooms[room]
+
+	if usage == nil {
+		usage = &Usage{}
+		q.rooms[room] = usage
+	}
+
+	return usage
+}
+
+// Usage retrieves a snapshot of the relay usage of the given room.
+func (q *quotas) Usage(room string) Usage {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if usage := q.rooms[room]; usage != nil {
+		return *usage
+	}
+
+	return Usage{}
+}
+
+// AllocatePacketConn counts the allocation of the client being handled and
+// wraps its relay.
+func (g *quotaGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	conn, addr, err := g.RelayAddressGenerator.AllocatePacketConn(network, requestedPort)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := &quotaConn{
+		PacketConn: conn,
+		quotas:     g.quotas,
+		allocation: g.quotas.acquire(g.listener.client()),
+		bitrate:    newBucket(g.quotas.options.RelayBitrate()),
+	}
+
+	if lifetime := g.quotas.options.MaxLifetime(); lifetime > 0 {
+		c.expiry = time.AfterFunc(lifetime, func() {
+			g.quotas.expire(c.allocation)
+		})
+	}
+
+	return c, addr, nil
+}
+
+// ReadFrom skips packets exceeding the quotas.
+func (c *quotaConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+
+		if err != nil || c.allows(n) {
+			return n, addr, err
+		}
+	}
+}
+
+// WriteTo silently drops packets exceeding the quotas.
+func (c *quotaConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if !c.allows(len(b)) {
+		return len(b), nil
+	}
+
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// Close releases the allocation.
+func (c *quotaConn) Close() error {
+	c.closeOnce.Do(func() {
+		if c.expiry != nil {
+			c.expiry.Stop()
+		}
+
+		c.quotas.release(c.allocation)
+	})
+
+	return c.PacketConn.Close()
+}
+
+// allows checks if n bytes could be relayed and accounts for them.
+func (c *quotaConn) allows(n int) bool {
+	allowed := c.bitrate.take(n)
+
+	if allowed && !c.quotas.bandwidth.take(n) {
+		c.bitrate.give(n)
+		allowed = false
+	}
+
+	return c.quotas.account(c.allocation, n, allowed)
+}
+
+// ReadFrom remembers the source of the packet.
+func (c *sourceConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+
+		if err != nil {
+			return n, addr, err
+		}
+
+		// Binding requests coming from I2P are answered here since the turn
+		// server would give the mapped address of the destination
+		if _, ok := c.book.destination(addr); ok && isBinding(b[:n]) {
+			c.bind(b[:n], addr)
+			continue
+		}
+
+		if isTCPAllocation(b[:n]) {
+			c.refuse(b[:n], addr, allocateError, stun.CodeUnsupportedTransProto, errTCPAllocation.Error())
+			continue
+		}
+
+		c.last = addr
+
+		return n, addr, nil
+	}
+}
+
+func (c *sourceConn) client() net.Addr {
+	return c.last
+}
+
+// newBucket builds a bucket for the given rate in kbit/s allowing bursts of
+// one second, nil for no limit.
+func newBucket(kbps int) *bucket {
+	if kbps <= 0 {
+		return nil
+	}
+
+	rate := float64(kbps) * 1000 / 8
+
+	return &bucket{
+		rate:   rate,
+		tokens: rate,
+		last:   time.Now(),
+	}
+}
+
+// take consumes n bytes if available. A nil bucket never runs out.
+func (b *bucket) take(n int) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	b.last = now
+
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+
+	if b.tokens < float64(n) {
+		return false
+	}
+
+	b.tokens -= float64(n)
+
+	return true
+}
+
+// give back n bytes taken from the bucket.
+func (b *bucket) give(n int) {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.tokens += float64(n)
+}
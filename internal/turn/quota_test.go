@@ -0,0 +1,178 @@
+package turn
+
+import (
+	"expvar"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/yuukanoo/rtchat/internal/logging"
+	"github.com/yuukanoo/rtchat/internal/metrics"
+	"github.com/yuukanoo/rtchat/internal/service"
+)
+
+// testOptions only overrides the options used by the quotas.
+type testOptions struct {
+	Options
+	roomAllocations       int
+	credentialAllocations int
+}
+
+func (o testOptions) RoomAllocations() int       { return o.roomAllocations }
+func (o testOptions) CredentialAllocations() int { return o.credentialAllocations }
+func (testOptions) RelayBandwidth() int          { return 0 }
+func (testOptions) RelayBitrate() int            { return 0 }
+func (testOptions) MaxLifetime() time.Duration   { return 0 }
+
+func TestBucket(t *testing.T) {
+	tests := []struct {
+		name    string
+		kbps    int
+		elapsed time.Duration
+		taken   int
+		take    int
+		allowed bool
+	}{
+		{"no limit", 0, 0, 0, 1 << 30, true},
+		{"burst of one second", 8, 0, 0, 1000, true},
+		{"beyond the burst", 8, 0, 0, 1001, false},
+		{"empty", 8, 0, 1000, 1, false},
+		{"refilled", 8, 500 * time.Millisecond, 1000, 450, true},
+		{"partially refilled", 8, 500 * time.Millisecond, 1000, 600, false},
+		{"never beyond the burst", 8, 10 * time.Second, 0, 1001, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newBucket(test.kbps)
+
+			if b != nil {
+				b.tokens -= float64(test.taken)
+				b.last = b.last.Add(-test.elapsed)
+			}
+
+			if got := b.take(test.take); got != test.allowed {
+				t.Errorf("expected %v, got %v", test.allowed, got)
+			}
+		})
+	}
+}
+
+func TestBucketGive(t *testing.T) {
+	b := newBucket(8)
+
+	if !b.take(1000) || b.take(100) {
+		t.Fatal("the bucket should only allow its burst")
+	}
+
+	b.give(100)
+
+	if !b.take(100) {
+		t.Error("bytes given back should be taken again")
+	}
+}
+
+func TestQuotasCountPendingAllocations(t *testing.T) {
+	svc := service.New()
+	room := svc.CreateRoom(service.RoomOptions{})
+	q := newQuotas(svc, logging.New(false), testOptions{roomAllocations: 2})
+
+	alice, bob, carol := &net.UDPAddr{Port: 1}, &net.UDPAddr{Port: 2}, &net.UDPAddr{Port: 3}
+
+	if !q.admits(alice, room, "alice") || !q.admits(bob, room, "bob") {
+		t.Fatal("clients should be admitted within the quota")
+	}
+
+	if q.admits(carol, room, "carol") {
+		t.Error("allocations being made should count against the quota")
+	}
+
+	if !q.admits(alice, room, "alice") {
+		t.Error("a client retrying its allocation should not count twice")
+	}
+
+	a := q.acquire(alice)
+
+	if q.admits(carol, room, "carol") {
+		t.Error("allocations should count against the quota")
+	}
+
+	q.release(a)
+
+	if !q.admits(carol, room, "carol") {
+		t.Error("released allocations should not count anymore")
+	}
+}
+
+func TestQuotasLimitAllocationsPerCredential(t *testing.T) {
+	svc := service.New()
+	room := svc.CreateRoom(service.RoomOptions{})
+	q := newQuotas(svc, logging.New(false), testOptions{credentialAllocations: 1})
+
+	alice, bob, carol := &net.UDPAddr{Port: 1}, &net.UDPAddr{Port: 2}, &net.UDPAddr{Port: 3}
+
+	if !q.admits(alice, room, "alice") || !q.admits(bob, room, "bob") {
+		t.Fatal("each credential should be admitted within its quota")
+	}
+
+	if q.admits(carol, room, "alice") {
+		t.Error("allocations being made with a credential should count against its quota")
+	}
+
+	a := q.acquire(alice)
+
+	if q.admits(carol, room, "alice") {
+		t.Error("allocations should count against the quota of their credential")
+	}
+
+	if !q.admits(alice, room, "alice") {
+		t.Error("a client refreshing its allocation should be admitted")
+	}
+
+	q.release(a)
+
+	if !q.admits(carol, room, "alice") {
+		t.Error("released allocations should not count anymore")
+	}
+}
+
+func TestEventsCarryTheAllocationsOfTheRoom(t *testing.T) {
+	svc := service.New()
+	room := svc.CreateRoom(service.RoomOptions{})
+	q := newQuotas(svc, logging.New(false), testOptions{})
+	events := q.Subscribe()
+
+	alice, bob := &net.UDPAddr{Port: 1}, &net.UDPAddr{Port: 2}
+	q.admits(alice, room, "alice")
+	q.admits(bob, room, "bob")
+	a := q.acquire(alice)
+	q.acquire(bob)
+	q.release(a)
+
+	for _, expected := range []int{1, 2, 1} {
+		if e := <-events; e.Room != room || e.Allocations != expected {
+			t.Errorf("expected %d allocations in %s, got %d in %s", expected, room, e.Allocations, e.Room)
+		}
+	}
+}
+
+func TestAccountCountsLiveTraffic(t *testing.T) {
+	svc := service.New()
+	room := svc.CreateRoom(service.RoomOptions{})
+	q := newQuotas(svc, logging.New(false), testOptions{})
+	bytes := func() int64 { return metrics.Relay.Get("bytes").(*expvar.Int).Value() }
+
+	q.admits(&net.UDPAddr{Port: 1}, room, "alice")
+	a := q.acquire(&net.UDPAddr{Port: 1})
+	q.account(a, 100, true)
+	before := bytes()
+	q.account(a, 100, true)
+
+	if bytes()-before != 100 {
+		t.Errorf("relayed bytes should be counted before the allocation is deleted")
+	}
+
+	if usage := q.Usage(room); usage.Bytes != 200 || usage.Packets != 2 {
+		t.Errorf("unexpected usage %+v", usage)
+	}
+}
@@ -1,14 +1,16 @@
 package turn
 
 import (
+	"crypto/tls"
 	"fmt"
-	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-i2p/i2pkeys"
-	sam "github.com/go-i2p/sam3/helper"
 	"github.com/yuukanoo/rtchat/internal/logging"
 	"github.com/yuukanoo/rtchat/internal/service"
 
+	pionlogging "github.com/pion/logging"
 	"github.com/pion/turn/v2"
 
 	"net"
@@ -19,114 +21,295 @@ type (
 	Options interface {
 		// Realm used by the turn server.
 		Realm() string
-		// PublicIP at which the turn server will be publicly accessible.
-		PublicIP() net.IP
 		// Port at which the turn server will be made available.
 		Port() int
 		// SAMAddress at which the Simple Anonymous Messaging bridge can be reached.
 		SAMAddress() string
+		// RelayPoolSize is the number of I2P relay sessions kept ready for new
+		// allocations.
+		RelayPoolSize() int
+		// RoomAllocations is the maximum number of allocations of a room, 0 for
+		// no limit.
+		RoomAllocations() int
+		// CredentialAllocations is the maximum number of allocations made with
+		// the credential of a participant, 0 for no limit.
+		CredentialAllocations() int
+		// RelayBitrate is the maximum bitrate of an allocation in kbit/s, 0 for
+		// no limit.
+		RelayBitrate() int
+		// RelayBandwidth is the maximum bitrate relayed by the whole server in
+		// kbit/s, 0 for no limit.
+		RelayBandwidth() int
+		// MaxLifetime is the duration after which allocations stop relaying and
+		// could not be refreshed anymore, 0 for no limit.
+		MaxLifetime() time.Duration
+		// TLSPort at which the turn server accepts TLS connections, 0 to disable
+		// the TLS listener.
+		TLSPort() int
+		// Certificate presented by the TLS listener.
+		Certificate() (tls.Certificate, error)
+		// LoggerFactory creates the loggers of the pion turn server.
+		LoggerFactory() pionlogging.LoggerFactory
+		// SessionLost is called when the session of the I2P listener is lost,
+		// it should then be rebuilt with Reconnect.
+		SessionLost(error)
 	}
 
 	// Server made available to traverse NAT.
 	Server interface {
+		// Host at which clients reach the server, the base32 destination of the
+		// listener.
+		Host() string
+		// TLSHost is the base32 destination of the TLS listener, empty if it is
+		// disabled.
+		TLSHost() string
+		// Usage retrieves the relay usage of the given room.
+		Usage(string) Usage
+		// Stats retrieves a snapshot of the allocations of the server.
+		Stats() Stats
+		// Subscribe returns a channel receiving allocation events.
+		Subscribe() <-chan Event
+		// Unsubscribe stops sending events to the given channel.
+		Unsubscribe(<-chan Event)
+		// Reconnect rebuilds the I2P sessions of the server, keeping the
+		// destinations of the listeners.
+		Reconnect() error
 		// Close the server and stops the listener.
 		Close() error
 	}
+
+	server struct {
+		*turn.Server
+		*quotas
+		pool    *sessionPool
+		session *sessionConn
+		streams *streamListener
+		host    string
+	}
 )
 
 // New instantiates a new turn server.
-func New(service service.Service, logger logging.Logger, options Options) (Server, error) {
-	udpListener, err := sam.I2PDatagramSession("rtcchat-turn", options.SAMAddress(), "rtcchat-turn")
+func New(svc service.Service, logger logging.Logger, options Options) (Server, error) {
+	// Relay sessions are built right away so the first allocations do not
+	// wait for tunnels
+	pool := newSessionPool(options.SAMAddress(), options.RelayPoolSize(), logger)
+	session, err := listenDatagrams(options.SAMAddress(), options.SessionLost)
 
 	if err != nil {
+		pool.close()
 		return nil, err
 	}
 
-	s, err := turn.NewServer(turn.ServerConfig{
-		Realm: options.Realm(),
-		AuthHandler: func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
-			switch srcAddr.(type) {
-			case *i2pkeys.I2PAddr:
-				// We have an I2P datagram, so it's OK to use
-				room := service.GetRoom(username)
-
-				if room == nil {
-					return nil, false
-				}
-
-				// TODO maybe cache this thing
-				return turn.GenerateAuthKey(room.ID, realm, room.Credential), true
-			}
+	// Relays are reached through the destination of the listener
+	host := session.LocalAddr().(i2pkeys.I2PAddr).Base32()
+	relays := &I2PRelayAddressGenerator{
+		RelayAddress: host,
+		SAMAddress:   options.SAMAddress(),
+		pool:         pool,
+	}
+
+	// The turn server only handles IP addresses so I2P destinations are mapped
+	// to some
+	book := newAddressBook()
+	connConfig := turn.PacketConnConfig{PacketConn: &mappedConn{PacketConn: session, book: book}}
+
+	isolation := newIsolation(logger, book)
+	quotas := newQuotas(svc, logger, options)
+	listener := &sourceConn{PacketConn: connConfig.PacketConn, book: book, refreshed: quotas.refreshed, logger: logger}
+
+	auth := func(username, realm string, srcAddr net.Addr) (key []byte, ok bool) {
+		room, key := relayKey(svc, username, realm)
+
+		if room == nil {
+			return nil, false
+		}
+
+		// Only allocations coming from I2P are accepted so no clearnet
+		// address could ever be relayed.
+		if _, ok := book.destination(srcAddr); !ok {
+			logger.Error("turn: refusing allocation from %s for room %s", srcAddr.Network(), room.ID)
+			return nil, false
+		}
+
+		if !quotas.admits(srcAddr, room.ID, username) {
 			return nil, false
-		},
-		PacketConnConfigs: []turn.PacketConnConfig{
-			{
-				PacketConn: udpListener,
-				RelayAddressGenerator: &I2PRelayAddressGenerator{
-					RelayAddress: udpListener.Addr().(i2pkeys.I2PAddr).Base32(), // Claim that we are listening on IP passed by user (This should be your Public IP)
-					SAMAddress:   options.SAMAddress(),
-				},
+		}
+
+		isolation.authenticated(srcAddr, room.ID)
+
+		return key, true
+	}
+
+	connConfig.PacketConn = listener
+	connConfig.PermissionHandler = isolation.permits
+	connConfig.RelayAddressGenerator = &mappedGenerator{
+		RelayAddressGenerator: guard(relays, listener, isolation, quotas),
+		book:                  book,
+	}
+
+	var (
+		listenerConfigs []turn.ListenerConfig
+		streams         *streamListener
+	)
+
+	if options.TLSPort() > 0 {
+		var tlsListener *sourceListener
+
+		// TCP allocations are handled apart since the turn server does not
+		// relay them
+		tcpRelays := &tcpRelays{
+			realm:       options.Realm(),
+			service:     svc,
+			auth:        auth,
+			newRelay:    func() (streamRelay, error) { return newStreamRelay(options.SAMAddress()) },
+			book:        book,
+			isolation:   isolation,
+			quotas:      quotas,
+			logger:      logger,
+			nonces:      make(map[string]time.Time),
+			connections: make(map[uint32]*tcpConnection),
+		}
+
+		if tlsListener, streams, err = listenTLS(options, book, tcpRelays); err != nil {
+			session.Close()
+			pool.close()
+
+			return nil, err
+		}
+
+		tlsListener.refreshed = quotas.refreshed
+
+		listenerConfigs = append(listenerConfigs, turn.ListenerConfig{
+			Listener:          tlsListener,
+			PermissionHandler: isolation.permits,
+			RelayAddressGenerator: &mappedGenerator{
+				RelayAddressGenerator: guard(relays, tlsListener, isolation, quotas),
+				book:                  book,
 			},
-		},
+		})
+	}
+
+	s, err := turn.NewServer(turn.ServerConfig{
+		Realm:             options.Realm(),
+		LoggerFactory:     options.LoggerFactory(),
+		AuthHandler:       auth,
+		PacketConnConfigs: []turn.PacketConnConfig{connConfig},
+		ListenerConfigs:   listenerConfigs,
 	})
 
+	if err != nil {
+		pool.close()
+		return nil, err
+	}
+
 	logger.Info(`TURN/STUN Server launched:
 	Realm:		%s
-	Public IP:	%s
-	Port:		%d`, options.Realm(), options.PublicIP(), options.Port())
+	Host:		%s
+	Port:		%d
+	TLS Port:	%d`, options.Realm(), host, options.Port(), options.TLSPort())
+
+	return &server{s, quotas, pool, session, streams, host}, nil
+}
+
+// relayKey retrieves the room of the given relay credential and its long-term
+// key, a nil room if the credential is unknown.
+func relayKey(svc service.Service, username, realm string) (*service.Room, []byte) {
+	room := svc.GetRoom(service.RelayRoom(username))
+
+	if room == nil {
+		return nil, nil
+	}
 
-	return s, err
+	return room, turn.GenerateAuthKey(username, realm, room.RelayPassword(username))
 }
 
+func (s *server) Host() string { return s.host }
+
+func (s *server) TLSHost() string {
+	if s.streams == nil {
+		return ""
+	}
+
+	return s.streams.Host()
+}
+
+// Reconnect swaps the sessions of the I2P listeners and replaces idle relay
+// sessions, allocations relayed by dead sessions expire on their own.
+func (s *server) Reconnect() error {
+	if err := s.session.reconnect(); err != nil {
+		return err
+	}
+
+	if s.streams != nil {
+		if err := s.streams.reconnect(); err != nil {
+			return err
+		}
+	}
+
+	s.pool.refill()
+
+	return nil
+}
+
+// Close the server and its idle relay sessions.
+func (s *server) Close() error {
+	defer s.pool.close()
+
+	return s.Server.Close()
+}
+
+// guard wraps the relay address generator of a listener so its allocations are
+// isolated and respect the quotas.
+func guard(generator turn.RelayAddressGenerator, listener clientSource, isolation *isolation, quotas *quotas) turn.RelayAddressGenerator {
+	return &quotaGenerator{
+		RelayAddressGenerator: &isolatedGenerator{generator, isolation, listener},
+		quotas:                quotas,
+		listener:              listener,
+	}
+}
+
+// I2PRelayAddressGenerator hands out I2P sessions to allocations.
 type I2PRelayAddressGenerator struct {
+	// RelayAddress is the base32 destination of the listener, advertised to
+	// clients as the host of the turn server.
 	RelayAddress string
 	SAMAddress   string
+
+	pool *sessionPool
 }
 
 func (i *I2PRelayAddressGenerator) Validate() error {
 	switch {
 	case i.RelayAddress == "":
 		return fmt.Errorf("I2PRelayAddressGenerator: RelayAddress is empty")
+	case !strings.HasSuffix(i.RelayAddress, ".b32.i2p"):
+		return fmt.Errorf("I2PRelayAddressGenerator: RelayAddress %q is not a base32 destination", i.RelayAddress)
+	case i.SAMAddress == "":
+		return fmt.Errorf("I2PRelayAddressGenerator: SAMAddress is empty")
 	default:
 		return nil
 	}
 }
 
-// Allocate a PacketConn (UDP) RelayAddress
+// AllocatePacketConn hands out a relay session to a UDP allocation. Sessions
+// come from the pool when there is one and are returned to it on expiry.
 func (i *I2PRelayAddressGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
-	conn, err := sam.I2PDatagramSession("rtcchat-turn-udp"+strconv.Itoa(requestedPort), i.SAMAddress, "rtcchat-turn-udp"+strconv.Itoa(requestedPort))
-	if err != nil {
-		return nil, nil, err
+	if i.pool != nil {
+		return i.pool.get()
 	}
 
-	// Replace actual listening IP with the user requested one of RelayAddressGeneratorStatic
-	relayAddr, ok := conn.LocalAddr().(*i2pkeys.I2PAddr)
-	if !ok {
-		return nil, nil, fmt.Errorf("I2PRelayAddressGenerator: AllocatePacketConn: conn.LocalAddr() is not an I2PAddr")
-	}
+	conn, err := newDatagramSession(i.SAMAddress)
 
-	//relayAddr.IP = i.RelayAddress
+	if err != nil {
+		return nil, nil, err
+	}
 
-	return conn, relayAddr, nil
+	return conn, conn.LocalI2PAddr(), nil
 }
 
-// Allocate a Conn (TCP) RelayAddress
+// AllocateConn is never called by pion/turn v2 which does not handle TCP
+// allocations (RFC 6062), they are relayed by the tcpRelays of the TLS
+// listener instead.
 func (i *I2PRelayAddressGenerator) AllocateConn(network string, requestedPort int) (net.Conn, net.Addr, error) {
-	sess, err := sam.I2PStreamSession("rtcchat-turn-tcp"+strconv.Itoa(requestedPort), i.SAMAddress, "rtcchat-turn-tcp"+strconv.Itoa(requestedPort))
-	if err != nil {
-		return nil, nil, err
-	}
-	relayAddr, ok := sess.LocalAddr().(*i2pkeys.I2PAddr)
-	if !ok {
-		return nil, nil, fmt.Errorf("nil connection error")
-	}
-	list, err := sess.Listen()
-	if err != nil {
-		return nil, nil, err
-	}
-	conn, err := list.Accept()
-	if err != nil {
-		return nil, nil, err
-	}
-	return conn, relayAddr, nil
+	return nil, nil, errTCPAllocation
 }
@@ -0,0 +1,362 @@
+package turn
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/go-i2p/sam3"
+	sam "github.com/go-i2p/sam3/helper"
+)
+
+const (
+	// listenerKeys is the name of the session of the I2P listener and the path
+	// of its keys, so the destination given to clients outlives the session.
+	listenerKeys = "rtcchat-turn"
+	// streamKeys is the same for the stream session of the TLS listener.
+	streamKeys = "rtcchat-turns"
+)
+
+type (
+	// sessionConn is the listener of the turn server on I2P. Sessions die with
+	// the router so a new one may be swapped in while the turn server keeps
+	// reading.
+	sessionConn struct {
+		samAddress string
+		// lost is called when the current session is lost, reads only wait for
+		// another one.
+		lost    func(error)
+		mutex   sync.Mutex
+		session net.PacketConn
+		swapped chan struct{}
+		closed  bool
+	}
+
+	// streamListener accepts the I2P streams of the TLS listener. Like the
+	// datagram session of the listener, its session may be swapped.
+	streamListener struct {
+		samAddress string
+		lost       func(error)
+		mutex      sync.Mutex
+		session    *sam3.StreamSession
+		listener   net.Listener
+		swapped    chan struct{}
+		closed     bool
+	}
+)
+
+// listenDatagrams opens the datagram session of the I2P listener.
+func listenDatagrams(samAddress string, lost func(error)) (*sessionConn, error) {
+	session, err := sam.I2PDatagramSession(listenerKeys, samAddress, listenerKeys)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c := &sessionConn{
+		samAddress: samAddress,
+		lost:       lost,
+		session:    session,
+		swapped:    make(chan struct{}),
+	}
+
+	go c.watch(session, control(session))
+
+	return c, nil
+}
+
+// control retrieves the connection to the bridge which holds the given session
+// open, sam3 does not expose it.
+func control(session any) net.Conn {
+	field := reflect.ValueOf(session).Elem().FieldByName("conn")
+
+	if !field.IsValid() || field.Type() != reflect.TypeOf((*net.Conn)(nil)).Elem() {
+		return nil
+	}
+
+	return *(*net.Conn)(unsafe.Pointer(field.UnsafeAddr()))
+}
+
+// keepAlive reads the given control connection until the bridge closes it and
+// answers its pings.
+func keepAlive(conn net.Conn) error {
+	reader := bufio.NewReader(conn)
+
+	for {
+		line, err := reader.ReadString('\n')
+
+		if err != nil {
+			return err
+		}
+
+		if rest, ok := strings.CutPrefix(line, "PING"); ok {
+			conn.Write([]byte("PONG" + rest))
+		}
+	}
+}
+
+// watch keeps the control connection of the given session alive until the
+// bridge closes it, which means the session is lost unless it has been
+// replaced or closed in the meantime.
+func (c *sessionConn) watch(session net.PacketConn, conn net.Conn) {
+	if conn == nil {
+		return
+	}
+
+	err := keepAlive(conn)
+
+	c.mutex.Lock()
+	current := c.session == session && !c.closed
+	c.mutex.Unlock()
+
+	if current {
+		c.lost(fmt.Errorf("turn: datagram session lost: %w", err))
+	}
+}
+
+// reconnect closes the current session and opens a new one with the same keys.
+// It is closed first since the bridge would refuse a duplicated destination.
+func (c *sessionConn) reconnect() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+
+	c.session.Close()
+
+	session, err := sam.I2PDatagramSession(listenerKeys, c.samAddress, listenerKeys)
+
+	if err != nil {
+		return err
+	}
+
+	c.session = session
+	close(c.swapped)
+	c.swapped = make(chan struct{})
+
+	go c.watch(session, control(session))
+
+	return nil
+}
+
+func (c *sessionConn) current() net.PacketConn {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.session
+}
+
+// ReadFrom reads from the current session. When it fails, the read waits for
+// another session instead of stopping the turn server.
+func (c *sessionConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mutex.Lock()
+		session, swapped, closed := c.session, c.swapped, c.closed
+		c.mutex.Unlock()
+
+		if closed {
+			return 0, nil, net.ErrClosed
+		}
+
+		n, addr, err := session.ReadFrom(b)
+
+		if err == nil {
+			return n, addr, nil
+		}
+
+		c.mutex.Lock()
+		stale := c.session != session
+		c.mutex.Unlock()
+
+		if !stale {
+			<-swapped
+		}
+	}
+}
+
+func (c *sessionConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.current().WriteTo(b, addr)
+}
+
+func (c *sessionConn) LocalAddr() net.Addr {
+	return c.current().LocalAddr()
+}
+
+func (c *sessionConn) SetDeadline(t time.Time) error {
+	return c.current().SetDeadline(t)
+}
+
+func (c *sessionConn) SetReadDeadline(t time.Time) error {
+	return c.current().SetReadDeadline(t)
+}
+
+func (c *sessionConn) SetWriteDeadline(t time.Time) error {
+	return c.current().SetWriteDeadline(t)
+}
+
+// Close the current session for good, pending reads return.
+func (c *sessionConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	c.closed = true
+	close(c.swapped)
+
+	return c.session.Close()
+}
+
+// listenStreams opens the stream session of the TLS listener.
+func listenStreams(samAddress string, lost func(error)) (*streamListener, error) {
+	session, listener, err := streamSession(samAddress)
+
+	if err != nil {
+		return nil, err
+	}
+
+	l := &streamListener{
+		samAddress: samAddress,
+		lost:       lost,
+		session:    session,
+		listener:   listener,
+		swapped:    make(chan struct{}),
+	}
+
+	go l.watch(session, control(session))
+
+	return l, nil
+}
+
+func streamSession(samAddress string) (*sam3.StreamSession, net.Listener, error) {
+	session, err := sam.I2PStreamSession(streamKeys, samAddress, streamKeys)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	listener, err := session.Listen()
+
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+
+	return session, listener, nil
+}
+
+// watch reports the given session lost once the bridge closes its control
+// connection, unless it has been replaced or closed in the meantime.
+func (l *streamListener) watch(session *sam3.StreamSession, conn net.Conn) {
+	if conn == nil {
+		return
+	}
+
+	err := keepAlive(conn)
+
+	l.mutex.Lock()
+	current := l.session == session && !l.closed
+	l.mutex.Unlock()
+
+	if current {
+		l.lost(fmt.Errorf("turn: stream session lost: %w", err))
+	}
+}
+
+// reconnect closes the current session and opens a new one with the same keys.
+func (l *streamListener) reconnect() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return net.ErrClosed
+	}
+
+	l.session.Close()
+
+	session, listener, err := streamSession(l.samAddress)
+
+	if err != nil {
+		return err
+	}
+
+	l.session, l.listener = session, listener
+	close(l.swapped)
+	l.swapped = make(chan struct{})
+
+	go l.watch(session, control(session))
+
+	return nil
+}
+
+// Host is the base32 destination of the session.
+func (l *streamListener) Host() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.session.Addr().Base32()
+}
+
+// Accept waits for a stream on the current session. When it fails, it waits
+// for another session instead of stopping the turn server.
+func (l *streamListener) Accept() (net.Conn, error) {
+	for {
+		l.mutex.Lock()
+		listener, swapped, closed := l.listener, l.swapped, l.closed
+		l.mutex.Unlock()
+
+		if closed {
+			return nil, net.ErrClosed
+		}
+
+		conn, err := listener.Accept()
+
+		if err == nil {
+			return conn, nil
+		}
+
+		l.mutex.Lock()
+		stale := l.listener != listener
+		l.mutex.Unlock()
+
+		if !stale {
+			// Streams are accepted on a new connection to the bridge, which may
+			// fail without the session being lost
+			select {
+			case <-swapped:
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+func (l *streamListener) Addr() net.Addr {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.session.Addr()
+}
+
+// Close the current session for good, pending accepts return.
+func (l *streamListener) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return nil
+	}
+
+	l.closed = true
+	close(l.swapped)
+
+	return l.session.Close()
+}
@@ -0,0 +1,61 @@
+package turn
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-i2p/sam3"
+)
+
+func TestControlConnOfSessions(t *testing.T) {
+	for _, session := range []any{sam3.DatagramSession{}, sam3.StreamSession{}} {
+		field, ok := reflect.TypeOf(session).FieldByName("conn")
+
+		if !ok || field.Type != reflect.TypeOf((*net.Conn)(nil)).Elem() {
+			t.Errorf("%T does not hold its control connection anymore", session)
+		}
+	}
+}
+
+func TestWatchReportsLostSessions(t *testing.T) {
+	lost := make(chan error, 1)
+	session := &nopConn{}
+	c := &sessionConn{lost: func(err error) { lost <- err }, session: session}
+
+	bridge, conn := net.Pipe()
+	go c.watch(session, conn)
+
+	// Pings of the bridge are answered
+	go bridge.Write([]byte("PING 42\n"))
+
+	if line, err := bufio.NewReader(bridge).ReadString('\n'); err != nil || line != "PONG 42\n" {
+		t.Fatalf("expected the ping to be answered, got %q and %v", line, err)
+	}
+
+	bridge.Close()
+
+	select {
+	case <-lost:
+	case <-time.After(time.Second):
+		t.Fatal("the lost session has not been reported")
+	}
+}
+
+func TestWatchIgnoresReplacedSessions(t *testing.T) {
+	lost := make(chan error, 1)
+	session := &nopConn{}
+	c := &sessionConn{lost: func(err error) { lost <- err }, session: &nopConn{}}
+
+	bridge, conn := net.Pipe()
+	bridge.Close()
+	c.watch(session, conn)
+
+	select {
+	case err := <-lost:
+		t.Fatalf("a replaced session has been reported lost: %v", err)
+	default:
+	}
+}
@@ -0,0 +1,166 @@
+package turn
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yuukanoo/rtchat/internal/metrics"
+
+	"github.com/pion/stun"
+)
+
+const (
+	// EventCreated is emitted when a relay is allocated.
+	EventCreated = "created"
+	// EventRefreshed is emitted when a client extends the lifetime of its
+	// allocation.
+	EventRefreshed = "refreshed"
+	// EventDeleted is emitted when an allocation expires or is deleted by its
+	// client.
+	EventDeleted = "deleted"
+
+	// eventBufferSize is the number of events which could be waiting for a
+	// subscriber before new ones are dropped.
+	eventBufferSize = 64
+)
+
+var refreshSuccess = stun.NewType(stun.MethodRefresh, stun.ClassSuccessResponse)
+
+type (
+	// Event in the lifecycle of an allocation with the traffic it has relayed so
+	// far and the number of allocations of its room once it has happened.
+	Event struct {
+		Type        string    `json:"type"`
+		Room        string    `json:"room"`
+		Allocations int       `json:"allocations"`
+		Bytes       uint64    `json:"bytes"`
+		Packets     uint64    `json:"packets"`
+		Time        time.Time `json:"time"`
+	}
+
+	// Stats is a snapshot of the allocations of the server.
+	Stats struct {
+		Allocations int              `json:"allocations"`
+		Rooms       map[string]Usage `json:"rooms"`
+	}
+
+	// events dispatches allocation events to subscribers without ever blocking
+	// the relays.
+	events struct {
+		mutex       sync.Mutex
+		subscribers []chan Event
+	}
+)
+
+// Subscribe returns a channel receiving allocation events. Events are dropped
+// if it is not read fast enough.
+func (e *events) Subscribe() <-chan Event {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	ch := make(chan Event, eventBufferSize)
+	e.subscribers = append(e.subscribers, ch)
+
+	return ch
+}
+
+// Unsubscribe stops sending events to the given channel and closes it.
+func (e *events) Unsubscribe(ch <-chan Event) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for i, sub := range e.subscribers {
+		if sub == ch {
+			e.subscribers = append(e.subscribers[:i], e.subscribers[i+1:]...)
+			close(sub)
+			return
+		}
+	}
+}
+
+func (e *events) emit(event Event) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for _, sub := range e.subscribers {
+		select {
+		case sub <- event:
+		default:
+		}
+	}
+}
+
+// notify counts an event of the given allocation and sends it to subscribers,
+// the mutex must be held.
+func (q *quotas) notify(typ string, a *allocation) {
+	metrics.Relay.Add("allocations_"+typ, 1)
+
+	q.emit(Event{
+		Type:        typ,
+		Room:        a.room,
+		Allocations: q.usage(a.room).Allocations,
+		Bytes:       a.bytes,
+		Packets:     a.packets,
+		Time:        time.Now(),
+	})
+}
+
+// refreshed emits an event for the allocation of the given client.
+func (q *quotas) refreshed(clientAddr net.Addr) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if a := q.allocations[clientAddr.String()]; a != nil {
+		q.notify(EventRefreshed, a)
+	}
+}
+
+// Stats retrieves a snapshot of the allocations and of the usage of every
+// room.
+func (q *quotas) Stats() Stats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	stats := Stats{
+		Allocations: len(q.allocations),
+		Rooms:       make(map[string]Usage, len(q.rooms)),
+	}
+
+	for room, usage := range q.rooms {
+		stats.Rooms[room] = *usage
+	}
+
+	return stats
+}
+
+// WriteTo tells when a refresh succeeds. Refreshes with a zero lifetime delete
+// the allocation and are reported when its relay is closed.
+func (c *sourceConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+
+	if err == nil && c.refreshed != nil && isRefresh(b) {
+		c.refreshed(addr)
+	}
+
+	return n, err
+}
+
+// isRefresh checks if the given packet is a successful refresh response which
+// extends the lifetime of an allocation.
+func isRefresh(b []byte) bool {
+	if !stun.IsMessage(b) || binary.BigEndian.Uint16(b) != refreshSuccess.Value() {
+		return false
+	}
+
+	m := &stun.Message{Raw: append([]byte(nil), b...)}
+
+	if err := m.Decode(); err != nil {
+		return false
+	}
+
+	lifetime, err := m.Get(stun.AttrLifetime)
+
+	return err == nil && len(lifetime) == 4 && binary.BigEndian.Uint32(lifetime) > 0
+}
@@ -0,0 +1,1016 @@
+package turn
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yuukanoo/rtchat/internal/crypto"
+	"github.com/yuukanoo/rtchat/internal/logging"
+	"github.com/yuukanoo/rtchat/internal/service"
+
+	"github.com/go-i2p/i2pkeys"
+	"github.com/go-i2p/sam3"
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2"
+)
+
+const (
+	// defaultLifetime and maxLifetime bound the lifetime of TCP allocations,
+	// as pion/turn does for UDP ones.
+	defaultLifetime = 10 * time.Minute
+	maxLifetime     = time.Hour
+	// permissionLifetime is the lifetime of the permissions of an allocation.
+	permissionLifetime = 5 * time.Minute
+	// connectionTimeout is the time given to a client to bind a peer connection
+	// before it is closed.
+	connectionTimeout = 30 * time.Second
+	// nonceLifetime is the time after which a nonce is stale.
+	nonceLifetime = time.Hour
+	// relayChunk is the size of the chunks relayed between data connections
+	// and peers, small enough to fit in the bucket of low bitrates.
+	relayChunk = 1500
+	// throttleInterval is the time waited for a bucket to refill.
+	throttleInterval = 10 * time.Millisecond
+)
+
+var (
+	refreshRequest          = stun.NewType(stun.MethodRefresh, stun.ClassRequest)
+	createPermissionRequest = stun.NewType(stun.MethodCreatePermission, stun.ClassRequest)
+	connectRequest          = stun.NewType(stun.MethodConnect, stun.ClassRequest)
+	connectionBindRequest   = stun.NewType(stun.MethodConnectionBind, stun.ClassRequest)
+	connectionAttempt       = stun.NewType(stun.MethodConnectionAttempt, stun.ClassIndication)
+)
+
+type (
+	// tcpRelays handles the TCP allocations of RFC 6062 on the streams of the
+	// TLS listener since pion/turn v2 does not. Each allocation is relayed by
+	// an I2P stream session of its own, whose streams are accepted in the
+	// background. Requests of other allocations are left to the turn server.
+	tcpRelays struct {
+		realm     string
+		service   service.Service
+		auth      turn.AuthHandler
+		newRelay  func() (streamRelay, error)
+		book      *addressBook
+		isolation *isolation
+		quotas    *quotas
+		logger    logging.Logger
+
+		mutex       sync.Mutex
+		nonces      map[string]time.Time
+		connections map[uint32]*tcpConnection
+	}
+
+	// streamRelay is the I2P stream session relaying a TCP allocation.
+	streamRelay interface {
+		Addr() i2pkeys.I2PAddr
+		Dial(i2pkeys.I2PAddr) (net.Conn, error)
+		Accept() (net.Conn, error)
+		Close() error
+	}
+
+	// i2pStreamRelay is a streamRelay built on a sam3 session.
+	i2pStreamRelay struct {
+		session  *sam3.StreamSession
+		listener *sam3.StreamListener
+	}
+
+	// tcpListener wraps the streams of the TLS listener so TCP allocations are
+	// handled by its relays.
+	tcpListener struct {
+		net.Listener
+		relays *tcpRelays
+	}
+
+	// tcpStream is a stream of the TLS listener. It is either the control
+	// connection of allocations or, once bound to a peer connection, a data
+	// connection which the turn server stops reading.
+	tcpStream struct {
+		net.Conn
+		relays *tcpRelays
+		// Frames left to the turn server and not read yet.
+		pending []byte
+		// Incomplete frame of the last read.
+		partial []byte
+		// Frames other than ConnectionBind requests read so far, the stream could
+		// not be bound after them.
+		others int
+		err    error
+
+		mutex      sync.Mutex
+		writeMutex sync.Mutex
+		allocation *tcpAllocation
+		// Peer connection to which the stream is bound.
+		binding *tcpConnection
+	}
+
+	// tcpAllocation is a TCP allocation controlled by a stream.
+	tcpAllocation struct {
+		relays   *tcpRelays
+		control  *tcpStream
+		relay    streamRelay
+		addr     *net.UDPAddr
+		room     string
+		username string
+		quota    *allocation
+		bitrate  *bucket
+
+		mutex       sync.Mutex
+		permissions map[string]time.Time
+		lifetime    *time.Timer
+		expiry      *time.Timer
+		closed      bool
+	}
+
+	// tcpConnection is a connection between a relay and a peer, relayed to the
+	// data connection bound to it.
+	tcpConnection struct {
+		id         uint32
+		allocation *tcpAllocation
+		peerAddr   *net.UDPAddr
+
+		mutex   sync.Mutex
+		peer    net.Conn
+		data    net.Conn
+		timeout *time.Timer
+		closed  bool
+	}
+
+	// lifetimeAttr sets a LIFETIME attribute.
+	lifetimeAttr time.Duration
+
+	// connectionIDAttr sets a CONNECTION-ID attribute.
+	connectionIDAttr uint32
+
+	// addressAttr sets an address attribute of the given type.
+	addressAttr struct {
+		addr *net.UDPAddr
+		typ  stun.AttrType
+	}
+)
+
+// newStreamRelay builds the stream session of a TCP allocation and listens for
+// peers on it.
+func newStreamRelay(samAddress string) (streamRelay, error) {
+	session, err := newStreamSession(samAddress)
+
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := session.Listen()
+
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	return &i2pStreamRelay{session, listener}, nil
+}
+
+func (r *i2pStreamRelay) Addr() i2pkeys.I2PAddr { return r.session.Addr() }
+
+func (r *i2pStreamRelay) Dial(peer i2pkeys.I2PAddr) (net.Conn, error) {
+	return r.session.DialI2P(peer)
+}
+
+func (r *i2pStreamRelay) Accept() (net.Conn, error) {
+	return r.listener.Accept()
+}
+
+// Close the session, which closes its streams.
+func (r *i2pStreamRelay) Close() error {
+	r.listener.Close()
+
+	return r.session.Close()
+}
+
+// Accept wraps the accepted stream.
+func (l *tcpListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &tcpStream{Conn: conn, relays: l.relays}, nil
+}
+
+// Read handles the requests of TCP allocations and gives the other frames to
+// the turn server. Once the stream is bound to a peer connection, it ends for
+// the turn server.
+func (c *tcpStream) Read(b []byte) (int, error) {
+	for {
+		if len(c.pending) > 0 {
+			n := copy(b, c.pending)
+			c.pending = c.pending[n:]
+
+			return n, nil
+		}
+
+		if c.err != nil {
+			return 0, c.err
+		}
+
+		n, err := c.Conn.Read(b)
+		c.err = err
+
+		if n > 0 {
+			c.split(b[:n])
+		}
+	}
+}
+
+// split the stream in STUN and ChannelData messages, as the turn server does,
+// and handles the requests of TCP allocations.
+func (c *tcpStream) split(b []byte) {
+	data := append(c.partial, b...)
+
+	for {
+		size := frameSize(data)
+
+		if size < 0 {
+			// The turn server closes the connection anyway
+			c.pending = append(c.pending, data...)
+			data = nil
+
+			break
+		}
+
+		if size == 0 || len(data) < size {
+			break
+		}
+
+		if !c.handle(data[:size]) {
+			c.pending = append(c.pending, data[:size]...)
+		}
+
+		data = data[size:]
+
+		if binding := c.bound(); binding != nil {
+			// What follows the binding is data for the peer, the turn server
+			// reads nothing more
+			binding.relay(append([]byte(nil), data...))
+			c.partial = nil
+			c.err = io.EOF
+
+			return
+		}
+	}
+
+	c.partial = append([]byte(nil), data...)
+}
+
+// handle a frame if it belongs to a TCP allocation, it returns false if it
+// should be given to the turn server.
+func (c *tcpStream) handle(frame []byte) bool {
+	m := &stun.Message{Raw: append([]byte(nil), frame...)}
+
+	if !stun.IsMessage(frame) || m.Decode() != nil {
+		c.others++
+		return false
+	}
+
+	if m.Type != connectionBindRequest {
+		c.others++
+	}
+
+	c.mutex.Lock()
+	a := c.allocation
+	c.mutex.Unlock()
+
+	switch {
+	case m.Type == connectionBindRequest:
+		// Data connections are only used to bind a peer connection
+		if c.others > 0 || a != nil {
+			c.fail(m, stun.CodeBadRequest)
+			return true
+		}
+
+		c.bind(m)
+	case a != nil:
+		switch m.Type {
+		case bindingRequest:
+			return false
+		case refreshRequest:
+			a.refresh(m)
+		case createPermissionRequest:
+			a.createPermission(m)
+		case connectRequest:
+			a.connect(m)
+		case allocateRequest:
+			c.fail(m, stun.CodeAllocMismatch)
+		default:
+			// TCP allocations do not relay datagrams
+			if m.Type.Class == stun.ClassRequest {
+				c.fail(m, stun.CodeBadRequest)
+			}
+		}
+	case m.Type == allocateRequest && isTCPAllocation(frame):
+		c.allocate(m)
+	case m.Type == connectRequest:
+		c.fail(m, stun.CodeAllocMismatch)
+	default:
+		return false
+	}
+
+	return true
+}
+
+// authenticate checks the long-term credential of the given request with the
+// given handler, answering it if it fails.
+func (c *tcpStream) authenticate(m *stun.Message, auth turn.AuthHandler) (stun.MessageIntegrity, string, bool) {
+	r := c.relays
+
+	if !m.Contains(stun.AttrMessageIntegrity) {
+		c.fail(m, stun.CodeUnauthorized, stun.NewNonce(r.nonce()), stun.NewRealm(r.realm))
+		return nil, "", false
+	}
+
+	var (
+		nonce    stun.Nonce
+		username stun.Username
+	)
+
+	if err := nonce.GetFrom(m); err != nil || !r.validNonce(nonce.String()) {
+		c.fail(m, stun.CodeStaleNonce, stun.NewNonce(r.nonce()), stun.NewRealm(r.realm))
+		return nil, "", false
+	}
+
+	if err := username.GetFrom(m); err != nil {
+		c.fail(m, stun.CodeBadRequest)
+		return nil, "", false
+	}
+
+	key, ok := auth(username.String(), r.realm, c.RemoteAddr())
+
+	if !ok {
+		c.fail(m, stun.CodeUnauthorized, stun.NewNonce(r.nonce()), stun.NewRealm(r.realm))
+		return nil, "", false
+	}
+
+	integrity := stun.MessageIntegrity(key)
+
+	if err := integrity.Check(m); err != nil {
+		c.fail(m, stun.CodeUnauthorized, stun.NewNonce(r.nonce()), stun.NewRealm(r.realm))
+		return nil, "", false
+	}
+
+	return integrity, username.String(), true
+}
+
+// allocate a relay stream session for a TCP allocation controlled by this
+// stream.
+func (c *tcpStream) allocate(m *stun.Message) {
+	r := c.relays
+	integrity, username, ok := c.authenticate(m, r.auth)
+
+	if !ok {
+		return
+	}
+
+	if m.Contains(stun.AttrEvenPort) || m.Contains(stun.AttrReservationToken) {
+		c.fail(m, stun.CodeBadRequest, integrity)
+		return
+	}
+
+	room := r.isolation.roomOf(c.RemoteAddr())
+
+	if room == "" {
+		c.fail(m, stun.CodeUnauthorized, integrity)
+		return
+	}
+
+	relay, err := r.newRelay()
+
+	if err != nil {
+		r.logger.Error("turn: could not build a tcp relay session: %s", err)
+		c.fail(m, stun.CodeInsufficientCapacity, integrity)
+
+		return
+	}
+
+	a := &tcpAllocation{
+		relays:      r,
+		control:     c,
+		relay:       relay,
+		addr:        r.book.pin(relay.Addr()),
+		room:        room,
+		username:    username,
+		quota:       r.quotas.acquire(c.RemoteAddr()),
+		bitrate:     newBucket(r.quotas.options.RelayBitrate()),
+		permissions: make(map[string]time.Time),
+	}
+
+	r.isolation.allocated(relay.Addr(), room)
+	lifetime := requestedLifetime(m)
+	a.lifetime = time.AfterFunc(lifetime, a.close)
+
+	if max := r.quotas.options.MaxLifetime(); max > 0 {
+		a.expiry = time.AfterFunc(max, func() {
+			r.quotas.expire(a.quota)
+			a.close()
+		})
+	}
+
+	c.mutex.Lock()
+	c.allocation = a
+	c.mutex.Unlock()
+
+	go a.accept()
+
+	c.respond(m, stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse),
+		addressAttr{a.addr, stun.AttrXORRelayedAddress},
+		lifetimeAttr(lifetime),
+		addressAttr{c.RemoteAddr().(*net.UDPAddr), stun.AttrXORMappedAddress},
+		integrity,
+	)
+}
+
+// bind this stream to the peer connection given by the request, the stream
+// then becomes its data connection.
+func (c *tcpStream) bind(m *stun.Message) {
+	r := c.relays
+	var id connectionIDAttr
+
+	if err := id.GetFrom(m); err != nil {
+		c.fail(m, stun.CodeBadRequest)
+		return
+	}
+
+	conn := r.connection(uint32(id))
+
+	if conn == nil {
+		c.fail(m, stun.CodeBadRequest)
+		return
+	}
+
+	// Data connections are authenticated with the credential of the
+	// allocation, they do not count against the quotas
+	integrity, _, ok := c.authenticate(m, func(username, realm string, _ net.Addr) ([]byte, bool) {
+		if username != conn.allocation.username {
+			return nil, false
+		}
+
+		room, key := relayKey(r.service, username, realm)
+
+		return key, room != nil && room.ID == conn.allocation.room
+	})
+
+	if !ok {
+		return
+	}
+
+	if !conn.attach(c.Conn) {
+		c.fail(m, stun.CodeBadRequest, integrity)
+		return
+	}
+
+	c.respond(m, stun.NewType(stun.MethodConnectionBind, stun.ClassSuccessResponse), integrity)
+
+	c.mutex.Lock()
+	c.binding = conn
+	c.mutex.Unlock()
+}
+
+func (c *tcpStream) bound() *tcpConnection {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.binding
+}
+
+// respond to the given request.
+func (c *tcpStream) respond(m *stun.Message, t stun.MessageType, setters ...stun.Setter) {
+	setters = append([]stun.Setter{stun.NewTransactionIDSetter(m.TransactionID), t}, setters...)
+	c.send(append(setters, stun.Fingerprint)...)
+}
+
+// fail answers the given request with an error response.
+func (c *tcpStream) fail(m *stun.Message, code stun.ErrorCode, setters ...stun.Setter) {
+	c.respond(m, stun.NewType(m.Type.Method, stun.ClassErrorResponse), append([]stun.Setter{code}, setters...)...)
+}
+
+// send a message built with the given setters.
+func (c *tcpStream) send(setters ...stun.Setter) {
+	m, err := stun.Build(setters...)
+
+	if err != nil {
+		return
+	}
+
+	if _, err = c.Write(m.Raw); err != nil {
+		c.relays.logger.Debug("turn: could not write to a tcp allocation: %v", err)
+	}
+}
+
+// Write messages at once since allocations write from their own goroutines.
+func (c *tcpStream) Write(b []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	return c.Conn.Write(b)
+}
+
+// Close deletes the allocation controlled by the stream. The turn server
+// closes a data connection once it stops reading it, which is left to its
+// peer connection.
+func (c *tcpStream) Close() error {
+	c.mutex.Lock()
+	a, binding := c.allocation, c.binding
+	c.mutex.Unlock()
+
+	if a != nil {
+		a.close()
+	}
+
+	if binding != nil {
+		return nil
+	}
+
+	return c.Conn.Close()
+}
+
+// nonce issues a new nonce.
+func (r *tcpRelays) nonce() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+
+	for n, issuedAt := range r.nonces {
+		if now.Sub(issuedAt) > nonceLifetime {
+			delete(r.nonces, n)
+		}
+	}
+
+	n := crypto.GenerateUID(16)
+	r.nonces[n] = now
+
+	return n
+}
+
+func (r *tcpRelays) validNonce(n string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	issuedAt, ok := r.nonces[n]
+
+	return ok && time.Since(issuedAt) <= nonceLifetime
+}
+
+// register a peer connection of the given allocation under a new id.
+func (r *tcpRelays) register(a *tcpAllocation, peerAddr *net.UDPAddr) *tcpConnection {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var b [4]byte
+
+	for {
+		rand.Read(b[:])
+		id := binary.BigEndian.Uint32(b[:])
+
+		if _, taken := r.connections[id]; id != 0 && !taken {
+			conn := &tcpConnection{id: id, allocation: a, peerAddr: peerAddr}
+			r.connections[id] = conn
+
+			return conn
+		}
+	}
+}
+
+// connection retrieves a peer connection by id.
+func (r *tcpRelays) connection(id uint32) *tcpConnection {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.connections[id]
+}
+
+// connectionsOf retrieves the peer connections of the given allocation.
+func (r *tcpRelays) connectionsOf(a *tcpAllocation) []*tcpConnection {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var conns []*tcpConnection
+
+	for _, conn := range r.connections {
+		if conn.allocation == a {
+			conns = append(conns, conn)
+		}
+	}
+
+	return conns
+}
+
+func (r *tcpRelays) forget(conn *tcpConnection) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.connections[conn.id] == conn {
+		delete(r.connections, conn.id)
+	}
+}
+
+// accept the streams of peers until the allocation is closed. Each permitted
+// peer is announced to the client which may then bind it.
+func (a *tcpAllocation) accept() {
+	for {
+		peer, err := a.relay.Accept()
+
+		if err != nil {
+			if a.isClosed() {
+				return
+			}
+
+			// Streams are accepted on a new connection to the bridge, which may
+			// fail without the session being lost
+			time.Sleep(time.Second)
+
+			continue
+		}
+
+		destination, ok := peer.RemoteAddr().(i2pkeys.I2PAddr)
+
+		if !ok || !a.permits(destination) {
+			peer.Close()
+			continue
+		}
+
+		conn := a.relays.register(a, a.relays.book.lookup(destination))
+
+		if !conn.connected(peer) {
+			continue
+		}
+
+		a.control.send(
+			stun.TransactionID,
+			connectionAttempt,
+			addressAttr{conn.peerAddr, stun.AttrXORPeerAddress},
+			connectionIDAttr(conn.id),
+			stun.Fingerprint,
+		)
+	}
+}
+
+// permits checks if the given peer is a relay of the room with a permission.
+func (a *tcpAllocation) permits(peer i2pkeys.I2PAddr) bool {
+	if !a.relays.isolation.isRelayOf(peer, a.room) {
+		return false
+	}
+
+	ip := a.relays.book.lookup(peer).IP.String()
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	expiresAt, ok := a.permissions[ip]
+
+	return ok && time.Now().Before(expiresAt)
+}
+
+// refresh the allocation, a zero lifetime deletes it.
+func (a *tcpAllocation) refresh(m *stun.Message) {
+	integrity, _, ok := a.control.authenticate(m, a.relays.auth)
+
+	if !ok {
+		return
+	}
+
+	lifetime := requestedLifetime(m)
+
+	if raw, err := m.Get(stun.AttrLifetime); err == nil && len(raw) == 4 && binary.BigEndian.Uint32(raw) == 0 {
+		lifetime = 0
+	}
+
+	a.control.respond(m, stun.NewType(stun.MethodRefresh, stun.ClassSuccessResponse), lifetimeAttr(lifetime), integrity)
+
+	if lifetime == 0 {
+		a.close()
+		return
+	}
+
+	a.lifetime.Reset(lifetime)
+	a.relays.quotas.refreshed(a.control.RemoteAddr())
+}
+
+// createPermission installs permissions for the peers of the request, which
+// must all be relays of the room.
+func (a *tcpAllocation) createPermission(m *stun.Message) {
+	integrity, _, ok := a.control.authenticate(m, a.relays.auth)
+
+	if !ok {
+		return
+	}
+
+	peers := peerAddresses(m)
+
+	if len(peers) == 0 {
+		a.control.fail(m, stun.CodeBadRequest, integrity)
+		return
+	}
+
+	for _, peer := range peers {
+		if !a.relays.isolation.permits(a.control.RemoteAddr(), peer.IP) {
+			a.control.fail(m, stun.CodeForbidden, integrity)
+			return
+		}
+	}
+
+	a.mutex.Lock()
+
+	for _, peer := range peers {
+		a.permissions[peer.IP.String()] = time.Now().Add(permissionLifetime)
+	}
+
+	a.mutex.Unlock()
+
+	a.control.respond(m, stun.NewType(stun.MethodCreatePermission, stun.ClassSuccessResponse), integrity)
+}
+
+// connect the relay to the peer of the request. Streams take a while to be
+// established over I2P so it is answered in the background.
+func (a *tcpAllocation) connect(m *stun.Message) {
+	integrity, _, ok := a.control.authenticate(m, a.relays.auth)
+
+	if !ok {
+		return
+	}
+
+	var peer stun.XORMappedAddress
+
+	if err := peer.GetFromAs(m, stun.AttrXORPeerAddress); err != nil {
+		a.control.fail(m, stun.CodeBadRequest, integrity)
+		return
+	}
+
+	destination, mapped := a.relays.book.resolve(peer.IP)
+
+	if !mapped || !a.relays.isolation.permits(a.control.RemoteAddr(), peer.IP) {
+		a.control.fail(m, stun.CodeForbidden, integrity)
+		return
+	}
+
+	for _, conn := range a.relays.connectionsOf(a) {
+		if conn.peerAddr.IP.Equal(peer.IP) {
+			a.control.fail(m, stun.CodeConnAlreadyExists, integrity)
+			return
+		}
+	}
+
+	conn := a.relays.register(a, &net.UDPAddr{IP: peer.IP, Port: peer.Port})
+
+	go func() {
+		stream, err := a.relay.Dial(destination)
+
+		if err != nil {
+			a.relays.logger.Debug("turn: could not connect a tcp relay of room %s: %v", a.room, err)
+			conn.close()
+			a.control.fail(m, stun.CodeConnTimeoutOrFailure, integrity)
+
+			return
+		}
+
+		if conn.connected(stream) {
+			a.control.respond(m, stun.NewType(stun.MethodConnect, stun.ClassSuccessResponse), connectionIDAttr(conn.id), integrity)
+		}
+	}()
+}
+
+// throttle waits until n bytes could be relayed and accounts for them. It
+// returns false once the allocation has expired.
+func (a *tcpAllocation) throttle(n int) bool {
+	for !a.bitrate.take(n) {
+		time.Sleep(throttleInterval)
+	}
+
+	for !a.relays.quotas.bandwidth.take(n) {
+		time.Sleep(throttleInterval)
+	}
+
+	return a.relays.quotas.account(a.quota, n, true)
+}
+
+func (a *tcpAllocation) isClosed() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.closed
+}
+
+// close the allocation with its relay and peer connections.
+func (a *tcpAllocation) close() {
+	a.mutex.Lock()
+
+	if a.closed {
+		a.mutex.Unlock()
+		return
+	}
+
+	a.closed = true
+	a.mutex.Unlock()
+
+	a.lifetime.Stop()
+
+	if a.expiry != nil {
+		a.expiry.Stop()
+	}
+
+	for _, conn := range a.relays.connectionsOf(a) {
+		conn.close()
+	}
+
+	a.relay.Close()
+	a.relays.isolation.released(a.relay.Addr())
+	a.relays.book.unpin(a.relay.Addr())
+	a.relays.quotas.release(a.quota)
+}
+
+// connected gives the stream to the peer, which the client must bind in time.
+// It returns false if the connection has been closed in the meantime.
+func (t *tcpConnection) connected(peer net.Conn) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed || t.allocation.isClosed() {
+		peer.Close()
+		t.allocation.relays.forget(t)
+
+		return false
+	}
+
+	t.peer = peer
+	t.timeout = time.AfterFunc(connectionTimeout, t.close)
+
+	return true
+}
+
+// attach the given data connection if the peer connection is waiting for one.
+func (t *tcpConnection) attach(data net.Conn) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed || t.peer == nil || t.data != nil {
+		return false
+	}
+
+	t.timeout.Stop()
+	t.data = data
+
+	return true
+}
+
+// relay data between the peer and data connections until either ends. The
+// given data has already been read from the data connection.
+func (t *tcpConnection) relay(first []byte) {
+	go t.pipe(t.peer, t.data, first)
+	go t.pipe(t.data, t.peer, nil)
+}
+
+func (t *tcpConnection) pipe(dst io.Writer, src io.Reader, first []byte) {
+	defer t.close()
+
+	if len(first) > 0 {
+		if !t.allocation.throttle(len(first)) {
+			return
+		}
+
+		if _, err := dst.Write(first); err != nil {
+			return
+		}
+	}
+
+	buf := make([]byte, relayChunk)
+
+	for {
+		n, err := src.Read(buf)
+
+		if n > 0 {
+			if !t.allocation.throttle(n) {
+				return
+			}
+
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// close the peer and data connections.
+func (t *tcpConnection) close() {
+	t.mutex.Lock()
+
+	if t.closed {
+		t.mutex.Unlock()
+		return
+	}
+
+	t.closed = true
+	peer, data := t.peer, t.data
+
+	if t.timeout != nil {
+		t.timeout.Stop()
+	}
+
+	t.mutex.Unlock()
+
+	if peer != nil {
+		peer.Close()
+	}
+
+	if data != nil {
+		data.Close()
+	}
+
+	t.allocation.relays.forget(t)
+}
+
+// requestedLifetime gives the lifetime of an allocation asked by the given
+// request, within bounds.
+func requestedLifetime(m *stun.Message) time.Duration {
+	raw, err := m.Get(stun.AttrLifetime)
+
+	if err != nil || len(raw) != 4 {
+		return defaultLifetime
+	}
+
+	lifetime := time.Duration(binary.BigEndian.Uint32(raw)) * time.Second
+
+	switch {
+	case lifetime < defaultLifetime:
+		return defaultLifetime
+	case lifetime > maxLifetime:
+		return maxLifetime
+	default:
+		return lifetime
+	}
+}
+
+// peerAddresses retrieves every XOR-PEER-ADDRESS of the given message.
+func peerAddresses(m *stun.Message) []stun.XORMappedAddress {
+	var peers []stun.XORMappedAddress
+
+	for _, attr := range m.Attributes {
+		if attr.Type != stun.AttrXORPeerAddress {
+			continue
+		}
+
+		single := &stun.Message{TransactionID: m.TransactionID}
+		single.WriteHeader()
+		single.Add(attr.Type, attr.Value)
+
+		var peer stun.XORMappedAddress
+
+		if err := peer.GetFromAs(single, attr.Type); err == nil {
+			peers = append(peers, peer)
+		}
+	}
+
+	return peers
+}
+
+func (l lifetimeAttr) AddTo(m *stun.Message) error {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(time.Duration(l)/time.Second))
+	m.Add(stun.AttrLifetime, v)
+
+	return nil
+}
+
+func (id connectionIDAttr) AddTo(m *stun.Message) error {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(id))
+	m.Add(stun.AttrConnectionID, v)
+
+	return nil
+}
+
+func (id *connectionIDAttr) GetFrom(m *stun.Message) error {
+	v, err := m.Get(stun.AttrConnectionID)
+
+	if err != nil {
+		return err
+	}
+
+	if len(v) != 4 {
+		return errors.New("turn: invalid CONNECTION-ID")
+	}
+
+	*id = connectionIDAttr(binary.BigEndian.Uint32(v))
+
+	return nil
+}
+
+func (a addressAttr) AddTo(m *stun.Message) error {
+	return stun.XORMappedAddress{IP: a.addr.IP, Port: a.addr.Port}.AddToAs(m, a.typ)
+}
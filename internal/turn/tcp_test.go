@@ -0,0 +1,397 @@
+package turn
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/yuukanoo/rtchat/internal/logging"
+	"github.com/yuukanoo/rtchat/internal/service"
+
+	"github.com/go-i2p/i2pkeys"
+	"github.com/pion/stun"
+)
+
+type (
+	// testRelay is a stream relay accepting and dialing the given streams.
+	testRelay struct {
+		addr    i2pkeys.I2PAddr
+		accepts chan net.Conn
+		dials   chan net.Conn
+		closed  chan struct{}
+	}
+
+	// addrConn is a connection from the given address.
+	addrConn struct {
+		net.Conn
+		remote net.Addr
+	}
+
+	// tcpClient speaks to a tcpStream as a client would.
+	tcpClient struct {
+		t        *testing.T
+		conn     net.Conn
+		username string
+		password string
+		nonce    string
+	}
+)
+
+func (r *testRelay) Addr() i2pkeys.I2PAddr { return r.addr }
+
+func (r *testRelay) Dial(peer i2pkeys.I2PAddr) (net.Conn, error) {
+	return <-r.dials, nil
+}
+
+func (r *testRelay) Accept() (net.Conn, error) {
+	select {
+	case conn := <-r.accepts:
+		return conn, nil
+	case <-r.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (r *testRelay) Close() error {
+	close(r.closed)
+	return nil
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+
+// send a request with the given setters and reads the response, long-term
+// credentials are added once a nonce is known.
+func (c *tcpClient) send(t stun.MessageType, setters ...stun.Setter) *stun.Message {
+	c.t.Helper()
+
+	setters = append([]stun.Setter{stun.TransactionID, t}, setters...)
+
+	if c.nonce != "" {
+		setters = append(setters,
+			stun.NewUsername(c.username),
+			stun.NewRealm("rtchat"),
+			stun.NewNonce(c.nonce),
+			stun.NewLongTermIntegrity(c.username, "rtchat", c.password),
+		)
+	}
+
+	m, err := stun.Build(append(setters, stun.Fingerprint)...)
+
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	if _, err = c.conn.Write(m.Raw); err != nil {
+		c.t.Fatal(err)
+	}
+
+	return c.read()
+}
+
+// read the next message.
+func (c *tcpClient) read() *stun.Message {
+	c.t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	header := make([]byte, stunHeaderSize)
+
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		c.t.Fatal(err)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[2:4]))
+
+	if _, err := io.ReadFull(c.conn, body); err != nil {
+		c.t.Fatal(err)
+	}
+
+	m := &stun.Message{Raw: append(header, body...)}
+
+	if err := m.Decode(); err != nil {
+		c.t.Fatal(err)
+	}
+
+	return m
+}
+
+// authenticate retrieves a nonce with a first request.
+func (c *tcpClient) authenticate(t stun.MessageType, setters ...stun.Setter) {
+	c.t.Helper()
+
+	m := c.send(t, setters...)
+	code := errorCode(m)
+
+	if code != stun.CodeUnauthorized {
+		c.t.Fatalf("expected a challenge, got %s with %d", m.Type, code)
+	}
+
+	var nonce stun.Nonce
+
+	if err := nonce.GetFrom(m); err != nil {
+		c.t.Fatal(err)
+	}
+
+	c.nonce = nonce.String()
+}
+
+func errorCode(m *stun.Message) stun.ErrorCode {
+	var code stun.ErrorCodeAttribute
+
+	if err := code.GetFrom(m); err != nil {
+		return 0
+	}
+
+	return code.Code
+}
+
+// newTestTCPRelays builds relays with the given stream relay and an
+// authentication handler like the one of the server.
+func newTestTCPRelays(svc service.Service, relay *testRelay) *tcpRelays {
+	logger := logging.New(false)
+	book := newAddressBook()
+	isolation := newIsolation(logger, book)
+	quotas := newQuotas(svc, logger, testOptions{})
+
+	return &tcpRelays{
+		realm:   "rtchat",
+		service: svc,
+		auth: func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			room, key := relayKey(svc, username, realm)
+
+			if room == nil || !quotas.admits(srcAddr, room.ID, username) {
+				return nil, false
+			}
+
+			isolation.authenticated(srcAddr, room.ID)
+
+			return key, true
+		},
+		newRelay:    func() (streamRelay, error) { return relay, nil },
+		book:        book,
+		isolation:   isolation,
+		quotas:      quotas,
+		logger:      logger,
+		nonces:      make(map[string]time.Time),
+		connections: make(map[uint32]*tcpConnection),
+	}
+}
+
+// serve reads the given stream like the turn server, frames it is given are
+// sent to the returned channel.
+func serve(stream *tcpStream) <-chan []byte {
+	frames := make(chan []byte, 10)
+
+	go func() {
+		defer stream.Close()
+
+		b := make([]byte, 1500)
+
+		for {
+			n, err := stream.Read(b)
+
+			if err != nil {
+				close(frames)
+				return
+			}
+
+			frames <- append([]byte(nil), b[:n]...)
+		}
+	}()
+
+	return frames
+}
+
+// connect a client to a new stream of the given relays from the given address.
+func connect(t *testing.T, relays *tcpRelays, remote net.Addr, username, password string) (*tcpClient, *tcpStream) {
+	client, server := net.Pipe()
+	stream := &tcpStream{Conn: &addrConn{server, remote}, relays: relays}
+
+	t.Cleanup(func() { client.Close() })
+
+	return &tcpClient{t: t, conn: client, username: username, password: password}, stream
+}
+
+func TestTCPAllocationRelaysPeers(t *testing.T) {
+	svc := service.New()
+	room := svc.GetRoom(svc.CreateRoom(service.RoomOptions{}))
+	username := room.RelayUsername()
+	relay := &testRelay{addr: destination(2), accepts: make(chan net.Conn), dials: make(chan net.Conn), closed: make(chan struct{})}
+	relays := newTestTCPRelays(svc, relay)
+	clientAddr := relays.book.lookup(destination(1))
+
+	control, stream := connect(t, relays, &net.UDPAddr{IP: clientAddr.IP, Port: 1024}, username, room.RelayPassword(username))
+	frames := serve(stream)
+
+	// Other requests are left to the turn server
+	udp, _ := stun.Build(stun.TransactionID, allocateRequest, stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{17, 0, 0, 0}})
+	go control.conn.Write(udp.Raw)
+
+	if frame := <-frames; string(frame) != string(udp.Raw) {
+		t.Fatal("a udp allocation should be read by the turn server")
+	}
+
+	tcp := stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{protoTCP, 0, 0, 0}}
+	control.authenticate(allocateRequest, tcp)
+
+	m := control.send(allocateRequest, tcp)
+
+	if m.Type != stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse) {
+		t.Fatalf("expected the tcp allocation to succeed, got %s with %d", m.Type, errorCode(m))
+	}
+
+	var relayed stun.XORMappedAddress
+
+	if err := relayed.GetFromAs(m, stun.AttrXORRelayedAddress); err != nil {
+		t.Fatal(err)
+	}
+
+	if d, ok := relays.book.resolve(relayed.IP); !ok || d != relay.addr {
+		t.Fatal("the relayed address should be mapped to the relay")
+	}
+
+	if !relays.isolation.isRelayOf(relay.addr, room.ID) {
+		t.Fatal("the relay should be recorded for the room")
+	}
+
+	// Only relays of the room could be permitted
+	peer := destination(3)
+	relays.isolation.allocated(peer, room.ID)
+	peerAddr := relays.book.pin(peer)
+
+	if m = control.send(createPermissionRequest, addressAttr{relays.book.lookup(destination(4)), stun.AttrXORPeerAddress}); errorCode(m) != stun.CodeForbidden {
+		t.Errorf("expected a permission to a host outside of the room to be forbidden, got %d", errorCode(m))
+	}
+
+	if m = control.send(createPermissionRequest, addressAttr{peerAddr, stun.AttrXORPeerAddress}); m.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("expected the permission to be created, got %d", errorCode(m))
+	}
+
+	// Streams of the peer are announced
+	peerSide, relaySide := net.Pipe()
+	defer peerSide.Close()
+
+	relay.accepts <- &addrConn{relaySide, peer}
+	m = control.read()
+
+	var id connectionIDAttr
+
+	if err := id.GetFrom(m); m.Type != connectionAttempt || err != nil {
+		t.Fatalf("expected a connection attempt, got %s", m.Type)
+	}
+
+	// and relayed once bound to a data connection
+	data, dataStream := connect(t, relays, &net.UDPAddr{IP: clientAddr.IP, Port: 1025}, username, room.RelayPassword(username))
+	dataFrames := serve(dataStream)
+
+	data.authenticate(connectionBindRequest, id)
+
+	if m = data.send(connectionBindRequest, id); m.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("expected the connection to be bound, got %d", errorCode(m))
+	}
+
+	if _, ok := <-dataFrames; ok {
+		t.Fatal("the turn server should stop reading a data connection")
+	}
+
+	go data.conn.Write([]byte("hello"))
+
+	if b := readN(t, peerSide, 5); string(b) != "hello" {
+		t.Errorf("expected the peer to receive the data, got %q", b)
+	}
+
+	go peerSide.Write([]byte("world"))
+
+	if b := readN(t, data.conn, 5); string(b) != "world" {
+		t.Errorf("expected the client to receive the data, got %q", b)
+	}
+
+	if usage := relays.quotas.Usage(room.ID); usage.Allocations != 1 || usage.Bytes != 10 {
+		t.Errorf("expected the relayed bytes to be counted, got %+v", usage)
+	}
+
+	// Closing the control connection deletes everything
+	control.conn.Close()
+
+	if _, err := peerSide.Read(make([]byte, 1)); err == nil {
+		t.Error("the peer connection should be closed with the allocation")
+	}
+
+	if relays.isolation.isRelayOf(relay.addr, room.ID) || relays.quotas.Usage(room.ID).Allocations != 0 {
+		t.Error("the allocation should be released")
+	}
+}
+
+func TestTCPAllocationConnectsPeers(t *testing.T) {
+	svc := service.New()
+	room := svc.GetRoom(svc.CreateRoom(service.RoomOptions{}))
+	username := room.RelayUsername()
+	relay := &testRelay{addr: destination(2), accepts: make(chan net.Conn), dials: make(chan net.Conn, 1), closed: make(chan struct{})}
+	relays := newTestTCPRelays(svc, relay)
+
+	control, stream := connect(t, relays, relays.book.lookup(destination(1)), username, room.RelayPassword(username))
+	serve(stream)
+
+	tcp := stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{protoTCP, 0, 0, 0}}
+	control.authenticate(allocateRequest, tcp)
+
+	if m := control.send(allocateRequest, tcp); m.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("expected the tcp allocation to succeed, got %d", errorCode(m))
+	}
+
+	peer := destination(3)
+	relays.isolation.allocated(peer, room.ID)
+	peerAddr := addressAttr{relays.book.pin(peer), stun.AttrXORPeerAddress}
+
+	if m := control.send(connectRequest, addressAttr{relays.book.lookup(destination(4)), stun.AttrXORPeerAddress}); errorCode(m) != stun.CodeForbidden {
+		t.Errorf("expected a connection outside of the room to be forbidden, got %d", errorCode(m))
+	}
+
+	peerSide, relaySide := net.Pipe()
+	defer peerSide.Close()
+
+	relay.dials <- relaySide
+	m := control.send(connectRequest, peerAddr)
+
+	var id connectionIDAttr
+
+	if err := id.GetFrom(m); m.Type.Class != stun.ClassSuccessResponse || err != nil {
+		t.Fatalf("expected the peer to be connected, got %d", errorCode(m))
+	}
+
+	if m = control.send(connectRequest, peerAddr); errorCode(m) != stun.CodeConnAlreadyExists {
+		t.Errorf("expected a second connection to the peer to be refused, got %d", errorCode(m))
+	}
+
+	// Unbound connections time out
+	relays.connection(uint32(id)).timeout.Reset(0)
+
+	if _, err := peerSide.Read(make([]byte, 1)); err == nil {
+		t.Error("the unbound peer connection should be closed")
+	}
+
+	// Refreshing with a zero lifetime deletes the allocation
+	if m = control.send(refreshRequest, lifetimeAttr(0)); m.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("expected the refresh to succeed, got %d", errorCode(m))
+	}
+
+	select {
+	case <-relay.closed:
+	case <-time.After(time.Second):
+		t.Error("the relay should be closed with the allocation")
+	}
+}
+
+func readN(t *testing.T, conn net.Conn, n int) []byte {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, n)
+
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
@@ -0,0 +1,179 @@
+package turn
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+)
+
+const (
+	stunHeaderSize        = 20
+	channelDataHeaderSize = 4
+	// maxFrameSize is the size of the largest STUN message or ChannelData
+	// message which could be read on a stream.
+	maxFrameSize = stunHeaderSize + 0xffff
+)
+
+type (
+	// sourceListener accepts connections whose allocate requests are handled
+	// one at a time, like the ones of a packet listener, so the client
+	// allocating a relay is known. Other requests and data are not serialized.
+	sourceListener struct {
+		net.Listener
+		refreshed func(net.Addr)
+
+		// Held from the moment an allocate request has been read on a
+		// connection until it reads again.
+		mutex sync.Mutex
+		last  net.Addr
+	}
+
+	// sourceStream is a connection accepted by a sourceListener.
+	sourceStream struct {
+		net.Conn
+		listener *sourceListener
+		handling bool
+		// Incomplete frame of the last read.
+		partial []byte
+	}
+)
+
+// listenTLS opens the TLS listener of the turn server on I2P streams. The
+// destinations of clients are mapped with the given book and TCP allocations
+// are handled by the given relays.
+func listenTLS(options Options, book *addressBook, relays *tcpRelays) (*sourceListener, *streamListener, error) {
+	cert, err := options.Certificate()
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("turn: could not load the tls certificate: %w", err)
+	}
+
+	streams, err := listenStreams(options.SAMAddress(), options.SessionLost)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	l := tls.NewListener(&mappedListener{Listener: streams, book: book}, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+
+	return &sourceListener{Listener: &tcpListener{Listener: l, relays: relays}}, streams, nil
+}
+
+// Accept wraps the accepted connection.
+func (l *sourceListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &sourceStream{Conn: conn, listener: l}, nil
+}
+
+func (l *sourceListener) client() net.Addr {
+	return l.last
+}
+
+// Read releases the listener while waiting for the next request and holds it
+// again if an allocate request has been read, until the turn server reads
+// again once it has handled it.
+func (c *sourceStream) Read(b []byte) (int, error) {
+	c.release()
+
+	n, err := c.Conn.Read(b)
+
+	if n > 0 && c.allocates(b[:n]) {
+		c.listener.mutex.Lock()
+		c.listener.last = c.RemoteAddr()
+		c.handling = true
+	}
+
+	return n, err
+}
+
+// allocates splits the stream in STUN and ChannelData messages, as the turn
+// server does, and checks if an allocate request has been completed by the
+// given data.
+func (c *sourceStream) allocates(b []byte) bool {
+	data := append(c.partial, b...)
+	found := false
+
+	for {
+		size := frameSize(data)
+
+		if size < 0 {
+			// The turn server closes the connection anyway
+			c.partial = nil
+			return found
+		}
+
+		if size == 0 || len(data) < size {
+			break
+		}
+
+		if binary.BigEndian.Uint16(data) == allocateRequest.Value() {
+			found = true
+		}
+
+		data = data[size:]
+	}
+
+	if len(data) > maxFrameSize {
+		data = nil
+	}
+
+	c.partial = append([]byte(nil), data...)
+
+	return found
+}
+
+// frameSize gives the size of the STUN or ChannelData message starting the
+// given data, 0 if its header is incomplete and -1 if it is neither.
+func frameSize(data []byte) int {
+	if len(data) < channelDataHeaderSize {
+		return 0
+	}
+
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+
+	switch data[0] >> 6 {
+	case 0:
+		return stunHeaderSize + length
+	case 1:
+		// ChannelData messages are padded to 4 bytes over streams
+		return channelDataHeaderSize + (length+3)&^3
+	default:
+		return -1
+	}
+}
+
+// Write tells when a refresh succeeds. Messages are written at once on
+// connections of the turn server.
+func (c *sourceStream) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+
+	if err == nil && c.listener.refreshed != nil && isRefresh(b) {
+		c.listener.refreshed(c.RemoteAddr())
+	}
+
+	return n, err
+}
+
+// Close releases the listener if a request was being handled.
+func (c *sourceStream) Close() error {
+	c.release()
+
+	return c.Conn.Close()
+}
+
+func (c *sourceStream) release() {
+	if c.handling {
+		c.handling = false
+		c.listener.mutex.Unlock()
+	}
+}
@@ -0,0 +1,100 @@
+package turn
+
+import (
+	"net"
+	"testing"
+
+	"github.com/pion/stun"
+)
+
+func TestStreamAllocates(t *testing.T) {
+	build := func(typ stun.MessageType) []byte {
+		m, err := stun.Build(stun.TransactionID, typ, stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{17, 0, 0, 0}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return m.Raw
+	}
+
+	allocate := build(allocateRequest)
+	refresh := build(stun.NewType(stun.MethodRefresh, stun.ClassRequest))
+	// Channel data of 3 bytes padded to 4
+	data := []byte{0x40, 0x00, 0x00, 0x03, 1, 2, 3, 0}
+
+	join := func(parts ...[]byte) []byte {
+		var b []byte
+
+		for _, p := range parts {
+			b = append(b, p...)
+		}
+
+		return b
+	}
+
+	tests := []struct {
+		name      string
+		reads     [][]byte
+		allocates []bool
+	}{
+		{"allocate", [][]byte{allocate}, []bool{true}},
+		{"refresh", [][]byte{refresh}, []bool{false}},
+		{"channel data", [][]byte{data}, []bool{false}},
+		{"allocate after other frames", [][]byte{join(refresh, data, allocate)}, []bool{true}},
+		{"split allocate", [][]byte{allocate[:10], allocate[10:]}, []bool{false, true}},
+		{"split channel data", [][]byte{data[:6], join(data[6:], allocate)}, []bool{false, true}},
+		{"allocate then refresh", [][]byte{allocate, refresh}, []bool{true, false}},
+		{"invalid frame", [][]byte{join([]byte{0xff, 0xff, 0, 0}, allocate), refresh}, []bool{false, false}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &sourceStream{}
+
+			for i, read := range test.reads {
+				if got := s.allocates(read); got != test.allocates[i] {
+					t.Errorf("read %d: expected %v, got %v", i, test.allocates[i], got)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamOnlyLocksAroundAllocations(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	listener := &sourceListener{refreshed: func(net.Addr) {}}
+	stream := &sourceStream{Conn: server, listener: listener}
+	defer stream.Close()
+
+	read := func(frame []byte) {
+		go client.Write(frame)
+
+		if _, err := stream.Read(make([]byte, 1500)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	refresh, _ := stun.Build(stun.TransactionID, stun.NewType(stun.MethodRefresh, stun.ClassRequest))
+	allocate, _ := stun.Build(stun.TransactionID, allocateRequest)
+
+	read(refresh.Raw)
+
+	if !listener.mutex.TryLock() {
+		t.Fatal("the listener should not be held while handling a refresh")
+	}
+
+	listener.mutex.Unlock()
+
+	read(allocate.Raw)
+
+	if listener.mutex.TryLock() {
+		t.Fatal("the listener should be held while handling an allocation")
+	}
+
+	if listener.client() != server.RemoteAddr() {
+		t.Errorf("expected the allocating client to be %s, got %s", server.RemoteAddr(), listener.client())
+	}
+}
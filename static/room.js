@@ -20,24 +20,338 @@
     // Update the local preview element source
     document.querySelector('video.local').srcObject = stream;
 
-    // Let's open the websocket connection for this particular room
-    const ws = new WebSocket(((window.location.protocol === "https:") ? "wss://" : "ws://") + window.location.host + "/ws/" + config.roomID, config.roomCred);
+    // Capabilities announced to the server during the handshake
+    const capabilities = [];
 
-    // Upon close, show an alert and go back to the web root
-    ws.onclose = function() {
-        for (const id in peers) {
-            peers[id].close();
+    // Ask the forwarding unit for a single mixed audio track with ?mix
+    if (new URLSearchParams(window.location.search).has('mix')) {
+        capabilities.push('mix');
+    }
+
+    // Informations about our session, received in the hello message
+    let session = null;
+
+    // Profiles and media states of other members in the room indexed by their id
+    const members = {};
+    const mediaStates = {};
+
+    // Identifiers of every other member, needed to connect with them when the
+    // room switches back to a mesh
+    const others = new Set();
+
+    // Roles of other members in broadcast rooms indexed by their id
+    const roles = {};
+
+    // Our screen share if any and the purpose of tracks published by others
+    // indexed by their id, which is kept by the forwarding unit
+    let screen = null;
+    const purposes = {};
+
+    // Time given to the forwarding unit to take over before our direct
+    // connections are closed
+    const migrationDelay = 5000;
+
+    // Whether the room is being recorded and if we have been asked for our
+    // consent during this session
+    let recording = false;
+    let consentAsked = false;
+
+    // Our own profile, the name is kept between visits
+    const profile = {
+        name: localStorage.getItem('rtchat.name') || prompt('What is your name?') || '',
+    };
+
+    if (profile.name) {
+        localStorage.setItem('rtchat.name', profile.name);
+    }
+
+    // Our media state, shared with everyone in the room
+    const media = {
+        audio: !!stream && stream.getAudioTracks().length > 0,
+        video: !!stream && stream.getVideoTracks().length > 0,
+        screen: false,
+        hand: false,
+        speaking: false,
+    };
+
+    // Maximum number of attempts to resume our session when the connection drops
+    const maxReconnectAttempts = 5;
+    let reconnectAttempts = 0;
+
+    let ws = null;
+
+    // When websockets could not be used, we fallback to Server-Sent Events for
+    // incoming messages and HTTP POST requests for outgoing ones.
+    let events = null;
+    let eventsSession = null;
+    let useEvents = false;
+
+    connect();
+
+    function connect() {
+        if (useEvents) {
+            connectEvents();
+        } else {
+            connectWebSocket();
+        }
+    }
+
+    /**
+     * Open the websocket connection for this particular room. The room
+     * credential is given as a subprotocol without its padding since "=" is not
+     * a valid token character. If we already have a session, we try to resume it.
+     */
+    function connectWebSocket() {
+        const protocols = ["rtchat.v1", "rtchat.auth." + config.roomCred.replace(/=+$/, "")];
+
+        if (session) {
+            protocols.push("rtchat.resume." + session.resumeToken.replace(/=+$/, ""));
+        }
+
+        if (config.moderatorKey) {
+            protocols.push("rtchat.moderator." + config.moderatorKey.replace(/=+$/, ""));
+        }
+
+        let opened = false;
+
+        ws = new WebSocket(
+            ((window.location.protocol === "https:") ? "wss://" : "ws://") + window.location.host + "/ws/" + config.roomID + "?caps=" + capabilities.join(","),
+            protocols,
+        );
+
+        ws.onopen = function() {
+            opened = true;
+        }
+
+        ws.onclose = function() {
+            ws = null;
+
+            // The upgrade has probably been mangled by a proxy
+            if (!opened && !session) {
+                useEvents = true;
+                connect();
+                return;
+            }
+
+            onClose();
+        }
+
+        ws.onmessage = onMessage;
+    }
+
+    /**
+     * Open the event stream for this particular room.
+     */
+    function connectEvents() {
+        const params = new URLSearchParams({
+            cred: config.roomCred,
+            caps: capabilities.join(","),
+        });
+
+        if (session) {
+            params.set("resume", session.resumeToken);
         }
 
+        if (config.moderatorKey) {
+            params.set("mod", config.moderatorKey);
+        }
+
+        events = new EventSource("/rooms/" + config.roomID + "/events?" + params.toString());
+
+        events.addEventListener("session", function(e) {
+            eventsSession = e.data;
+        });
+
+        events.onmessage = onMessage;
+
+        // Prevent the browser from reconnecting by itself since it would not
+        // resume our session.
+        events.onerror = function() {
+            events.close();
+            events = null;
+            eventsSession = null;
+            onClose();
+        }
+    }
+
+    /**
+     * Send a message to the server using the available transport.
+     */
+    function send(msg) {
+        if (ws) {
+            ws.send(JSON.stringify(msg));
+            return;
+        }
+
+        if (!eventsSession) {
+            return;
+        }
+
+        fetch("/rooms/" + config.roomID + "/messages?session=" + encodeURIComponent(eventsSession), {
+            method: "POST",
+            headers: {
+                "Authorization": "Bearer " + config.roomCred,
+                "Content-Type": "application/json",
+            },
+            body: JSON.stringify(msg),
+        });
+    }
+
+    /**
+     * Upon close, try to resume the session and if it fails, show an alert.
+     */
+    function onClose() {
+        if (session && reconnectAttempts < maxReconnectAttempts) {
+            reconnectAttempts++;
+            setTimeout(connect, 1000 * reconnectAttempts);
+            return;
+        }
+
+        closePeers();
+
         alert('communication closed, nothing to see anymore');
     }
 
-    ws.onmessage = async function(e) {
+    function closePeers() {
+        for (const id in peers) {
+            removePeer(id);
+        }
+
+        // Streams received from the forwarding unit do not have their own peer
+        for (const videoEle of document.querySelectorAll('video.videos__peer:not(.local)')) {
+            videoEle.remove();
+        }
+    }
+
+    async function onMessage(e) {
         const msg = JSON.parse(e.data);
 
         console.info(msg);
 
+        if (msg.hello) {
+            // If we could not resume our session, others have seen us leave so
+            // every connection should be started again.
+            if (session && session.id !== msg.hello.id) {
+                closePeers();
+            }
+
+            session = msg.hello;
+            reconnectAttempts = 0;
+
+            // Viewers of broadcast rooms only watch presenters
+            if (session.role === 'viewer' && stream) {
+                for (const track of stream.getTracks()) {
+                    track.stop();
+                }
+
+                stream = null;
+                media.audio = false;
+                media.video = false;
+                document.querySelector('video.local').hidden = true;
+            }
+
+            document.querySelector('.controls__screen').hidden = session.role === 'viewer';
+
+            // Moderators could start and stop recordings
+            document.querySelector('.controls__record').hidden = !(msg.hello.moderator && msg.hello.features.recording);
+
+            if (!msg.hello.resumed) {
+                consentAsked = false;
+
+                if (profile.name) {
+                    send({
+                        presence: profile,
+                    });
+                }
+
+                sendMedia();
+                sendTracks();
+            }
+        }
+
+        if (msg.roster) {
+            for (const member of msg.roster.members) {
+                others.add(member.id);
+                roles[member.id] = member.role;
+                updateTracks(member.id, member.tracks);
+                updateMember(member.id, member.presence);
+                updateMedia(member.id, member.media);
+            }
+
+            // Presenters always make the offer to viewers, even those who were
+            // there first
+            if (session.role === 'presenter' && !session.sfu) {
+                for (const member of msg.roster.members) {
+                    if (member.role === 'viewer' && !peers[member.id]) {
+                        sendOffer(member.id, await createPeer(member.id));
+                    }
+                }
+            }
+        }
+
+        if (msg.presence) {
+            updateMember(msg.presence.id, msg.presence);
+        }
+
+        if (msg.media) {
+            updateMedia(msg.media.id, msg.media);
+        }
+
+        if (msg.tracks) {
+            if (msg.tracks.id === session.id) {
+                // Our screen share has been refused by the server policy
+                if (screen && !msg.tracks.tracks.some(t => t.purpose === 'screen')) {
+                    stopScreen();
+                    alert('you are not allowed to share your screen right now');
+                }
+            } else {
+                updateTracks(msg.tracks.id, msg.tracks.tracks);
+            }
+        }
+
+        if (msg.chat) {
+            appendChat(msg.from, msg.chat);
+        }
+
+        if (msg.recording) {
+            recording = msg.recording.active;
+            document.querySelector('.room__recording').hidden = !recording;
+            document.querySelector('.controls__record').textContent = recording ? 'Stop recording' : 'Start recording';
+
+            if (recording && msg.recording.consent && !consentAsked) {
+                consentAsked = true;
+                send({
+                    consent: { recording: confirm('This room is being recorded, do you agree to be recorded?') },
+                });
+            }
+        }
+
+        if (msg.switch) {
+            session.sfu = msg.switch.sfu || '';
+
+            if (session.sfu) {
+                // The forwarding unit will make its offer, our direct connections
+                // are kept until it has taken over.
+                setTimeout(closeMeshPeers, migrationDelay);
+            } else {
+                // Back to a mesh, the member with the lowest id makes the offer
+                for (const id of others) {
+                    if (!peers[id] && makesOffer(id)) {
+                        sendOffer(id, await createPeer(id));
+                    }
+                }
+            }
+        }
+
+        // When the server forwards streams, it makes every offer and we only
+        // connect to it.
         if (msg.joined) {
+            others.add(msg.joined.id);
+            roles[msg.joined.id] = msg.joined.role;
+        }
+
+        // Viewers wait for presenters to make their offer
+        if (msg.joined && !session.sfu && session.role !== 'viewer') {
             // New user has joined, let's starts an RTCPeerConnection for this user
             // and make an offer.
             const peer = await createPeer(msg.joined.id);
@@ -53,10 +367,14 @@
         }
 
         if (msg.left) {
+            others.delete(msg.left.id);
+            delete roles[msg.left.id];
             removePeer(msg.left.id);
+            delete members[msg.left.id];
+            delete mediaStates[msg.left.id];
         }
 
-        if (msg.offer) {
+        if (msg.offer && (!session.sfu || msg.from === session.sfu)) {
             // An offer has been made by someone else, create an RTCPeerConnection
             // and sends an answer
             const peer = peers[msg.from] || await createPeer(msg.from);
@@ -64,23 +382,39 @@
             const answer = await peer.createAnswer();
             await peer.setLocalDescription(answer);
 
-            ws.send(JSON.stringify({
+            send({
                 answer,
                 to: msg.from,
-            }));
+            });
         }
 
-        if (msg.answer) {
+        if (msg.answer && peers[msg.from]) {
             const peer = peers[msg.from];
             peer.setRemoteDescription(msg.answer);
         }
 
-        if (msg.ice) {
+        if (msg.ice && peers[msg.from]) {
             const peer = peers[msg.from];
             peer.addIceCandidate(msg.ice);
         }
     }
 
+    /**
+     * Checks if we should make the offer to the given member when connecting
+     * with everyone. In broadcast rooms, presenters always make it to viewers.
+     */
+    function makesOffer(id) {
+        if (session.role === 'viewer') {
+            return false;
+        }
+
+        if (session.role === 'presenter' && roles[id] === 'viewer') {
+            return true;
+        }
+
+        return session.id < id;
+    }
+
     /**
      * Sends an offer using the given peer. It will affect the local description
      * as well as signalying the offer on the websocket.
@@ -88,10 +422,254 @@
     async function sendOffer(to, peer, offerOptions) {
         const offer = await peer.createOffer(offerOptions);
         await peer.setLocalDescription(offer);
-        ws.send(JSON.stringify({
+        send({
             offer,
             to,
-        }));
+        });
+    }
+
+    // Toggle our microphone
+    document.querySelector('.controls__audio').onclick = function(e) {
+        if (!stream) {
+            return;
+        }
+
+        media.audio = !media.audio;
+
+        for (const track of stream.getAudioTracks()) {
+            track.enabled = media.audio;
+        }
+
+        e.target.textContent = media.audio ? 'Mute' : 'Unmute';
+        sendMedia();
+    }
+
+    // Raise or lower our hand
+    document.querySelector('.controls__hand').onclick = function(e) {
+        media.hand = !media.hand;
+        e.target.textContent = media.hand ? 'Lower hand' : 'Raise hand';
+        sendMedia();
+    }
+
+    // Share our screen or stop sharing it
+    document.querySelector('.controls__screen').onclick = async function() {
+        if (screen) {
+            stopScreen();
+            return;
+        }
+
+        try {
+            screen = await navigator.mediaDevices.getDisplayMedia({ video: true });
+        } catch {
+            return;
+        }
+
+        for (const track of screen.getTracks()) {
+            // Stopped from the browser interface
+            track.onended = stopScreen;
+
+            for (const id in peers) {
+                peers[id].addTrack(track, screen);
+            }
+        }
+
+        media.screen = true;
+        document.querySelector('.controls__screen').textContent = 'Stop sharing';
+
+        // The server should know the purpose of our tracks before receiving them
+        sendTracks();
+        sendMedia();
+        renegotiate();
+    }
+
+    /**
+     * Stop sharing our screen and remove its tracks from every connection.
+     */
+    function stopScreen() {
+        if (!screen) {
+            return;
+        }
+
+        const tracks = screen.getTracks();
+
+        for (const id in peers) {
+            for (const sender of peers[id].getSenders()) {
+                if (tracks.includes(sender.track)) {
+                    peers[id].removeTrack(sender);
+                }
+            }
+        }
+
+        for (const track of tracks) {
+            track.stop();
+        }
+
+        screen = null;
+        media.screen = false;
+        document.querySelector('.controls__screen').textContent = 'Share screen';
+
+        sendTracks();
+        sendMedia();
+        renegotiate();
+    }
+
+    /**
+     * Make a new offer to every peer after our tracks have changed.
+     */
+    function renegotiate() {
+        for (const id in peers) {
+            sendOffer(id, peers[id]);
+        }
+    }
+
+    /**
+     * Tell the room the purpose of each track we publish.
+     */
+    function sendTracks() {
+        const tracks = [];
+
+        if (stream) {
+            for (const track of stream.getTracks()) {
+                tracks.push({ stream: stream.id, track: track.id, purpose: track.kind === 'audio' ? 'microphone' : 'camera' });
+            }
+        }
+
+        if (screen) {
+            for (const track of screen.getTracks()) {
+                tracks.push({ stream: screen.id, track: track.id, purpose: 'screen' });
+            }
+        }
+
+        send({
+            tracks: { tracks },
+        });
+    }
+
+    // Start or stop the recording of the room, moderators only
+    document.querySelector('.controls__record').onclick = function() {
+        send({
+            record: { active: !recording },
+        });
+    }
+
+    function sendMedia() {
+        send({
+            media,
+        });
+    }
+
+    // Send chat messages when submitting the form
+    document.querySelector('.chat__form').onsubmit = function(e) {
+        e.preventDefault();
+
+        const input = document.querySelector('.chat__input');
+
+        if (!input.value.trim()) {
+            return;
+        }
+
+        send({
+            chat: { text: input.value },
+        });
+
+        input.value = '';
+    }
+
+    /**
+     * Append a chat message to the list. Text is never interpreted as html.
+     */
+    function appendChat(from, chat) {
+        const list = document.querySelector('.chat__messages');
+        const item = document.createElement('li');
+        const author = document.createElement('span');
+
+        author.classList.add('chat__author');
+        author.textContent = from === session.id ? profile.name || 'me' : (members[from] ? members[from].name : from.substring(0, 8));
+        author.title = new Date(chat.time).toLocaleString();
+
+        item.appendChild(author);
+        item.appendChild(document.createTextNode(chat.text));
+        list.appendChild(item);
+        list.scrollTop = list.scrollHeight;
+    }
+
+    /**
+     * Keep track of a member profile and update its video element if any.
+     */
+    function updateMember(id, presence) {
+        if (!presence) {
+            return;
+        }
+
+        members[id] = presence;
+
+        const videoEle = findVideoElement(id);
+
+        if (videoEle) {
+            videoEle.title = presence.name;
+        }
+    }
+
+    /**
+     * Reflect the media state of a member on its video element.
+     */
+    function updateMedia(id, state) {
+        if (!state) {
+            return;
+        }
+
+        mediaStates[id] = state;
+
+        const videoEle = findVideoElement(id);
+
+        if (videoEle) {
+            videoEle.classList.toggle('videos__peer--muted', !state.audio);
+            videoEle.classList.toggle('videos__peer--hand', state.hand);
+        }
+    }
+
+    /**
+     * Keep track of the purpose of the tracks published by a member and remove
+     * its screen share when it has stopped.
+     */
+    function updateTracks(id, tracks) {
+        if (!tracks) {
+            return;
+        }
+
+        for (const track of tracks) {
+            purposes[track.track] = track.purpose;
+        }
+
+        if (!tracks.some(t => t.purpose === 'screen')) {
+            removeScreenElement(id);
+        }
+    }
+
+    /**
+     * Retrieve the element showing the screen share of a member or create it.
+     */
+    function createScreenElement(id) {
+        let videoEle = document.querySelector('video[data-screen="' + id + '"]');
+
+        if (!videoEle) {
+            videoEle = document.createElement('video');
+            videoEle.classList.add('videos__peer', 'videos__peer--screen');
+            videoEle.dataset.screen = id;
+            videoEle.autoplay = true;
+            videoEle.muted = true;
+            document.querySelector('.videos').appendChild(videoEle);
+        }
+
+        return videoEle;
+    }
+
+    function removeScreenElement(id) {
+        const videoEle = document.querySelector('video[data-screen="' + id + '"]');
+
+        if (videoEle) {
+            videoEle.remove();
+        }
     }
 
     function findVideoElement(id) {
@@ -105,14 +683,12 @@
     async function createPeer(id) {
         const peer = new RTCPeerConnection(config); // Config here comes from the html template
 
-        let videoEle = findVideoElement(id);
+        // The forwarding unit sends the streams of every other member, each one
+        // identified by the member id.
+        const forwarded = id === session.sfu;
 
-        if (!videoEle) {
-            videoEle = document.createElement('video');
-            videoEle.classList.add('videos__peer');
-            videoEle.dataset.id = id;
-            videoEle.autoplay = true;
-            document.querySelector('.videos').appendChild(videoEle);
+        if (!forwarded) {
+            createVideoElement(id);
         }
 
         // Append our tracks if we have a valid stream.
@@ -122,6 +698,12 @@
             }
         }
 
+        if (screen) {
+            for (const track of screen.getTracks()) {
+                peer.addTrack(track, screen);
+            }
+        }
+
         // When track are added in the other side, sets the video element src to
         // the stream in use.
         peer.ontrack = function(e) {
@@ -129,6 +711,26 @@
                 return;
             }
 
+            // Voices of every other member mixed by the forwarding unit
+            if (forwarded && e.streams[0].id === 'mix') {
+                createAudioElement().srcObject = e.streams[0];
+                return;
+            }
+
+            const member = forwarded ? e.streams[0].id : id;
+
+            // The forwarding unit has taken over our direct connection
+            if (forwarded && peers[member]) {
+                closePeer(member);
+            }
+
+            // Screen shares are shown next to the camera of their member
+            if (purposes[e.track.id] === 'screen') {
+                createScreenElement(member).srcObject = new MediaStream([e.track]);
+                return;
+            }
+
+            const videoEle = createVideoElement(member);
             videoEle.srcObject = e.streams[0];
         }
 
@@ -139,10 +741,10 @@
                 return;
             }
 
-            ws.send(JSON.stringify({
+            send({
                 ice: e.candidate,
                 to: id,
-            }));
+            });
         }
 
         // Append it to our list of peers for this room.
@@ -151,15 +753,83 @@
         return peer;
     }
 
+    /**
+     * Retrieve the video element of a member or create it.
+     */
+    function createVideoElement(id) {
+        let videoEle = findVideoElement(id);
+
+        if (!videoEle) {
+            videoEle = document.createElement('video');
+            videoEle.classList.add('videos__peer');
+            videoEle.dataset.id = id;
+            videoEle.autoplay = true;
+            videoEle.title = members[id] ? members[id].name : '';
+            document.querySelector('.videos').appendChild(videoEle);
+            updateMedia(id, mediaStates[id]);
+        }
+
+        return videoEle;
+    }
+
+    /**
+     * Retrieve the element playing the mixed audio or create it.
+     */
+    function createAudioElement() {
+        let audioEle = document.querySelector('audio.mix');
+
+        if (!audioEle) {
+            audioEle = document.createElement('audio');
+            audioEle.classList.add('mix');
+            audioEle.autoplay = true;
+            document.body.appendChild(audioEle);
+        }
+
+        return audioEle;
+    }
+
+    /**
+     * Close the connection with a peer but keep its video element.
+     */
+    function closePeer(id) {
+        peers[id].close();
+        delete peers[id];
+    }
+
+    /**
+     * Close direct connections which have not been replaced by the forwarding
+     * unit.
+     */
+    function closeMeshPeers() {
+        if (!session.sfu) {
+            return;
+        }
+
+        for (const id in peers) {
+            if (id !== session.sfu) {
+                removePeer(id);
+            }
+        }
+    }
+
     /**
      * Remove a peer from the collection and close the connection.
      */
     async function removePeer(id) {
         const peer = peers[id];
-        await peer.close();
-        delete peers[id];
+
+        if (peer) {
+            delete peers[id];
+            await peer.close();
+        }
 
         // Remove the video html element for this user
-        findVideoElement(id).remove();
+        const videoEle = findVideoElement(id);
+
+        if (videoEle) {
+            videoEle.remove();
+        }
+
+        removeScreenElement(id);
     }
 })();
\ No newline at end of file